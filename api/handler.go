@@ -0,0 +1,413 @@
+// Package api exposes the queue as a JSON HTTP API.
+//
+//	GET    /tasks                          list tasks, see parseTaskQuery
+//	POST   /tasks                          queue a task
+//	GET    /tasks/{id}                     get a task
+//	DELETE /tasks/{id}                     remove a task which is not started
+//	GET    /logs/{id}                      youtube-dl log of a task as text
+//	GET    /failed_tasks                   list failed tasks
+//	DELETE /failed_tasks/{id}              remove a failed task
+//	POST   /failed_tasks/{id}/requeue      requeue a failed task
+//	GET    /status                         worker status
+//
+// {id} is the job id of a task. Lists of failed tasks are narrowed
+// to one video by the video_id query parameter.
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	queue "github.com/satom9to5/youtube-dl-queue"
+)
+
+var errInvalidId = errors.New("id must be a job id.")
+
+type Handler struct {
+	queue *queue.Queue
+}
+
+// NewHandler serves the default queue.
+func NewHandler() *Handler {
+	return NewQueueHandler(queue.Default())
+}
+
+func NewQueueHandler(q *queue.Queue) *Handler {
+	return &Handler{queue: q}
+}
+
+// TaskRequest is the body of POST /tasks.
+type TaskRequest struct {
+	Url         string `json:"url"`
+	VideoFormat string `json:"video_format"`
+	AudioFormat string `json:"audio_format"`
+	Title       string `json:"title"`
+	OutputPath  string `json:"output_path"`
+	// Format is a format selection expression, selecting the formats
+	// instead of VideoFormat and AudioFormat.
+	Format string `json:"format"`
+	// Parameters are the extra downloader arguments, or Parameter
+	// holds them as one string split as a shell does.
+	Parameters []string              `json:"parameters"`
+	Parameter  string                `json:"parameter"`
+	Downloader string                `json:"downloader"`
+	Options    queue.DownloadOptions `json:"options"`
+}
+
+// Task returns the task requested.
+func (request TaskRequest) Task() (task queue.Task, err error) {
+	task = queue.Task{
+		Url:         request.Url,
+		VideoFormat: request.VideoFormat,
+		AudioFormat: request.AudioFormat,
+		Format:      request.Format,
+		Title:       request.Title,
+		OutputPath:  request.OutputPath,
+		Parameters:  request.Parameters,
+		Downloader:  request.Downloader,
+		Options:     request.Options,
+	}
+
+	if request.Parameter != "" {
+		if len(request.Parameters) > 0 {
+			return task, fmt.Errorf("parameter and parameters are exclusive: %w", queue.ErrInvalidParameter)
+		}
+
+		if task.Parameters, err = queue.ParseParameters(request.Parameter); err != nil {
+			return task, err
+		}
+	}
+
+	return task, nil
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	paths := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	switch {
+	case len(paths) == 1 && paths[0] == "tasks":
+		switch r.Method {
+		case http.MethodGet:
+			h.listTasks(w, r)
+		case http.MethodPost:
+			h.createTask(w, r)
+		default:
+			methodNotAllowed(w, http.MethodGet, http.MethodPost)
+		}
+	case len(paths) == 2 && paths[0] == "tasks":
+		switch r.Method {
+		case http.MethodGet:
+			h.getTask(w, r, paths[1])
+		case http.MethodDelete:
+			h.deleteTask(w, r, paths[1])
+		default:
+			methodNotAllowed(w, http.MethodGet, http.MethodDelete)
+		}
+	case len(paths) == 1 && paths[0] == "failed_tasks":
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		h.listFailedTasks(w, r)
+	case len(paths) == 2 && paths[0] == "failed_tasks":
+		if r.Method != http.MethodDelete {
+			methodNotAllowed(w, http.MethodDelete)
+			return
+		}
+		h.deleteFailedTask(w, r, paths[1])
+	case len(paths) == 3 && paths[0] == "failed_tasks" && paths[2] == "requeue":
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, http.MethodPost)
+			return
+		}
+		h.requeueFailedTask(w, r, paths[1])
+	case len(paths) == 2 && paths[0] == "logs":
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		h.getLog(w, r, paths[1])
+	case len(paths) == 1 && paths[0] == "status":
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		h.getStatus(w, r)
+	default:
+		writeError(w, http.StatusNotFound, errors.New("not found."))
+	}
+}
+
+func (h *Handler) listTasks(w http.ResponseWriter, r *http.Request) {
+	query, err := parseTaskQuery(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	tasks, err := h.queue.QueryTasks(query)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, tasks)
+}
+
+// parseTaskQuery reads the filters of GET /tasks. Lists are comma separated.
+//
+//	id, video_id, status, video_format, audio_format   lists
+//	created_after, created_before                      unix seconds
+//	started_after, started_before                      unix seconds
+//	title                                              substring
+//	order, asc                                         sort field, true for ascending
+//	limit, offset                                      pagination
+func parseTaskQuery(values url.Values) (query queue.TaskQuery, err error) {
+	for _, id := range splitParam(values.Get("id")) {
+		jobId, err := parseId(id)
+		if err != nil {
+			return query, err
+		}
+		query.Ids = append(query.Ids, jobId)
+	}
+
+	query.VideoIds = splitParam(values.Get("video_id"))
+	query.VideoFormats = splitParam(values.Get("video_format"))
+	query.AudioFormats = splitParam(values.Get("audio_format"))
+
+	for _, status := range splitParam(values.Get("status")) {
+		query.Statuses = append(query.Statuses, queue.TaskStatus(status))
+	}
+
+	for name, v := range map[string]*int64{
+		"created_after":  &query.CreatedAfter,
+		"created_before": &query.CreatedBefore,
+		"started_after":  &query.StartedAfter,
+		"started_before": &query.StartedBefore,
+	} {
+		if values.Get(name) == "" {
+			continue
+		}
+		if *v, err = strconv.ParseInt(values.Get(name), 10, 64); err != nil {
+			return query, fmt.Errorf("%s must be unix seconds.", name)
+		}
+	}
+
+	for name, v := range map[string]*int{
+		"limit":  &query.Limit,
+		"offset": &query.Offset,
+	} {
+		if values.Get(name) == "" {
+			continue
+		}
+		if *v, err = strconv.Atoi(values.Get(name)); err != nil {
+			return query, fmt.Errorf("%s must be a number.", name)
+		}
+	}
+
+	query.Title = values.Get("title")
+	query.OrderBy = queue.TaskOrder(values.Get("order"))
+	query.Ascending = values.Get("asc") == "true"
+
+	return query, nil
+}
+
+func splitParam(value string) []string {
+	if value == "" {
+		return nil
+	}
+
+	return strings.Split(value, ",")
+}
+
+func (h *Handler) createTask(w http.ResponseWriter, r *http.Request) {
+	request := TaskRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	task, err := request.Task()
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+
+	if err := h.queue.QueueTask(&task); err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, task)
+}
+
+func (h *Handler) getTask(w http.ResponseWriter, r *http.Request, id string) {
+	jobId, err := parseId(id)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+
+	task, err := h.queue.GetTask(jobId)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, task)
+}
+
+func (h *Handler) deleteTask(w http.ResponseWriter, r *http.Request, id string) {
+	jobId, err := parseId(id)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+
+	if err := h.queue.RemoveTask(jobId); err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) listFailedTasks(w http.ResponseWriter, r *http.Request) {
+	var (
+		failedTasks []queue.FailedTask
+		err         error
+	)
+
+	if videoId := r.URL.Query().Get("video_id"); videoId != "" {
+		failedTasks, err = h.queue.GetFailedTasksByVideoId(videoId)
+	} else {
+		failedTasks, err = h.queue.GetAllFailedTasks()
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, failedTasks)
+}
+
+func (h *Handler) deleteFailedTask(w http.ResponseWriter, r *http.Request, id string) {
+	jobId, err := parseId(id)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+
+	if err := h.queue.RemoveFailedTask(jobId); err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) requeueFailedTask(w http.ResponseWriter, r *http.Request, id string) {
+	jobId, err := parseId(id)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+
+	failedTask, err := h.queue.GetFailedTask(jobId)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+
+	task, err := h.queue.RequeueTask(failedTask)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, task)
+}
+
+func (h *Handler) getLog(w http.ResponseWriter, r *http.Request, id string) {
+	jobId, err := parseId(id)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+
+	file, err := os.Open(h.queue.LogPath(jobId))
+	if os.IsNotExist(err) {
+		writeError(w, http.StatusNotFound, errors.New("log is not found."))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.Copy(w, file)
+}
+
+func (h *Handler) getStatus(w http.ResponseWriter, r *http.Request) {
+	status, err := h.queue.GetWorkerStatus()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, status)
+}
+
+func parseId(id string) (int64, error) {
+	jobId, err := strconv.ParseInt(id, 10, 64)
+	if err != nil || jobId <= 0 {
+		return 0, errInvalidId
+	}
+
+	return jobId, nil
+}
+
+func errorStatus(err error) int {
+	if errors.Is(err, queue.ErrInvalidQuery) || errors.Is(err, queue.ErrInvalidParameter) || errors.Is(err, queue.ErrInvalidOptions) || errors.Is(err, queue.ErrInvalidFormat) {
+		return http.StatusBadRequest
+	}
+
+	switch err {
+	case queue.ErrInvalidUrl, queue.ErrUnknownDownloader, errInvalidId:
+		return http.StatusBadRequest
+	case queue.ErrTaskNotFound:
+		return http.StatusNotFound
+	case queue.ErrDuplicateTask, queue.ErrTaskRunning:
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func methodNotAllowed(w http.ResponseWriter, methods ...string) {
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed."))
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,382 @@
+package api
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	queue "github.com/satom9to5/youtube-dl-queue"
+)
+
+func newServerForTest(t *testing.T) *httptest.Server {
+	f, err := ioutil.TempFile("", "youtube-dl-queue-api-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	db, err := sql.Open("sqlite3", f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := queue.InitializeSchema(db); err != nil {
+		t.Fatal(err)
+	}
+
+	return httptest.NewServer(NewHandler())
+}
+
+func queueTaskForTest(t *testing.T, url string, videoFormat string) queue.Task {
+	task := queue.Task{
+		Url:         url,
+		VideoFormat: videoFormat,
+		AudioFormat: "140",
+		Title:       "Test",
+		OutputPath:  "/tmp/output",
+	}
+
+	if err := task.QueueTask(); err != nil {
+		t.Fatal(err)
+	}
+
+	return task
+}
+
+func doRequestForTest(t *testing.T, method string, url string, body interface{}, v interface{}) int {
+	var reader *bytes.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(b)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	request, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	if v != nil {
+		if err := json.NewDecoder(response.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return response.StatusCode
+}
+
+func TestCreateTask(t *testing.T) {
+	server := newServerForTest(t)
+	defer server.Close()
+
+	request := TaskRequest{
+		Url:         "https://www.youtube.com/watch?v=CreateTask",
+		VideoFormat: "137",
+		AudioFormat: "140",
+		OutputPath:  "/tmp/output",
+	}
+
+	task := queue.Task{}
+	if status := doRequestForTest(t, http.MethodPost, server.URL+"/tasks", request, &task); status != http.StatusCreated {
+		t.Fatalf("different status! %d", status)
+	}
+
+	if task.Id == 0 || task.VideoId != "CreateTask" || task.CreatedAt == 0 {
+		t.Fatalf("different task! %s", task)
+	}
+
+	// the same download again
+	response := errorResponse{}
+	if status := doRequestForTest(t, http.MethodPost, server.URL+"/tasks", request, &response); status != http.StatusConflict {
+		t.Fatalf("different status! %d", status)
+	}
+
+	if response.Error != queue.ErrDuplicateTask.Error() {
+		t.Fatalf("different error! %s", response.Error)
+	}
+
+	// same video in another format
+	request.VideoFormat = "136"
+	if status := doRequestForTest(t, http.MethodPost, server.URL+"/tasks", request, nil); status != http.StatusCreated {
+		t.Fatalf("different status! %d", status)
+	}
+
+	// parameters as a list, or as one string split as a shell does
+	for i, parameters := range []TaskRequest{
+		{Parameters: []string{"--write-sub", "--sub-lang", "en"}},
+		{Parameter: "--write-sub --sub-lang 'en'"},
+	} {
+		parameters.Url = "https://www.youtube.com/watch?v=CreateTaskParameters"
+		parameters.VideoFormat = "137"
+		parameters.AudioFormat = "140"
+		parameters.OutputPath = "/tmp/output" + strconv.Itoa(i)
+
+		task := queue.Task{}
+		if status := doRequestForTest(t, http.MethodPost, server.URL+"/tasks", parameters, &task); status != http.StatusCreated {
+			t.Fatalf("%+v: different status! %d", parameters, status)
+		}
+
+		if task.Parameters.String() != "--write-sub --sub-lang en" {
+			t.Fatalf("%+v: different parameters! %q", parameters, task.Parameters)
+		}
+	}
+
+	// formats by a format selection expression
+	formatRequest := TaskRequest{Url: "https://www.youtube.com/watch?v=CreateTaskFormat", Format: "bestvideo[height<=1080]+bestaudio/best"}
+	if status := doRequestForTest(t, http.MethodPost, server.URL+"/tasks", formatRequest, &task); status != http.StatusCreated {
+		t.Fatalf("different status! %d", status)
+	}
+
+	if task.Format != formatRequest.Format || task.FormatSpec() != formatRequest.Format {
+		t.Fatalf("different format! %s", task.Format)
+	}
+
+	invalids := []TaskRequest{
+		{Url: "https://www.youtube.com/", VideoFormat: "137", AudioFormat: "140"},
+		{Url: "://invalid", VideoFormat: "137", AudioFormat: "140"},
+		{Url: "https://www.youtube.com/watch?v=NoFormat"},
+		{Url: "https://www.youtube.com/watch?v=Format", Format: "best[height<=1080"},
+		{Url: "https://www.youtube.com/watch?v=Format", Format: "best", VideoFormat: "137"},
+		{Url: "https://www.youtube.com/watch?v=Parameters", VideoFormat: "137", AudioFormat: "140", Parameters: []string{"-o", "/tmp/other"}},
+		{Url: "https://www.youtube.com/watch?v=Parameters", VideoFormat: "137", AudioFormat: "140", Parameter: "--exec 'rm {}'"},
+		{Url: "https://www.youtube.com/watch?v=Parameters", VideoFormat: "137", AudioFormat: "140", Parameter: "'unterminated"},
+		{Url: "https://www.youtube.com/watch?v=Parameters", VideoFormat: "137", AudioFormat: "140", Parameter: "--no-mtime", Parameters: []string{"--no-mtime"}},
+		{Url: "https://www.youtube.com/watch?v=Options", VideoFormat: "137", AudioFormat: "140", Options: queue.DownloadOptions{ExtractAudio: true, MergeOutputFormat: "mkv"}},
+	}
+
+	for _, invalid := range invalids {
+		if status := doRequestForTest(t, http.MethodPost, server.URL+"/tasks", invalid, nil); status != http.StatusBadRequest {
+			t.Fatalf("%+v: different status! %d", invalid, status)
+		}
+	}
+}
+
+func TestListAndGetTasks(t *testing.T) {
+	server := newServerForTest(t)
+	defer server.Close()
+
+	queueTaskForTest(t, "https://www.youtube.com/watch?v=GetTask", "137")
+	variant := queueTaskForTest(t, "https://www.youtube.com/watch?v=GetTask", "136")
+	queueTaskForTest(t, "https://www.youtube.com/watch?v=GetTask2", "137")
+
+	tasks := []queue.Task{}
+	if status := doRequestForTest(t, http.MethodGet, server.URL+"/tasks", nil, &tasks); status != http.StatusOK {
+		t.Fatalf("different status! %d", status)
+	}
+
+	if len(tasks) != 3 {
+		t.Fatalf("different tasks size! %d", len(tasks))
+	}
+
+	if status := doRequestForTest(t, http.MethodGet, server.URL+"/tasks?video_id=GetTask", nil, &tasks); status != http.StatusOK {
+		t.Fatalf("different status! %d", status)
+	}
+
+	if len(tasks) != 2 {
+		t.Fatalf("different tasks size! %d", len(tasks))
+	}
+
+	if status := doRequestForTest(t, http.MethodGet, server.URL+"/tasks?video_id=GetTask,GetTask2&video_format=136,138&status=queued", nil, &tasks); status != http.StatusOK {
+		t.Fatalf("different status! %d", status)
+	}
+
+	if len(tasks) != 1 || tasks[0].Id != variant.Id {
+		t.Fatalf("different filtered tasks! %+v", tasks)
+	}
+
+	if status := doRequestForTest(t, http.MethodGet, server.URL+"/tasks?order=id&asc=true&limit=1&offset=1", nil, &tasks); status != http.StatusOK {
+		t.Fatalf("different status! %d", status)
+	}
+
+	if len(tasks) != 1 || tasks[0].Id != variant.Id {
+		t.Fatalf("different paged tasks! %+v", tasks)
+	}
+
+	for _, query := range []string{"status=finished", "limit=ten", "created_after=yesterday", "id=GetTask"} {
+		if status := doRequestForTest(t, http.MethodGet, server.URL+"/tasks?"+query, nil, nil); status != http.StatusBadRequest {
+			t.Fatalf("%s: different status! %d", query, status)
+		}
+	}
+
+	task := queue.Task{}
+	if status := doRequestForTest(t, http.MethodGet, server.URL+"/tasks/"+strconv.FormatInt(variant.Id, 10), nil, &task); status != http.StatusOK {
+		t.Fatalf("different status! %d", status)
+	}
+
+	if task.Id != variant.Id || task.VideoId != "GetTask" || task.VideoFormat != "136" {
+		t.Fatalf("different task! %s", task)
+	}
+
+	if status := doRequestForTest(t, http.MethodGet, server.URL+"/tasks/GetTask", nil, nil); status != http.StatusBadRequest {
+		t.Fatalf("video id: different status! %d", status)
+	}
+
+	if status := doRequestForTest(t, http.MethodGet, server.URL+"/tasks/999", nil, nil); status != http.StatusNotFound {
+		t.Fatalf("different status! %d", status)
+	}
+
+	if status := doRequestForTest(t, http.MethodPut, server.URL+"/tasks", nil, nil); status != http.StatusMethodNotAllowed {
+		t.Fatalf("different status! %d", status)
+	}
+}
+
+func TestDeleteTask(t *testing.T) {
+	server := newServerForTest(t)
+	defer server.Close()
+
+	deleted := queueTaskForTest(t, "https://www.youtube.com/watch?v=DeleteTask", "137")
+	queueTaskForTest(t, "https://www.youtube.com/watch?v=DeleteTask", "136")
+
+	deletedUrl := server.URL + "/tasks/" + strconv.FormatInt(deleted.Id, 10)
+	if status := doRequestForTest(t, http.MethodDelete, deletedUrl, nil, nil); status != http.StatusNoContent {
+		t.Fatalf("different status! %d", status)
+	}
+
+	tasks, err := queue.GetTasksByVideoId("DeleteTask")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tasks) != 1 || tasks[0].VideoFormat != "136" {
+		t.Fatalf("different tasks are deleted! %+v", tasks)
+	}
+
+	if status := doRequestForTest(t, http.MethodDelete, deletedUrl, nil, nil); status != http.StatusNotFound {
+		t.Fatalf("different status! %d", status)
+	}
+
+	if err := tasks[0].StartTask(); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := doRequestForTest(t, http.MethodDelete, server.URL+"/tasks/"+strconv.FormatInt(tasks[0].Id, 10), nil, nil); status != http.StatusConflict {
+		t.Fatalf("running task: different status! %d", status)
+	}
+}
+
+func TestFailedTasks(t *testing.T) {
+	server := newServerForTest(t)
+	defer server.Close()
+
+	// the same video failed in two formats
+	urls := []string{}
+	for _, videoFormat := range []string{"137", "136"} {
+		task := queueTaskForTest(t, "https://www.youtube.com/watch?v=FailedTask", videoFormat)
+		if _, err := task.AddFailedTask(errors.New("failed")); err != nil {
+			t.Fatal(err)
+		}
+		urls = append(urls, server.URL+"/failed_tasks/"+strconv.FormatInt(task.Id, 10))
+	}
+
+	failedTasks := []queue.FailedTask{}
+	if status := doRequestForTest(t, http.MethodGet, server.URL+"/failed_tasks", nil, &failedTasks); status != http.StatusOK {
+		t.Fatalf("different status! %d", status)
+	}
+
+	if len(failedTasks) != 2 {
+		t.Fatalf("different failed tasks size! %d", len(failedTasks))
+	}
+
+	if status := doRequestForTest(t, http.MethodGet, server.URL+"/failed_tasks?video_id=Unknown", nil, &failedTasks); status != http.StatusOK || len(failedTasks) != 0 {
+		t.Fatalf("different failed tasks! %d %+v", status, failedTasks)
+	}
+
+	task := queue.Task{}
+	if status := doRequestForTest(t, http.MethodPost, urls[0]+"/requeue", nil, &task); status != http.StatusOK {
+		t.Fatalf("different status! %d", status)
+	}
+
+	if task.VideoId != "FailedTask" || task.VideoFormat != "137" {
+		t.Fatalf("different task! %s", task)
+	}
+
+	if tasks, _ := queue.GetTasksByVideoId("FailedTask"); len(tasks) != 1 {
+		t.Fatalf("requeued task is not queued!")
+	}
+
+	if failedTasks, _ := queue.GetFailedTasksByVideoId("FailedTask"); len(failedTasks) != 1 || failedTasks[0].VideoFormat != "136" {
+		t.Fatalf("another format is requeued! %+v", failedTasks)
+	}
+
+	if status := doRequestForTest(t, http.MethodPost, urls[0]+"/requeue", nil, nil); status != http.StatusNotFound {
+		t.Fatalf("different status! %d", status)
+	}
+
+	if status := doRequestForTest(t, http.MethodDelete, urls[1], nil, nil); status != http.StatusNoContent {
+		t.Fatalf("different status! %d", status)
+	}
+
+	if failedTasks, _ := queue.GetAllFailedTasks(); len(failedTasks) != 0 {
+		t.Fatalf("failed task is not deleted!")
+	}
+
+	if status := doRequestForTest(t, http.MethodDelete, urls[1], nil, nil); status != http.StatusNotFound {
+		t.Fatalf("different status! %d", status)
+	}
+}
+
+func TestGetStatus(t *testing.T) {
+	server := newServerForTest(t)
+	defer server.Close()
+
+	status := queue.WorkerStatus{}
+	if code := doRequestForTest(t, http.MethodGet, server.URL+"/status", nil, &status); code != http.StatusOK {
+		t.Fatalf("different status! %d", code)
+	}
+
+	if status.Running || status.WorkerNum != queue.GetWorkerNum() || status.CurrentTasks == nil {
+		t.Fatalf("different worker status! %+v", status)
+	}
+
+	if code := doRequestForTest(t, http.MethodGet, server.URL+"/unknown", nil, nil); code != http.StatusNotFound {
+		t.Fatalf("different status! %d", code)
+	}
+}
+
+func TestGetLog(t *testing.T) {
+	server := newServerForTest(t)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "youtube-dl-queue-api-log-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue.SetLogDirectory(dir)
+
+	task := queue.Task{Id: 1}
+	if err := ioutil.WriteFile(task.LogPath(), []byte("[download] 100%\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := http.Get(server.URL + "/logs/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	body, _ := ioutil.ReadAll(response.Body)
+	if response.StatusCode != http.StatusOK || string(body) != "[download] 100%\n" {
+		t.Fatalf("different log! %d %q", response.StatusCode, body)
+	}
+
+	if status := doRequestForTest(t, http.MethodGet, server.URL+"/logs/2", nil, nil); status != http.StatusNotFound {
+		t.Fatalf("different status! %d", status)
+	}
+}
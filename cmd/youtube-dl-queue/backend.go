@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+	queue "github.com/satom9to5/youtube-dl-queue"
+	"github.com/satom9to5/youtube-dl-queue/api"
+)
+
+// backend runs commands either directly on the db or against a running daemon.
+type backend interface {
+	AddTask(request api.TaskRequest) (queue.Task, error)
+	ListTasks() ([]queue.Task, error)
+	ListFailedTasks() ([]queue.FailedTask, error)
+	RequeueTask(id int64) (queue.Task, error)
+	RemoveTask(id int64) error
+	Log(id int64, w io.Writer) error
+	Status() (queue.WorkerStatus, error)
+	Close()
+}
+
+type dbBackend struct{}
+
+func newDBBackend(o options) (*dbBackend, error) {
+	s, err := openStore(o)
+	if err != nil {
+		return nil, err
+	}
+
+	queue.SetStore(s)
+	queue.SetLogDirectory(o.logDirectory)
+
+	return &dbBackend{}, nil
+}
+
+// sqliteOptions are set on the SQLite db shared by worker processes:
+// a writer waits up to 5 seconds for the lock held by another process
+// instead of failing with "database is locked", and readers do not
+// block the writer in the write-ahead log journal.
+const sqliteOptions = "_busy_timeout=5000&_journal_mode=WAL"
+
+// sqliteDSN appends sqliteOptions to the db path, which may have its own.
+func sqliteDSN(dbPath string) string {
+	if strings.Contains(dbPath, "?") {
+		return dbPath + "&" + sqliteOptions
+	}
+
+	return dbPath + "?" + sqliteOptions
+}
+
+// openStore opens the PostgreSQL database of -postgres, or the SQLite db of -db.
+func openStore(o options) (queue.Store, error) {
+	if o.postgres != "" {
+		return queue.NewPostgresStore(o.postgres)
+	}
+
+	db, err := sql.Open("sqlite3", sqliteDSN(o.dbPath))
+	if err != nil {
+		return nil, err
+	}
+
+	// processes sharing the db wake each other up when tasks are added
+	if o.notifyDirectory == "" {
+		o.notifyDirectory = o.dbPath + ".notify"
+	}
+	queue.SetNotifyDirectory(o.notifyDirectory)
+
+	// the logs of a db keyed on video ids are migrated with it
+	s, err := queue.NewSQLiteStore(db, o.logDirectory)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (b *dbBackend) AddTask(request api.TaskRequest) (task queue.Task, err error) {
+	if task, err = request.Task(); err != nil {
+		return task, err
+	}
+
+	err = task.QueueTask()
+
+	return task, err
+}
+
+func (b *dbBackend) ListTasks() ([]queue.Task, error) {
+	return queue.GetAllTasks()
+}
+
+func (b *dbBackend) ListFailedTasks() ([]queue.FailedTask, error) {
+	return queue.GetAllFailedTasks()
+}
+
+func (b *dbBackend) RequeueTask(id int64) (task queue.Task, err error) {
+	failedTask, err := queue.GetFailedTask(id)
+	if err != nil {
+		return task, err
+	}
+
+	return failedTask.RequeueTask()
+}
+
+func (b *dbBackend) RemoveTask(id int64) error {
+	task := queue.Task{Id: id}
+
+	return task.RemoveTask()
+}
+
+func (b *dbBackend) Log(id int64, w io.Writer) error {
+	file, err := os.Open(queue.Task{Id: id}.LogPath())
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(w, file)
+
+	return err
+}
+
+func (b *dbBackend) Status() (queue.WorkerStatus, error) {
+	return queue.GetWorkerStatus()
+}
+
+func (b *dbBackend) Close() {
+	queue.CloseDB()
+}
+
+// httpBackend talks to the api handler of a running daemon.
+type httpBackend struct {
+	server string
+	client *http.Client
+}
+
+func newHTTPBackend(server string) *httpBackend {
+	return &httpBackend{
+		server: strings.TrimRight(server, "/"),
+		client: http.DefaultClient,
+	}
+}
+
+func (b *httpBackend) do(method string, path string, query url.Values, body interface{}, v interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		buf, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(buf)
+	}
+
+	u := b.server + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	request, err := http.NewRequest(method, u, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	response, err := b.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 300 {
+		errorBody := struct {
+			Error string `json:"error"`
+		}{}
+		b, _ := ioutil.ReadAll(response.Body)
+		if json.Unmarshal(b, &errorBody) == nil && errorBody.Error != "" {
+			return errors.New(errorBody.Error)
+		}
+		return fmt.Errorf("server responded %s.", response.Status)
+	}
+
+	if v == nil {
+		return nil
+	}
+
+	if w, ok := v.(io.Writer); ok {
+		_, err = io.Copy(w, response.Body)
+		return err
+	}
+
+	return json.NewDecoder(response.Body).Decode(v)
+}
+
+func (b *httpBackend) AddTask(request api.TaskRequest) (task queue.Task, err error) {
+	err = b.do(http.MethodPost, "/tasks", nil, request, &task)
+	return task, err
+}
+
+func (b *httpBackend) ListTasks() (tasks []queue.Task, err error) {
+	err = b.do(http.MethodGet, "/tasks", nil, nil, &tasks)
+	return tasks, err
+}
+
+func (b *httpBackend) ListFailedTasks() (failedTasks []queue.FailedTask, err error) {
+	err = b.do(http.MethodGet, "/failed_tasks", nil, nil, &failedTasks)
+	return failedTasks, err
+}
+
+func (b *httpBackend) RequeueTask(id int64) (task queue.Task, err error) {
+	err = b.do(http.MethodPost, "/failed_tasks/"+strconv.FormatInt(id, 10)+"/requeue", nil, nil, &task)
+	return task, err
+}
+
+func (b *httpBackend) RemoveTask(id int64) error {
+	return b.do(http.MethodDelete, "/tasks/"+strconv.FormatInt(id, 10), nil, nil, nil)
+}
+
+func (b *httpBackend) Log(id int64, w io.Writer) error {
+	return b.do(http.MethodGet, "/logs/"+strconv.FormatInt(id, 10), nil, nil, w)
+}
+
+func (b *httpBackend) Status() (status queue.WorkerStatus, err error) {
+	err = b.do(http.MethodGet, "/status", nil, nil, &status)
+	return status, err
+}
+
+func (b *httpBackend) Close() {}
@@ -0,0 +1,402 @@
+// Command youtube-dl-queue runs the download queue daemon and manages its tasks,
+// either directly on the SQLite db or through the HTTP API of a running daemon.
+//
+//	youtube-dl-queue [-db path | -postgres dsn | -server url] [-json] <command> [flags] [args]
+//
+// Commands:
+//
+//	serve                      run workers and the HTTP API
+//	add <url> -f 137+140 -o t  queue a task
+//	list                       list tasks
+//	failed                     list failed tasks
+//	requeue <id>               requeue a failed task
+//	remove <id>                remove a task which is not started
+//	logs <id>                  print the youtube-dl log of a task
+//	status                     print worker status
+//
+// Tasks are identified by their job id, printed in the ID column.
+// With -postgres, the queue is shared by daemons on several hosts.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	queue "github.com/satom9to5/youtube-dl-queue"
+	"github.com/satom9to5/youtube-dl-queue/api"
+)
+
+type options struct {
+	dbPath          string
+	postgres        string
+	server          string
+	logDirectory    string
+	notifyDirectory string
+	json            bool
+	stdout          io.Writer
+	stderr          io.Writer
+}
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout, os.Stderr); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, stdout io.Writer, stderr io.Writer) error {
+	o := options{stdout: stdout, stderr: stderr}
+
+	fs := flag.NewFlagSet("youtube-dl-queue", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.StringVar(&o.dbPath, "db", "./youtube-dl-queue.db", "SQLite db path")
+	fs.StringVar(&o.postgres, "postgres", "", "PostgreSQL DSN, instead of the SQLite db")
+	fs.StringVar(&o.server, "server", "", "URL of a running daemon, instead of opening the db")
+	fs.StringVar(&o.logDirectory, "log-dir", "./log", "youtube-dl log directory")
+	fs.StringVar(&o.notifyDirectory, "notify-dir", "", "directory of the sockets waking processes sharing the SQLite db (default db path + \".notify\")")
+	fs.BoolVar(&o.json, "json", false, "print JSON instead of tables")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: youtube-dl-queue [flags] serve|add|list|failed|requeue|remove|logs|status [args]")
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("command is required.")
+	}
+
+	command, args := fs.Arg(0), fs.Args()[1:]
+
+	if command == "serve" {
+		return serve(o, args)
+	}
+
+	var b backend
+	if o.server != "" {
+		b = newHTTPBackend(o.server)
+	} else {
+		dbBackend, err := newDBBackend(o)
+		if err != nil {
+			return err
+		}
+		b = dbBackend
+	}
+	defer b.Close()
+
+	switch command {
+	case "add":
+		return add(o, b, args)
+	case "list":
+		tasks, err := b.ListTasks()
+		if err != nil {
+			return err
+		}
+		return printTasks(o, tasks)
+	case "failed":
+		failedTasks, err := b.ListFailedTasks()
+		if err != nil {
+			return err
+		}
+		return printFailedTasks(o, failedTasks)
+	case "requeue":
+		id, err := parseIdArgs(command, args)
+		if err != nil {
+			return err
+		}
+		task, err := b.RequeueTask(id)
+		if err != nil {
+			return err
+		}
+		return printTasks(o, []queue.Task{task})
+	case "remove":
+		id, err := parseIdArgs(command, args)
+		if err != nil {
+			return err
+		}
+		return b.RemoveTask(id)
+	case "logs":
+		id, err := parseIdArgs(command, args)
+		if err != nil {
+			return err
+		}
+		return b.Log(id, stdout)
+	case "status":
+		status, err := b.Status()
+		if err != nil {
+			return err
+		}
+		return printStatus(o, status)
+	default:
+		fs.Usage()
+		return fmt.Errorf("unknown command %s.", command)
+	}
+}
+
+// parseInterspersed parses flags placed before or after positional arguments.
+func parseInterspersed(fs *flag.FlagSet, args []string) (positionals []string, err error) {
+	for {
+		if err = fs.Parse(args); err != nil {
+			return positionals, err
+		}
+
+		if fs.NArg() == 0 {
+			return positionals, nil
+		}
+
+		positionals = append(positionals, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// parseFormat takes format ids as video+audio into the video and audio
+// formats, and any other format selection expression into format.
+func parseFormat(spec string) (videoFormat string, audioFormat string, format string, err error) {
+	if err = queue.ValidateFormat(spec); err != nil {
+		return "", "", "", err
+	}
+
+	formats := strings.Split(spec, "+")
+	if len(formats) == 2 && !strings.ContainsAny(spec, ",/()[] ") {
+		return formats[0], formats[1], "", nil
+	}
+
+	return "", "", spec, nil
+}
+
+func add(o options, b backend, args []string) error {
+	fs := flag.NewFlagSet("add", flag.ContinueOnError)
+	fs.SetOutput(o.stderr)
+	format := fs.String("f", "", "format as video+audio, e.g. 137+140, or a format selection expression, e.g. bestvideo[height<=1080]+bestaudio/best")
+	output := fs.String("o", "", "youtube-dl output template")
+	title := fs.String("title", "", "task title")
+	parameter := fs.String("p", "", "extra youtube-dl parameters, quoted as in a shell")
+	downloader := fs.String("downloader", "", "downloader of the task, youtube-dl or yt-dlp, empty for the default of the server")
+	downloadOptions := fs.String("options", "", `download options as JSON, e.g. {"subtitle_languages":["en"],"embed_subtitles":true}`)
+
+	positionals, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if len(positionals) != 1 {
+		return errors.New("usage: add <url> -f format [-o template]")
+	}
+
+	if *format == "" {
+		return errors.New("format is required.")
+	}
+
+	videoFormat, audioFormat, spec, err := parseFormat(*format)
+	if err != nil {
+		return err
+	}
+
+	request := api.TaskRequest{
+		Url:         positionals[0],
+		VideoFormat: videoFormat,
+		AudioFormat: audioFormat,
+		Format:      spec,
+		Title:       *title,
+		OutputPath:  *output,
+		Parameter:   *parameter,
+		Downloader:  *downloader,
+	}
+
+	if *downloadOptions != "" {
+		if err := json.Unmarshal([]byte(*downloadOptions), &request.Options); err != nil {
+			return fmt.Errorf("options: %s", err)
+		}
+	}
+
+	task, err := b.AddTask(request)
+	if err != nil {
+		return err
+	}
+
+	return printTasks(o, []queue.Task{task})
+}
+
+// parseIdArgs parses the job id which is the only argument of command.
+func parseIdArgs(command string, args []string) (id int64, err error) {
+	if len(args) != 1 {
+		return id, fmt.Errorf("usage: %s <id>", command)
+	}
+
+	id, err = strconv.ParseInt(args[0], 10, 64)
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("id %s must be a job id.", args[0])
+	}
+
+	return id, nil
+}
+
+func serve(o options, args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	fs.SetOutput(o.stderr)
+	pidfilePath := fs.String("pidfile", "", "pidfile path, empty to share the db with other processes")
+	youtubeDlPath := fs.String("youtube-dl", "youtube-dl", "youtube-dl path")
+	ytDlpPath := fs.String("yt-dlp", "", "yt-dlp path, empty to disable")
+	defaultDownloader := fs.String("downloader", queue.YoutubeDl, "downloader of tasks selecting none, youtube-dl or yt-dlp")
+	ffmpegPath := fs.String("ffmpeg", "", "ffmpeg path, empty to look it up in $PATH, none to leave it to the downloader")
+	workers := fs.Int("workers", 1, "concurrent downloads")
+	identity := fs.String("identity", "", "worker identity, unique among processes sharing the db")
+	listen := fs.String("listen", "127.0.0.1:8080", "HTTP API address, empty to disable")
+	grace := fs.Duration("grace", 30*time.Second, "how long to wait for running downloads on shutdown")
+	poll := fs.Duration("poll", time.Minute, "how long idle workers wait before looking for tasks without a wakeup")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(o.logDirectory, 0755); err != nil {
+		return err
+	}
+
+	s, err := openStore(o)
+	if err != nil {
+		return err
+	}
+
+	queue.SetLogDirectory(o.logDirectory)
+	queue.SetStopGracePeriod(*grace)
+	queue.SetWorkerIdentity(*identity)
+	if err = queue.SetWorkerNum(*workers); err != nil {
+		return err
+	}
+	if err = queue.SetPollInterval(*poll); err != nil {
+		return err
+	}
+	switch {
+	case *defaultDownloader == queue.YtDlp && *ytDlpPath != "":
+		queue.SetDownloader(queue.NewYtDlp(*ytDlpPath))
+	case *defaultDownloader == queue.YtDlp:
+		return errors.New("yt-dlp path is required to download with yt-dlp by default.")
+	case *defaultDownloader != queue.YoutubeDl:
+		return fmt.Errorf("downloader %s is unknown.", *defaultDownloader)
+	case *ytDlpPath != "":
+		queue.AddDownloader(queue.NewYtDlp(*ytDlpPath))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pid, err := queue.StartWithStore(ctx, s, *pidfilePath, *youtubeDlPath, *ffmpegPath)
+	if err != nil {
+		return err
+	}
+	defer queue.Stop()
+
+	fmt.Fprintf(o.stderr, "youtube-dl-queue started (pid %d).\n", pid)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	serverErr := make(chan error, 1)
+	var server *http.Server
+	if *listen != "" {
+		server = &http.Server{Addr: *listen, Handler: api.NewHandler()}
+		go func() { serverErr <- server.ListenAndServe() }()
+	}
+
+	select {
+	case s := <-signals:
+		fmt.Fprintf(o.stderr, "%s received, stopping.\n", s)
+	case err = <-serverErr:
+	}
+
+	if server != nil {
+		shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancelShutdown()
+		server.Shutdown(shutdownCtx)
+	}
+
+	return err
+}
+
+func printJSON(o options, v interface{}) error {
+	encoder := json.NewEncoder(o.stdout)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(v)
+}
+
+func formatTime(unix int64) string {
+	if unix == 0 {
+		return "-"
+	}
+
+	return time.Unix(unix, 0).Format("2006-01-02 15:04:05")
+}
+
+func printTasks(o options, tasks []queue.Task) error {
+	if o.json {
+		return printJSON(o, tasks)
+	}
+
+	w := tabwriter.NewWriter(o.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tVIDEO ID\tFORMAT\tTITLE\tCREATED\tSTARTED\tATTEMPTS\tURL")
+	for _, t := range tasks {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%d\t%s\n", t.Id, t.VideoId, t.FormatSpec(), t.Title, formatTime(t.CreatedAt), formatTime(t.StartedAt), t.Attempts, t.Url)
+	}
+
+	return w.Flush()
+}
+
+func printFailedTasks(o options, failedTasks []queue.FailedTask) error {
+	if o.json {
+		return printJSON(o, failedTasks)
+	}
+
+	w := tabwriter.NewWriter(o.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tVIDEO ID\tFORMAT\tTITLE\tFAILED\tREASON\tEXIT\tATTEMPTS\tURL")
+	for _, ft := range failedTasks {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%d\t%d\t%s\n", ft.Id, ft.VideoId, ft.FormatSpec(), ft.Title, formatTime(ft.FailedAt), ft.Reason, ft.ExitCode, ft.Attempts, ft.Url)
+	}
+
+	return w.Flush()
+}
+
+func printStatus(o options, status queue.WorkerStatus) error {
+	if o.json {
+		return printJSON(o, status)
+	}
+
+	progresses := map[int64]queue.Progress{}
+	for _, p := range status.Progresses {
+		progresses[p.Id] = p
+	}
+
+	fmt.Fprintf(o.stdout, "running: %t\tworkers: %d\tidentity: %s\n\n", status.Running, status.WorkerNum, status.WorkerIdentity)
+
+	w := tabwriter.NewWriter(o.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tWORKER\tPID\tPHASE\tPERCENT\tETA\tHEARTBEAT")
+	for _, ct := range status.CurrentTasks {
+		p, ok := progresses[ct.Id]
+		phase, percent, eta := "-", "-", "-"
+		if ok {
+			phase = string(p.Phase)
+			percent = fmt.Sprintf("%.1f%%", p.Percent)
+			eta = (time.Duration(p.Eta) * time.Second).String()
+		}
+		fmt.Fprintf(w, "%d\t%s\t%d\t%s\t%s\t%s\t%s\n", ct.Id, ct.WorkerId, ct.Pid, phase, percent, eta, formatTime(ct.HeartbeatAt))
+	}
+
+	return w.Flush()
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	queue "github.com/satom9to5/youtube-dl-queue"
+	"github.com/satom9to5/youtube-dl-queue/api"
+)
+
+func tempDirForTest(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "youtube-dl-queue-cmd-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dir
+}
+
+func runForTest(t *testing.T, args ...string) string {
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+
+	if err := run(args, stdout, stderr); err != nil {
+		t.Fatalf("%s: %s %s", strings.Join(args, " "), err, stderr)
+	}
+
+	return stdout.String()
+}
+
+func TestParseFormat(t *testing.T) {
+	videoFormat, audioFormat, format, err := parseFormat("137+140")
+	if err != nil || videoFormat != "137" || audioFormat != "140" || format != "" {
+		t.Fatalf("different formats! %s %s %s %v", videoFormat, audioFormat, format, err)
+	}
+
+	for _, spec := range []string{"137", "bestaudio", "137+140+141", "bestvideo[height<=1080]+bestaudio/best"} {
+		if videoFormat, audioFormat, format, err := parseFormat(spec); err != nil || videoFormat != "" || audioFormat != "" || format != spec {
+			t.Fatalf("different formats of %s! %s %s %s %v", spec, videoFormat, audioFormat, format, err)
+		}
+	}
+
+	for _, spec := range []string{"137+", "+140", "best[height<=", "(best"} {
+		if _, _, _, err := parseFormat(spec); err == nil {
+			t.Fatalf("accepted format %s!", spec)
+		}
+	}
+}
+
+func TestParseInterspersed(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	format := fs.String("f", "", "")
+	output := fs.String("o", "", "")
+
+	positionals, err := parseInterspersed(fs, []string{"-o", "template", "url", "-f", "137+140"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(positionals) != 1 || positionals[0] != "url" || *format != "137+140" || *output != "template" {
+		t.Fatalf("different args! %v %s %s", positionals, *format, *output)
+	}
+}
+
+func TestSQLiteDSN(t *testing.T) {
+	dbPath := filepath.Join(tempDirForTest(t), "queue.sqlite3")
+
+	if dsn := sqliteDSN(dbPath + "?cache=shared"); dsn != dbPath+"?cache=shared&"+sqliteOptions {
+		t.Fatalf("different dsn! %s", dsn)
+	}
+
+	db, err := sql.Open("sqlite3", sqliteDSN(dbPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	journalMode := ""
+	if err := db.QueryRow(`PRAGMA journal_mode`).Scan(&journalMode); err != nil || journalMode != "wal" {
+		t.Fatalf("different journal mode! %s %v", journalMode, err)
+	}
+
+	busyTimeout := 0
+	if err := db.QueryRow(`PRAGMA busy_timeout`).Scan(&busyTimeout); err != nil || busyTimeout != 5000 {
+		t.Fatalf("different busy timeout! %d %v", busyTimeout, err)
+	}
+}
+
+func TestRunOnDB(t *testing.T) {
+	dir := tempDirForTest(t)
+	dbPath := filepath.Join(dir, "queue.db")
+	logDirectory := filepath.Join(dir, "log")
+
+	global := []string{"-db", dbPath, "-log-dir", logDirectory}
+	withGlobal := func(args ...string) []string {
+		return append(append([]string{}, global...), args...)
+	}
+
+	output := runForTest(t, withGlobal("add", "https://www.youtube.com/watch?v=RunOnDB", "-f", "137+140", "-o", "%(title)s.%(ext)s")...)
+	if !strings.Contains(output, "RunOnDB") || !strings.Contains(output, "137+140") {
+		t.Fatalf("different add output! %s", output)
+	}
+
+	runForTest(t, withGlobal("add", "-f", "136+140", "-p", "--write-sub --sub-lang 'en'", "https://www.youtube.com/watch?v=RunOnDB")...)
+
+	if err := run(withGlobal("add", "-f", "135+140", "-p", "-o other", "https://www.youtube.com/watch?v=RunOnDB"), ioutil.Discard, ioutil.Discard); err == nil {
+		t.Fatalf("added with the output parameter!")
+	}
+
+	if err := run(withGlobal("add", "-f", "135+140", "-options", `{"rate_limit":"fast"}`, "https://www.youtube.com/watch?v=RunOnDB"), ioutil.Discard, ioutil.Discard); err == nil {
+		t.Fatalf("added with invalid options!")
+	}
+
+	tasks := []queue.Task{}
+	if err := json.Unmarshal([]byte(runForTest(t, withGlobal("-json", "list")...)), &tasks); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tasks) != 2 {
+		t.Fatalf("different tasks size! %d", len(tasks))
+	}
+
+	for _, task := range tasks {
+		if task.VideoFormat == "136" && task.Parameters.String() != "--write-sub --sub-lang en" {
+			t.Fatalf("different parameters! %q", task.Parameters)
+		}
+	}
+
+	if err := run(withGlobal("remove", "RunOnDB"), ioutil.Discard, ioutil.Discard); err == nil {
+		t.Fatalf("removed by video id!")
+	}
+
+	kept := tasks[0]
+	runForTest(t, withGlobal("remove", strconv.FormatInt(tasks[1].Id, 10))...)
+
+	if err := json.Unmarshal([]byte(runForTest(t, withGlobal("-json", "list")...)), &tasks); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tasks) != 1 || tasks[0].Id != kept.Id {
+		t.Fatalf("different tasks! %+v", tasks)
+	}
+
+	// each command closes the db, so reopen it to fail the task directly
+	b, err := newDBBackend(options{dbPath: dbPath, logDirectory: logDirectory})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	task := tasks[0]
+	_, err = task.AddFailedTask(errors.New("failed"))
+	b.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output = runForTest(t, withGlobal("failed")...)
+	if !strings.Contains(output, "RunOnDB") || !strings.Contains(output, "REASON") {
+		t.Fatalf("different failed output! %s", output)
+	}
+
+	runForTest(t, withGlobal("requeue", strconv.FormatInt(task.Id, 10))...)
+
+	if output := runForTest(t, withGlobal("list")...); !strings.Contains(output, "RunOnDB") {
+		t.Fatalf("task is not requeued! %s", output)
+	}
+
+	if err := os.MkdirAll(logDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(task.LogPath(), []byte("[download] 100%\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if output := runForTest(t, withGlobal("logs", strconv.FormatInt(task.Id, 10))...); output != "[download] 100%\n" {
+		t.Fatalf("different logs! %q", output)
+	}
+
+	if output := runForTest(t, withGlobal("status")...); !strings.Contains(output, "running: false") {
+		t.Fatalf("different status! %s", output)
+	}
+
+	if err := run(withGlobal("unknown"), ioutil.Discard, ioutil.Discard); err == nil {
+		t.Fatalf("accepted unknown command!")
+	}
+}
+
+func TestRunOnServer(t *testing.T) {
+	dir := tempDirForTest(t)
+
+	// open the db for the daemon side
+	if _, err := newDBBackend(options{dbPath: filepath.Join(dir, "queue.db"), logDirectory: filepath.Join(dir, "log")}); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(api.NewHandler())
+	defer server.Close()
+
+	global := []string{"-server", server.URL}
+	withGlobal := func(args ...string) []string {
+		return append(append([]string{}, global...), args...)
+	}
+
+	runForTest(t, withGlobal("add", "https://www.youtube.com/watch?v=RunOnServer", "-f", "137+140")...)
+
+	if err := run(withGlobal("add", "https://www.youtube.com/watch?v=RunOnServer", "-f", "137+140"), ioutil.Discard, ioutil.Discard); err == nil || err.Error() != queue.ErrDuplicateTask.Error() {
+		t.Fatalf("expected duplicate error, got %v", err)
+	}
+
+	tasks := []queue.Task{}
+	if err := json.Unmarshal([]byte(runForTest(t, withGlobal("-json", "list")...)), &tasks); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tasks) != 1 || tasks[0].VideoId != "RunOnServer" {
+		t.Fatalf("different tasks! %+v", tasks)
+	}
+
+	if _, err := tasks[0].AddFailedTask(errors.New("failed")); err != nil {
+		t.Fatal(err)
+	}
+
+	failedTasks := []queue.FailedTask{}
+	if err := json.Unmarshal([]byte(runForTest(t, withGlobal("-json", "failed")...)), &failedTasks); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(failedTasks) != 1 {
+		t.Fatalf("different failed tasks size! %d", len(failedTasks))
+	}
+
+	id := strconv.FormatInt(tasks[0].Id, 10)
+	runForTest(t, withGlobal("requeue", id)...)
+	runForTest(t, withGlobal("remove", id)...)
+
+	if output := runForTest(t, withGlobal("-json", "list")...); strings.TrimSpace(output) != "[]" {
+		t.Fatalf("task is not removed! %s", output)
+	}
+
+	status := queue.WorkerStatus{}
+	if err := json.Unmarshal([]byte(runForTest(t, withGlobal("-json", "status")...)), &status); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := run(withGlobal("logs", "999"), ioutil.Discard, ioutil.Discard); err == nil {
+		t.Fatalf("printed unknown logs!")
+	}
+}
@@ -0,0 +1,63 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+var (
+	leaseHeartbeatInterval = 10 * time.Second
+	leaseTimeout           = time.Minute
+)
+
+// CurrentTask is a lease on a running task, refreshed while youtube-dl runs.
+type CurrentTask struct {
+	Id          int64  `json:"id"`
+	WorkerId    string `json:"worker_id"`
+	Pid         int    `json:"pid"`
+	HeartbeatAt int64  `json:"heartbeat_at"`
+}
+
+func (ct CurrentTask) String() string {
+	return fmt.Sprintf(
+		"Id: %d\tWorkerId:%s\tPid:%d\tHeartbeatAt:%d",
+		ct.Id,
+		ct.WorkerId,
+		ct.Pid,
+		ct.HeartbeatAt,
+	)
+}
+
+// heartbeat refreshes the lease of the task until ctx is done.
+func (q *Queue) heartbeat(ctx context.Context, id int64) {
+	ticker := time.NewTicker(leaseHeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := q.store.Heartbeat(id); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// recoverStaleLeases puts tasks whose lease heartbeat is older than
+// leaseTimeout, or which are started without any lease, back into the queue.
+func (q *Queue) recoverStaleLeases() (recovered int64, err error) {
+	return q.store.RecoverStaleLeases(time.Now().Add(-leaseTimeout).Unix())
+}
+
+func GetCurrentTasks() (currentTasks []CurrentTask, err error) {
+	return defaultQueue.GetCurrentTasks()
+}
+
+func (q *Queue) GetCurrentTasks() (currentTasks []CurrentTask, err error) {
+	return q.store.ListLeases()
+}
@@ -0,0 +1,155 @@
+package queue
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func insertCurrentTaskForTest(t *testing.T, currentTask CurrentTask) {
+	if _, err := db.Exec(
+		`INSERT INTO current_task (id, worker_id, pid, heartbeat_at) VALUES (?, ?, ?, ?)`,
+		&currentTask.Id,
+		&currentTask.WorkerId,
+		&currentTask.Pid,
+		&currentTask.HeartbeatAt,
+	); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPopTasksAddsLease(t *testing.T) {
+	InitializeForTest(t)
+
+	insertTaskForTest(t, Task{
+		VideoFormat: "135",
+		AudioFormat: "140",
+		Url:         "https://www.youtube.com/watch?v=PopTasksAddsLease",
+		Title:       "TestPopTasksAddsLease",
+		OutputPath:  "/tmp/output",
+	})
+
+	tasks, err := defaultQueue.popTasks("worker-1", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	currentTasks, err := GetCurrentTasks()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(currentTasks) != 1 {
+		t.Fatalf("different current tasks size!")
+	}
+
+	currentTask := currentTasks[0]
+	if currentTask.Id != tasks[0].Id || currentTask.WorkerId != "worker-1" || currentTask.Pid != os.Getpid() {
+		t.Fatalf("different lease! %s", currentTask)
+	}
+
+	if err := tasks[0].FinishTask(); err != nil {
+		t.Fatal(err)
+	}
+
+	if currentTasks, _ := GetCurrentTasks(); len(currentTasks) != 0 {
+		t.Fatalf("lease is not released!")
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	InitializeForTest(t)
+
+	leaseHeartbeatInterval = 10 * time.Millisecond
+	defer func() { leaseHeartbeatInterval = 10 * time.Second }()
+
+	task := Task{Id: 1, VideoId: "Heartbeat", VideoFormat: "135", AudioFormat: "140"}
+	insertCurrentTaskForTest(t, CurrentTask{
+		Id:          task.Id,
+		WorkerId:    "0",
+		Pid:         os.Getpid(),
+		HeartbeatAt: 0,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go defaultQueue.heartbeat(ctx, task.Id)
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	currentTasks, err := GetCurrentTasks()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if currentTasks[0].HeartbeatAt == 0 {
+		t.Fatalf("heartbeat is not refreshed!")
+	}
+}
+
+func TestRecoverStaleLeases(t *testing.T) {
+	InitializeForTest(t)
+
+	now := time.Now().Unix()
+
+	// stale lease, fresh lease, and started without lease
+	heartbeats := []int64{now - 3600, now, -1}
+
+	ids := []int64{}
+	for i, heartbeatAt := range heartbeats {
+		task := insertTaskForTest(t, Task{
+			VideoFormat: "135",
+			AudioFormat: "140",
+			Url:         "https://www.youtube.com/watch?v=RecoverStaleLeases" + strconv.Itoa(i),
+			Title:       "TestRecoverStaleLeases",
+			OutputPath:  "/tmp/output",
+		})
+		ids = append(ids, task.Id)
+
+		if _, err := db.Exec(`UPDATE tasks SET started_at = ? WHERE id = ?`, now, task.Id); err != nil {
+			t.Fatal(err)
+		}
+
+		if heartbeatAt < 0 {
+			continue
+		}
+
+		insertCurrentTaskForTest(t, CurrentTask{
+			Id:          task.Id,
+			WorkerId:    strconv.Itoa(i),
+			Pid:         os.Getpid(),
+			HeartbeatAt: heartbeatAt,
+		})
+	}
+
+	recovered, err := defaultQueue.recoverStaleLeases()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if recovered != 2 {
+		t.Fatalf("different recovered tasks size! %d", recovered)
+	}
+
+	currentTasks, err := GetCurrentTasks()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(currentTasks) != 1 || currentTasks[0].Id != ids[1] {
+		t.Fatalf("fresh lease is not kept!")
+	}
+
+	if task := getTaskByIdForTest(t, ids[1]); task.StartedAt == 0 {
+		t.Fatalf("leased task is requeued!")
+	}
+
+	for _, id := range []int64{ids[0], ids[2]} {
+		if task := getTaskByIdForTest(t, id); task.StartedAt != 0 {
+			t.Fatalf("task %d is not requeued!", id)
+		}
+	}
+}
@@ -2,28 +2,29 @@ package queue
 
 import (
 	"database/sql"
-	"errors"
 )
 
-var (
-	db       *sql.DB
-	sqlStmts = make(map[string]*sql.Stmt)
-)
+// execer and queryer are satisfied by both *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
 
-func InitializeSchema(varDB *sql.DB) (err error) {
-	if err = initializeDB(varDB); err != nil {
-		return err
-	}
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
 
-	sqls := []string{
-		`CREATE TABLE IF NOT EXISTS "current_task" (
-	    "id" TEXT NOT NULL,	
-	    "video_format" TEXT NOT NULL,	
-	    "audio_format" TEXT NOT NULL,	
-			PRIMARY KEY ("id", "video_format", "audio_format")
+// baselineSqls is the schema of version 1. It must not change: the schema
+// is changed by appending migrations, see migration.go.
+var baselineSqls = []string{
+	`CREATE TABLE IF NOT EXISTS "current_task" (
+			"id" INTEGER NOT NULL PRIMARY KEY,
+	    "worker_id" TEXT NOT NULL,	
+			"pid" INTEGER NOT NULL,
+			"heartbeat_at" INTEGER NOT NULL
 		)`,
-		`CREATE TABLE IF NOT EXISTS "tasks" (
-	    "id" TEXT NOT NULL,	
+	`CREATE TABLE IF NOT EXISTS "tasks" (
+			"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+	    "video_id" TEXT NOT NULL,	
 	    "video_format" TEXT NOT NULL,	
 	    "audio_format" TEXT NOT NULL,	
 	    "url" TEXT NOT NULL,	
@@ -33,10 +34,26 @@ func InitializeSchema(varDB *sql.DB) (err error) {
 			"created_at" INTEGER NOT NULL,
 			"updated_at" INTEGER NOT NULL,
 			"started_at" INTEGER NOT NULL,
-			PRIMARY KEY ("id", "video_format", "audio_format")
+			"attempts" INTEGER NOT NULL DEFAULT 0,
+			"next_attempt_at" INTEGER NOT NULL DEFAULT 0
 		)`,
-		`CREATE TABLE IF NOT EXISTS "failed_tasks" (
-	    "id" TEXT NOT NULL,	
+	`CREATE INDEX IF NOT EXISTS "tasks_video_id" ON "tasks" ("video_id")`,
+	// the same download must not be queued twice
+	`CREATE UNIQUE INDEX IF NOT EXISTS "tasks_download" ON "tasks" ("video_id", "video_format", "audio_format", "output_path", "parameter")`,
+	`CREATE TABLE IF NOT EXISTS "task_progress" (
+			"id" INTEGER NOT NULL PRIMARY KEY,
+	    "phase" TEXT NOT NULL,	
+			"percent" REAL NOT NULL,
+			"downloaded_bytes" INTEGER NOT NULL,
+			"total_bytes" INTEGER NOT NULL,
+			"speed" INTEGER NOT NULL,
+			"eta" INTEGER NOT NULL,
+			"filename" TEXT NOT NULL DEFAULT '',
+			"updated_at" INTEGER NOT NULL
+		)`,
+	`CREATE TABLE IF NOT EXISTS "failed_tasks" (
+			"id" INTEGER NOT NULL PRIMARY KEY,
+	    "video_id" TEXT NOT NULL,	
 	    "video_format" TEXT NOT NULL,	
 	    "audio_format" TEXT NOT NULL,	
 	    "url" TEXT NOT NULL,	
@@ -47,42 +64,57 @@ func InitializeSchema(varDB *sql.DB) (err error) {
 			"updated_at" INTEGER NOT NULL,
 			"started_at" INTEGER NOT NULL,
 			"failed_at" INTEGER NOT NULL,
-			PRIMARY KEY ("id", "video_format", "audio_format")
+			"exit_code" INTEGER NOT NULL DEFAULT 0,
+			"log_path" TEXT NOT NULL DEFAULT '',
+			"reason" TEXT NOT NULL DEFAULT '',
+			"log_tail" TEXT NOT NULL DEFAULT '',
+			"attempts" INTEGER NOT NULL DEFAULT 0
 		)`,
-	}
+	`CREATE INDEX IF NOT EXISTS "failed_tasks_video_id" ON "failed_tasks" ("video_id")`,
+	`CREATE TABLE IF NOT EXISTS "webhooks" (
+			"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+	    "url" TEXT NOT NULL,	
+	    "secret" TEXT NOT NULL,	
+	    "events" TEXT NOT NULL,	
+			"created_at" INTEGER NOT NULL
+		)`,
+	`CREATE TABLE IF NOT EXISTS "webhook_deliveries" (
+			"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+			"webhook_id" INTEGER NOT NULL,
+	    "event" TEXT NOT NULL,	
+			"task_id" INTEGER NOT NULL,
+	    "video_id" TEXT NOT NULL,	
+			"attempt" INTEGER NOT NULL,
+			"status_code" INTEGER NOT NULL,
+	    "error" TEXT NOT NULL,	
+			"delivered_at" INTEGER NOT NULL
+		)`,
+}
 
-	for _, sql := range sqls {
-		if _, err = db.Exec(sql); err != nil {
-			return err
-		}
+// InitializeSchema makes the default queue run on a SQLite store on varDB,
+// see NewSQLiteStore. Call SetLogDirectory before it.
+func InitializeSchema(varDB *sql.DB) error {
+	s, err := NewSQLiteStore(varDB, defaultQueue.logDirectory)
+	if err != nil {
+		return err
 	}
 
-	return err
-}
+	SetStore(s)
 
-func CloseDB() {
-	db.Close()
+	return nil
 }
 
-func initializeDB(varDB *sql.DB) error {
-	db = varDB
-	if db == nil {
-		return errors.New("cannot found db!")
+func execSqls(e execer, sqls []string) error {
+	for _, sql := range sqls {
+		if _, err := e.Exec(sql); err != nil {
+			return err
+		}
 	}
+
 	return nil
 }
 
-func createSqlStmt(sql string) (stmt *sql.Stmt, err error) {
-	stmt, ok := sqlStmts[sql]
-	if ok {
-		return stmt, err
-	}
-
-	stmt, err = db.Prepare(sql)
-	if err == nil {
-		sqlStmts[sql] = stmt
-		return stmt, err
-	} else {
-		return nil, err
-	}
+// CloseDB closes the store of the default queue.
+func CloseDB() {
+	defaultQueue.Close()
 }
@@ -2,6 +2,9 @@ package queue
 
 import (
 	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -23,11 +26,11 @@ func TestInitializeSchema(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if db == nil {
-		t.Fatalf("db is nil.")
+	if defaultQueue.store == nil {
+		t.Fatalf("store is nil.")
 	}
 
-	rows, _ := db.Query(`SELECT name FROM sqlite_master WHERE type = 'table'`)
+	rows, _ := testDb.Query(`SELECT name FROM sqlite_master WHERE type = 'table'`)
 
 	defer rows.Close()
 
@@ -47,22 +50,192 @@ func TestInitializeSchema(t *testing.T) {
 	}
 }
 
-func TestCloseDB(t *testing.T) {
-	var err error
+// legacySchemaSqlsForTest is the schema keyed on video ids, before job ids.
+var legacySchemaSqlsForTest = []string{
+	`CREATE TABLE "current_task" ("id" TEXT NOT NULL, "video_format" TEXT NOT NULL, "audio_format" TEXT NOT NULL, PRIMARY KEY ("id", "video_format", "audio_format"))`,
+	`CREATE TABLE "tasks" ("id" TEXT NOT NULL, "video_format" TEXT NOT NULL, "audio_format" TEXT NOT NULL, "url" TEXT NOT NULL, "title" TEXT NOT NULL, "output_path" TEXT NOT NULL, "parameter" TEXT NOT NULL, "created_at" INTEGER NOT NULL, "updated_at" INTEGER NOT NULL, "started_at" INTEGER NOT NULL, PRIMARY KEY ("id", "video_format", "audio_format"))`,
+	`CREATE TABLE "failed_tasks" ("id" TEXT NOT NULL, "video_format" TEXT NOT NULL, "audio_format" TEXT NOT NULL, "url" TEXT NOT NULL, "title" TEXT NOT NULL, "output_path" TEXT NOT NULL, "parameter" TEXT NOT NULL, "created_at" INTEGER NOT NULL, "updated_at" INTEGER NOT NULL, "started_at" INTEGER NOT NULL, "failed_at" INTEGER NOT NULL, PRIMARY KEY ("id", "video_format", "audio_format"))`,
+	`INSERT INTO tasks VALUES ('Legacy', '137', '140', 'https://www.youtube.com/watch?v=Legacy', 'TestLegacy', '/tmp/output', '', 1, 1, 0)`,
+	`INSERT INTO tasks VALUES ('Legacy', '136', '140', 'https://www.youtube.com/watch?v=Legacy', 'TestLegacy', '/tmp/output', '', 2, 2, 5)`,
+	`INSERT INTO failed_tasks VALUES ('LegacyFailed', '137', '140', 'https://www.youtube.com/watch?v=LegacyFailed', 'TestLegacyFailed', '/tmp/output', '', 1, 1, 1, 3)`,
+}
+
+func TestMigrateLegacyLayout(t *testing.T) {
+	InitializeForTest(t)
 
 	sqlitePath, err := TempFileName()
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	db, err = sql.Open("sqlite3", sqlitePath)
+	testDb, err := sql.Open("sqlite3", sqlitePath)
 	if err != nil {
 		t.Fatal(err)
 	}
 
+	for _, sql := range legacySchemaSqlsForTest {
+		if _, err := testDb.Exec(sql); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, videoId := range []string{"Legacy", "LegacyFailed"} {
+		if err := ioutil.WriteFile(filepath.Join(defaultQueue.logDirectory, videoId+".log"), []byte(videoId+"\n"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := InitializeSchema(testDb); err != nil {
+		t.Fatal(err)
+	}
+
+	if version, _ := schemaVersion(testDb); version != migrations[len(migrations)-1].version {
+		t.Fatalf("migrated db is not upgraded! %d", version)
+	}
+
+	tasks, err := GetTasksByVideoId("Legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tasks) != 2 || tasks[0].Id == tasks[1].Id || tasks[0].StartedAt != 0 || tasks[1].StartedAt != 0 {
+		t.Fatalf("different tasks! %+v", tasks)
+	}
+
+	failedTasks, err := GetFailedTasksByVideoId("LegacyFailed")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(failedTasks) != 1 || failedTasks[0].Id <= tasks[0].Id || failedTasks[0].Id <= tasks[1].Id || failedTasks[0].FailedAt != 3 {
+		t.Fatalf("different failed tasks! %+v", failedTasks)
+	}
+
+	// every job has a copy of the log of its video
+	for _, task := range append(tasks, Task{Id: failedTasks[0].Id, VideoId: failedTasks[0].VideoId}) {
+		b, err := ioutil.ReadFile(task.LogPath())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(b) != task.VideoId+"\n" {
+			t.Fatalf("different log of %d! %q", task.Id, b)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(defaultQueue.logDirectory, "Legacy.log")); !os.IsNotExist(err) {
+		t.Fatalf("legacy log is not removed!")
+	}
+
+	// new jobs never take the id of a failed task
+	task := Task{
+		VideoFormat: "137",
+		AudioFormat: "140",
+		Url:         "https://www.youtube.com/watch?v=LegacyFailed",
+		OutputPath:  "/tmp/other",
+	}
+	if err := task.AddTask(); err != nil {
+		t.Fatal(err)
+	}
+
+	if task.Id <= failedTasks[0].Id {
+		t.Fatalf("job id %d is reused!", task.Id)
+	}
+
+	if _, err := failedTasks[0].RequeueTask(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the migration runs only once
+	if err := InitializeSchema(testDb); err != nil {
+		t.Fatal(err)
+	}
+
+	if tasks, _ := GetAllTasks(); len(tasks) != 4 {
+		t.Fatalf("different tasks size! %d", len(tasks))
+	}
+}
+
+func TestMigrateLegacyLayoutOfQueue(t *testing.T) {
+	InitializeForTest(t)
+
+	sqlitePath, err := TempFileName()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testDb, err := sql.Open("sqlite3", sqlitePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sql := range legacySchemaSqlsForTest {
+		if _, err := testDb.Exec(sql); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	logDir, err := ioutil.TempDir("", "youtube-dl-queue-log-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(logDir, "LegacyFailed.log"), []byte("LegacyFailed\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewSQLiteStore(testDb, logDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q, err := New(Options{Store: s, LogDirectory: logDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failedTasks, err := q.GetFailedTasksByVideoId("LegacyFailed")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(failedTasks) != 1 {
+		t.Fatalf("different failed tasks! %+v", failedTasks)
+	}
+
+	b, err := ioutil.ReadFile(q.LogPath(failedTasks[0].Id))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != "LegacyFailed\n" {
+		t.Fatalf("different log! %q", b)
+	}
+
+	// the default queue keeps its own logs
+	if _, err := os.Stat(defaultQueue.LogPath(failedTasks[0].Id)); !os.IsNotExist(err) {
+		t.Fatalf("log is migrated into the default queue!")
+	}
+}
+
+func TestCloseDB(t *testing.T) {
+	sqlitePath, err := TempFileName()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testDb, err := sql.Open("sqlite3", sqlitePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := InitializeSchema(testDb); err != nil {
+		t.Fatal(err)
+	}
+
 	CloseDB()
 
-	if db.Stats().Idle != 0 {
+	if testDb.Stats().Idle != 0 {
 		t.Fatalf("DB Idle connections exist!")
 	}
 }
@@ -0,0 +1,184 @@
+package queue
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+var ErrInvalidOptions = errors.New("download options are invalid.")
+
+// DownloadOptions are the downloader options a task sets most often,
+// translated into the flags of its downloader, see Downloader.Args.
+// They are stored as a JSON object.
+type DownloadOptions struct {
+	// SubtitleLanguages are the languages of the subtitles written next to
+	// the video, none for no subtitles. AutoSubtitles takes automatic
+	// captions too, and EmbedSubtitles embeds them into the video.
+	SubtitleLanguages []string `json:"subtitle_languages,omitempty"`
+	AutoSubtitles     bool     `json:"auto_subtitles,omitempty"`
+	EmbedSubtitles    bool     `json:"embed_subtitles,omitempty"`
+
+	EmbedThumbnail bool `json:"embed_thumbnail,omitempty"`
+	EmbedMetadata  bool `json:"embed_metadata,omitempty"`
+
+	// RateLimit is bytes per second, as "50K" or "4.2M".
+	RateLimit string `json:"rate_limit,omitempty"`
+	Proxy     string `json:"proxy,omitempty"`
+	// CookiesFile is the absolute path of a Netscape cookies file
+	// on the host running the task.
+	CookiesFile string `json:"cookies_file,omitempty"`
+
+	// MergeOutputFormat is the container the formats are merged into,
+	// as "mkv".
+	MergeOutputFormat string `json:"merge_output_format,omitempty"`
+
+	// ExtractAudio converts the download into an audio file of AudioCodec,
+	// "best" by default, at AudioQuality, a VBR quality from "0" (best)
+	// to "9" or a bitrate as "128K".
+	ExtractAudio bool   `json:"extract_audio,omitempty"`
+	AudioCodec   string `json:"audio_codec,omitempty"`
+	AudioQuality string `json:"audio_quality,omitempty"`
+
+	// DateAfter and DateBefore limit the uploads downloaded of a playlist
+	// or channel to a range of YYYYMMDD dates, both inclusive.
+	DateAfter  string `json:"date_after,omitempty"`
+	DateBefore string `json:"date_before,omitempty"`
+	// PlaylistStart and PlaylistEnd limit the items downloaded of a playlist,
+	// counted from 1 and both inclusive. 0 is the start or end of the playlist.
+	PlaylistStart int `json:"playlist_start,omitempty"`
+	PlaylistEnd   int `json:"playlist_end,omitempty"`
+}
+
+var (
+	mergeOutputFormats = []string{"mkv", "mp4", "ogg", "webm", "flv"}
+	// subtitles are embedded into these containers only
+	subtitleContainers = []string{"mkv", "mp4", "webm"}
+	// and thumbnails into these
+	thumbnailContainers = []string{"mkv", "mp4"}
+	audioCodecs         = []string{"best", "aac", "flac", "mp3", "m4a", "opus", "vorbis", "wav"}
+	proxySchemes        = []string{"http", "https", "socks4", "socks4a", "socks5", "socks5h"}
+
+	rateLimitRegexp    = regexp.MustCompile(`^\d+(\.\d+)?[KMGTP]?$`)
+	audioQualityRegexp = regexp.MustCompile(`^([0-9]|\d+K)$`)
+	languageRegexp     = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+)
+
+// validate rejects malformed values, and options which cannot be combined.
+func (o DownloadOptions) validate() error {
+	for _, language := range o.SubtitleLanguages {
+		if !languageRegexp.MatchString(language) {
+			return fmt.Errorf("subtitle language %q is invalid: %w", language, ErrInvalidOptions)
+		}
+	}
+
+	if len(o.SubtitleLanguages) == 0 && (o.AutoSubtitles || o.EmbedSubtitles) {
+		return fmt.Errorf("auto_subtitles and embed_subtitles need subtitle_languages: %w", ErrInvalidOptions)
+	}
+
+	if o.RateLimit != "" && !rateLimitRegexp.MatchString(o.RateLimit) {
+		return fmt.Errorf("rate limit %q is invalid: %w", o.RateLimit, ErrInvalidOptions)
+	}
+
+	if o.Proxy != "" {
+		proxy, err := url.Parse(o.Proxy)
+		if err != nil || proxy.Host == "" || !containsString(proxySchemes, proxy.Scheme) {
+			return fmt.Errorf("proxy %q is invalid: %w", o.Proxy, ErrInvalidOptions)
+		}
+	}
+
+	if o.CookiesFile != "" && !filepath.IsAbs(o.CookiesFile) {
+		return fmt.Errorf("cookies file %q is not an absolute path: %w", o.CookiesFile, ErrInvalidOptions)
+	}
+
+	if o.MergeOutputFormat != "" {
+		if !containsString(mergeOutputFormats, o.MergeOutputFormat) {
+			return fmt.Errorf("merge output format %q is unknown: %w", o.MergeOutputFormat, ErrInvalidOptions)
+		}
+
+		if o.EmbedSubtitles && !containsString(subtitleContainers, o.MergeOutputFormat) {
+			return fmt.Errorf("subtitles cannot be embedded into %s: %w", o.MergeOutputFormat, ErrInvalidOptions)
+		}
+
+		if o.EmbedThumbnail && !containsString(thumbnailContainers, o.MergeOutputFormat) {
+			return fmt.Errorf("thumbnails cannot be embedded into %s: %w", o.MergeOutputFormat, ErrInvalidOptions)
+		}
+	}
+
+	if o.ExtractAudio {
+		if o.MergeOutputFormat != "" || o.EmbedSubtitles {
+			return fmt.Errorf("extract_audio cannot be combined with merge_output_format or embed_subtitles: %w", ErrInvalidOptions)
+		}
+
+		if o.AudioCodec != "" && !containsString(audioCodecs, o.AudioCodec) {
+			return fmt.Errorf("audio codec %q is unknown: %w", o.AudioCodec, ErrInvalidOptions)
+		}
+
+		if o.AudioQuality != "" && !audioQualityRegexp.MatchString(o.AudioQuality) {
+			return fmt.Errorf("audio quality %q is invalid: %w", o.AudioQuality, ErrInvalidOptions)
+		}
+	} else if o.AudioCodec != "" || o.AudioQuality != "" {
+		return fmt.Errorf("audio_codec and audio_quality need extract_audio: %w", ErrInvalidOptions)
+	}
+
+	var after, before time.Time
+	for _, date := range []struct {
+		value string
+		time  *time.Time
+	}{{o.DateAfter, &after}, {o.DateBefore, &before}} {
+		if date.value == "" {
+			continue
+		}
+
+		t, err := time.Parse("20060102", date.value)
+		if err != nil {
+			return fmt.Errorf("date %q is not YYYYMMDD: %w", date.value, ErrInvalidOptions)
+		}
+		*date.time = t
+	}
+
+	if !after.IsZero() && !before.IsZero() && after.After(before) {
+		return fmt.Errorf("date_after is after date_before: %w", ErrInvalidOptions)
+	}
+
+	if o.PlaylistStart < 0 || o.PlaylistEnd < 0 {
+		return fmt.Errorf("playlist_start and playlist_end must not be negative: %w", ErrInvalidOptions)
+	}
+
+	if o.PlaylistEnd != 0 && o.PlaylistStart > o.PlaylistEnd {
+		return fmt.Errorf("playlist_start is after playlist_end: %w", ErrInvalidOptions)
+	}
+
+	return nil
+}
+
+// Value stores the options as a JSON object.
+func (o DownloadOptions) Value() (driver.Value, error) {
+	value, err := json.Marshal(o)
+	if err != nil {
+		return nil, err
+	}
+
+	return string(value), nil
+}
+
+func (o *DownloadOptions) Scan(src interface{}) error {
+	var value []byte
+	switch src := src.(type) {
+	case []byte:
+		value = src
+	case string:
+		value = []byte(src)
+	default:
+		return fmt.Errorf("cannot scan %T into download options.", src)
+	}
+
+	*o = DownloadOptions{}
+
+	return json.Unmarshal(value, o)
+}
@@ -0,0 +1,163 @@
+package queue
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDownloadOptionsValidate(t *testing.T) {
+	valids := []DownloadOptions{
+		{},
+		{SubtitleLanguages: []string{"en", "pt-BR"}, AutoSubtitles: true, EmbedSubtitles: true, MergeOutputFormat: "mkv"},
+		{EmbedThumbnail: true, EmbedMetadata: true, MergeOutputFormat: "mp4"},
+		{RateLimit: "4.2M", Proxy: "socks5://127.0.0.1:1080/", CookiesFile: "/etc/youtube-dl/cookies.txt"},
+		{ExtractAudio: true, AudioCodec: "mp3", AudioQuality: "0"},
+		{ExtractAudio: true, AudioQuality: "128K", EmbedThumbnail: true},
+		{DateAfter: "20200101", DateBefore: "20200101", PlaylistStart: 2, PlaylistEnd: 2},
+		{PlaylistStart: 10},
+	}
+
+	for _, o := range valids {
+		if err := o.validate(); err != nil {
+			t.Fatalf("%+v: %s", o, err)
+		}
+	}
+
+	invalids := []DownloadOptions{
+		{SubtitleLanguages: []string{"en,ja"}},
+		{AutoSubtitles: true},
+		{EmbedSubtitles: true},
+		{SubtitleLanguages: []string{"en"}, EmbedSubtitles: true, MergeOutputFormat: "flv"},
+		{EmbedThumbnail: true, MergeOutputFormat: "webm"},
+		{MergeOutputFormat: "avi"},
+		{RateLimit: "fast"},
+		{RateLimit: "50KB"},
+		{Proxy: "127.0.0.1:1080"},
+		{Proxy: "ftp://127.0.0.1/"},
+		{CookiesFile: "cookies.txt"},
+		{ExtractAudio: true, MergeOutputFormat: "mkv"},
+		{ExtractAudio: true, SubtitleLanguages: []string{"en"}, EmbedSubtitles: true},
+		{ExtractAudio: true, AudioCodec: "wma"},
+		{ExtractAudio: true, AudioQuality: "10"},
+		{AudioCodec: "mp3"},
+		{AudioQuality: "0"},
+		{DateAfter: "2020-01-01"},
+		{DateAfter: "20200102", DateBefore: "20200101"},
+		{PlaylistStart: -1},
+		{PlaylistStart: 3, PlaylistEnd: 2},
+	}
+
+	for _, o := range invalids {
+		if err := o.validate(); !errors.Is(err, ErrInvalidOptions) {
+			t.Fatalf("%+v: expected invalid options error, got %v", o, err)
+		}
+	}
+}
+
+func TestDownloadOptionsArgs(t *testing.T) {
+	task := Task{
+		VideoFormat: "137",
+		AudioFormat: "140",
+		Url:         "https://www.youtube.com/watch?v=DownloadOptionsArgs",
+		OutputPath:  "/tmp/output",
+		Parameters:  Parameters{"--no-mtime"},
+		Options: DownloadOptions{
+			SubtitleLanguages: []string{"en", "ja"},
+			AutoSubtitles:     true,
+			EmbedSubtitles:    true,
+			EmbedThumbnail:    true,
+			EmbedMetadata:     true,
+			RateLimit:         "50K",
+			Proxy:             "http://proxy:3128/",
+			CookiesFile:       "/tmp/cookies.txt",
+			MergeOutputFormat: "mkv",
+			DateAfter:         "20200101",
+			DateBefore:        "20201231",
+			PlaylistStart:     2,
+			PlaylistEnd:       5,
+		},
+	}
+
+	expected := map[string]string{
+		YoutubeDl: "--write-sub --sub-lang en,ja --write-auto-sub --embed-subs --embed-thumbnail --add-metadata",
+		YtDlp:     "--write-subs --sub-langs en,ja --write-auto-subs --embed-subs --embed-thumbnail --embed-metadata",
+	}
+
+	for _, d := range downloadersForTest(t) {
+		args := strings.Join(d.downloader.Args(task, "/usr/bin/ffmpeg"), " ")
+
+		// the options come before the parameters, which may override them
+		if !strings.Contains(args, "-o /tmp/output "+expected[d.downloader.Name()]+
+			" --limit-rate 50K --proxy http://proxy:3128/ --cookies /tmp/cookies.txt --merge-output-format mkv"+
+			" --dateafter 20200101 --datebefore 20201231 --playlist-start 2 --playlist-end 5 --no-mtime https://") {
+			t.Fatalf("%s: different args! %s", d.downloader.Name(), args)
+		}
+	}
+
+	task.Options = DownloadOptions{ExtractAudio: true, AudioCodec: "opus", AudioQuality: "5"}
+	args := strings.Join(NewYoutubeDl("youtube-dl").Args(task, "/usr/bin/ffmpeg"), " ")
+	if !strings.Contains(args, "-o /tmp/output --extract-audio --audio-format opus --audio-quality 5 --no-mtime") {
+		t.Fatalf("different audio args! %s", args)
+	}
+}
+
+func TestQueueTaskOptions(t *testing.T) {
+	for name, s := range storesForTest(t) {
+		q, err := New(Options{Store: s, Downloader: NewYoutubeDl("youtube-dl")})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		task := Task{
+			VideoFormat: "137",
+			AudioFormat: "140",
+			Url:         "https://www.youtube.com/watch?v=QueueTaskOptions",
+			OutputPath:  "/tmp/output",
+			Options:     DownloadOptions{SubtitleLanguages: []string{"en"}, EmbedSubtitles: true, RateLimit: "1M"},
+		}
+		if err := q.QueueTask(&task); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		queued, err := q.GetTask(task.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if strings.Join(queued.Options.SubtitleLanguages, ",") != "en" || !queued.Options.EmbedSubtitles || queued.Options.RateLimit != "1M" {
+			t.Fatalf("%s: different options! %+v", name, queued.Options)
+		}
+
+		// failed and requeued tasks keep their options
+		failedTask, err := q.FailTask(&queued, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if failedTask, err = q.GetFailedTask(failedTask.Id); err != nil || failedTask.Options.RateLimit != "1M" {
+			t.Fatalf("%s: different failed task options! %+v %v", name, failedTask.Options, err)
+		}
+
+		requeued, err := q.RequeueTask(failedTask)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if requeued, err = q.GetTask(requeued.Id); err != nil || requeued.Options.RateLimit != "1M" {
+			t.Fatalf("%s: different requeued options! %+v %v", name, requeued.Options, err)
+		}
+
+		invalid := Task{
+			VideoFormat: "137",
+			AudioFormat: "140",
+			Url:         "https://www.youtube.com/watch?v=QueueTaskOptionsInvalid",
+			Options:     DownloadOptions{ExtractAudio: true, MergeOutputFormat: "mkv"},
+		}
+		if err := q.QueueTask(&invalid); !errors.Is(err, ErrInvalidOptions) {
+			t.Fatalf("%s: expected invalid options error, got %v", name, err)
+		}
+
+		s.Close()
+	}
+}
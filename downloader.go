@@ -0,0 +1,415 @@
+package queue
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	YoutubeDl = "youtube-dl"
+	YtDlp     = "yt-dlp"
+)
+
+var ErrUnknownDownloader = errors.New("downloader is unknown.")
+
+// Downloader runs a youtube-dl compatible program for tasks.
+// A queue runs tasks on its default downloader, unless they select
+// another one of the queue by Task.Downloader.
+type Downloader interface {
+	// Name is what tasks select the downloader by, such as "yt-dlp".
+	Name() string
+	// Path is the executable of the downloader.
+	Path() string
+	// Args returns the arguments downloading t, merging the formats
+	// with the ffmpeg at ffmpegPath, if not empty.
+	Args(t Task, ffmpegPath string) []string
+	// Version returns the version the executable reports.
+	Version(ctx context.Context) (string, error)
+	// ParseProgress reads a line of output, and reports false
+	// when the line tells nothing about the progress.
+	ParseProgress(line string) (ProgressLine, bool)
+	// ClassifyFailure derives a FailureReason from the output of a failed run
+	// and the error returned by running it.
+	ClassifyFailure(output string, cause error) FailureReason
+}
+
+// ProgressLineKind is what a line of downloader output reports.
+type ProgressLineKind string
+
+const (
+	// LineDownload reports the bytes downloaded of the current file.
+	LineDownload ProgressLineKind = "download"
+	// LineDestination starts the download of a file.
+	LineDestination ProgressLineKind = "destination"
+	// LineDownloaded reports a file downloaded by an earlier run.
+	LineDownloaded ProgressLineKind = "downloaded"
+	// LineMerging starts merging the formats into a file.
+	LineMerging ProgressLineKind = "merging"
+	// LineFormats reports the ids of the formats selected for download.
+	LineFormats ProgressLineKind = "formats"
+	// LineInfoJson reports the info JSON file of a video, naming its formats.
+	LineInfoJson ProgressLineKind = "info_json"
+)
+
+// ProgressLine is a line of downloader output about the progress of a task.
+// FormatIds is set for formats lines, Filename for destination, downloaded,
+// merging and info JSON lines, and the rest for download lines.
+type ProgressLine struct {
+	Kind            ProgressLineKind
+	FormatIds       []string
+	Filename        string
+	Percent         float64
+	DownloadedBytes int64
+	TotalBytes      int64
+	Speed           int64 // bytes per second
+	Eta             int64 // seconds
+}
+
+var (
+	progressLineRegexp = regexp.MustCompile(
+		`^\[download\]\s+([\d.]+)%\s+of\s+~?\s*([\d.]+)([KMGTP]?i?B)` +
+			`(?:\s+at\s+(?:([\d.]+)([KMGTP]?i?B)/s|Unknown speed))?` +
+			`(?:\s+ETA\s+(?:([\d:]+)|Unknown ETA))?`,
+	)
+	destinationLineRegexp = regexp.MustCompile(`^\[download\] Destination: (.+)$`)
+	mergingLineRegexp     = regexp.MustCompile(`^\[(?:ffmpeg|Merger)\] Merging formats into "(.+)"$`)
+	downloadedLineRegexp  = regexp.MustCompile(`^\[download\] (.+) has already been downloaded`)
+	infoJsonLineRegexp    = regexp.MustCompile(`^\[info\] Writing video (?:description )?metadata as JSON to: (.+)$`)
+)
+
+type youtubeDl struct {
+	path string
+}
+
+// NewYoutubeDl returns the youtube-dl at path.
+func NewYoutubeDl(path string) Downloader {
+	return youtubeDl{path: path}
+}
+
+func (d youtubeDl) Name() string {
+	return YoutubeDl
+}
+
+func (d youtubeDl) Path() string {
+	return d.path
+}
+
+// Args make youtube-dl write the info JSON of the video, which is the only
+// place it tells the formats it resolved when they are not merged.
+func (d youtubeDl) Args(t Task, ffmpegPath string) []string {
+	return append([]string{"--write-info-json"}, d.args(t, ffmpegPath, youtubeDlFlags)...)
+}
+
+// args are the arguments of t, translating its DownloadOptions into flags.
+func (d youtubeDl) args(t Task, ffmpegPath string, flags downloadFlags) []string {
+	params := []string{
+		"-f", t.FormatSpec(), // format
+		"-o", t.OutputPath, // file output
+	}
+
+	// without one, the downloader finds ffmpeg by itself
+	if ffmpegPath != "" {
+		params = append([]string{"--ffmpeg-location", ffmpegPath}, params...)
+	}
+
+	params = append(params, flags.args(t.Options)...)
+	params = append(params, t.Parameters...)
+
+	return append(params, t.Url)
+}
+
+// downloadFlags name the flags of DownloadOptions which differ between
+// youtube-dl and yt-dlp.
+type downloadFlags struct {
+	writeSubtitles    string
+	subtitleLanguages string
+	autoSubtitles     string
+	embedMetadata     string
+}
+
+var youtubeDlFlags = downloadFlags{
+	writeSubtitles:    "--write-sub",
+	subtitleLanguages: "--sub-lang",
+	autoSubtitles:     "--write-auto-sub",
+	embedMetadata:     "--add-metadata",
+}
+
+func (flags downloadFlags) args(o DownloadOptions) []string {
+	args := []string{}
+
+	if len(o.SubtitleLanguages) > 0 {
+		args = append(args, flags.writeSubtitles, flags.subtitleLanguages, strings.Join(o.SubtitleLanguages, ","))
+		if o.AutoSubtitles {
+			args = append(args, flags.autoSubtitles)
+		}
+		if o.EmbedSubtitles {
+			args = append(args, "--embed-subs")
+		}
+	}
+
+	if o.EmbedThumbnail {
+		args = append(args, "--embed-thumbnail")
+	}
+	if o.EmbedMetadata {
+		args = append(args, flags.embedMetadata)
+	}
+
+	if o.RateLimit != "" {
+		args = append(args, "--limit-rate", o.RateLimit)
+	}
+	if o.Proxy != "" {
+		args = append(args, "--proxy", o.Proxy)
+	}
+	if o.CookiesFile != "" {
+		args = append(args, "--cookies", o.CookiesFile)
+	}
+
+	if o.MergeOutputFormat != "" {
+		args = append(args, "--merge-output-format", o.MergeOutputFormat)
+	}
+
+	if o.ExtractAudio {
+		args = append(args, "--extract-audio")
+		if o.AudioCodec != "" {
+			args = append(args, "--audio-format", o.AudioCodec)
+		}
+		if o.AudioQuality != "" {
+			args = append(args, "--audio-quality", o.AudioQuality)
+		}
+	}
+
+	if o.DateAfter != "" {
+		args = append(args, "--dateafter", o.DateAfter)
+	}
+	if o.DateBefore != "" {
+		args = append(args, "--datebefore", o.DateBefore)
+	}
+	if o.PlaylistStart != 0 {
+		args = append(args, "--playlist-start", strconv.Itoa(o.PlaylistStart))
+	}
+	if o.PlaylistEnd != 0 {
+		args = append(args, "--playlist-end", strconv.Itoa(o.PlaylistEnd))
+	}
+
+	return args
+}
+
+func (d youtubeDl) Version(ctx context.Context) (string, error) {
+	return commandVersion(ctx, d.path, "--version")
+}
+
+func (d youtubeDl) ParseProgress(line string) (ProgressLine, bool) {
+	if matches := destinationLineRegexp.FindStringSubmatch(line); matches != nil {
+		return ProgressLine{Kind: LineDestination, Filename: matches[1]}, true
+	}
+
+	if matches := downloadedLineRegexp.FindStringSubmatch(line); matches != nil {
+		return ProgressLine{Kind: LineDownloaded, Filename: matches[1]}, true
+	}
+
+	if matches := mergingLineRegexp.FindStringSubmatch(line); matches != nil {
+		return ProgressLine{Kind: LineMerging, Filename: matches[1]}, true
+	}
+
+	if matches := infoJsonLineRegexp.FindStringSubmatch(line); matches != nil {
+		return ProgressLine{Kind: LineInfoJson, Filename: matches[1]}, true
+	}
+
+	matches := progressLineRegexp.FindStringSubmatch(line)
+	if matches == nil {
+		return ProgressLine{}, false
+	}
+
+	progress := ProgressLine{Kind: LineDownload}
+	progress.Percent, _ = strconv.ParseFloat(matches[1], 64)
+	progress.TotalBytes = parseBytes(matches[2], matches[3])
+	progress.DownloadedBytes = int64(float64(progress.TotalBytes) * progress.Percent / 100)
+	if matches[4] != "" {
+		progress.Speed = parseBytes(matches[4], matches[5])
+	}
+	if matches[6] != "" {
+		progress.Eta = parseEta(matches[6])
+	}
+
+	return progress, true
+}
+
+func (d youtubeDl) ClassifyFailure(output string, cause error) FailureReason {
+	return ClassifyFailure(output, cause)
+}
+
+// ytDlpProgressTemplate makes yt-dlp print exact byte counts, one line each.
+const ytDlpProgressTemplate = "download:[progress] %(progress.downloaded_bytes)s %(progress.total_bytes,progress.total_bytes_estimate)s %(progress.speed)s %(progress.eta)s"
+
+var (
+	ytDlpProgressLineRegexp = regexp.MustCompile(`^\[progress\] (\d+|NA) ([\d.]+|NA) ([\d.]+|NA) ([\d.]+|NA)$`)
+	// the formats of each video, as "137+140" or "137+140, 22" for several
+	ytDlpFormatsLineRegexp = regexp.MustCompile(`^\[info\] .+: Downloading \d+ format\(s\): (.+)$`)
+)
+
+// ytDlpFailurePatterns are the messages of yt-dlp youtube-dl does not print,
+// matched before failurePatterns.
+var ytDlpFailurePatterns = []failurePattern{
+	{ReasonRateLimited, []string{
+		"not a bot",
+		"this content isn't available, try again later",
+	}},
+	{ReasonUnavailable, []string{
+		"members-only",
+		"join this channel",
+		"premieres in",
+		"this video is private",
+	}},
+	{ReasonFFmpeg, []string{
+		"ffmpeg not found",
+	}},
+	{ReasonNetwork, []string{
+		"got error:",
+		"http error 403",
+	}},
+}
+
+// ytDlpFlags are the names yt-dlp gives the flags, youtube-dl names
+// being kept as aliases or taken as abbreviations.
+var ytDlpFlags = downloadFlags{
+	writeSubtitles:    "--write-subs",
+	subtitleLanguages: "--sub-langs",
+	autoSubtitles:     "--write-auto-subs",
+	embedMetadata:     "--embed-metadata",
+}
+
+// ytDlp differs from youtube-dl in its progress output, error messages
+// and the names of some flags.
+type ytDlp struct {
+	youtubeDl
+}
+
+// NewYtDlp returns the yt-dlp at path.
+func NewYtDlp(path string) Downloader {
+	return ytDlp{youtubeDl{path: path}}
+}
+
+func (d ytDlp) Name() string {
+	return YtDlp
+}
+
+func (d ytDlp) Args(t Task, ffmpegPath string) []string {
+	params := []string{
+		"--newline",
+		"--progress-template", ytDlpProgressTemplate,
+	}
+
+	return append(params, d.youtubeDl.args(t, ffmpegPath, ytDlpFlags)...)
+}
+
+func (d ytDlp) ParseProgress(line string) (ProgressLine, bool) {
+	if matches := ytDlpFormatsLineRegexp.FindStringSubmatch(line); matches != nil {
+		return ProgressLine{Kind: LineFormats, FormatIds: strings.FieldsFunc(matches[1], func(r rune) bool {
+			return r == '+' || r == ',' || r == ' '
+		})}, true
+	}
+
+	matches := ytDlpProgressLineRegexp.FindStringSubmatch(line)
+	if matches == nil {
+		// the default progress lines are kept for parameters overriding the template
+		return d.youtubeDl.ParseProgress(line)
+	}
+
+	progress := ProgressLine{Kind: LineDownload}
+	progress.DownloadedBytes, _ = strconv.ParseInt(matches[1], 10, 64)
+	progress.TotalBytes = parseBytes(matches[2], "B")
+	progress.Speed = parseBytes(matches[3], "B")
+	progress.Eta = parseBytes(matches[4], "B")
+	if progress.TotalBytes > 0 {
+		progress.Percent = float64(progress.DownloadedBytes) * 100 / float64(progress.TotalBytes)
+	}
+
+	return progress, true
+}
+
+func (d ytDlp) ClassifyFailure(output string, cause error) FailureReason {
+	return classifyFailure(output, cause, append(ytDlpFailurePatterns, failurePatterns...))
+}
+
+// commandVersion returns the first line printed by path with versionFlag.
+func commandVersion(ctx context.Context, path string, versionFlag string) (string, error) {
+	output, err := exec.CommandContext(ctx, path, versionFlag).Output()
+	if err != nil {
+		return "", err
+	}
+
+	version := strings.TrimSpace(string(bytes.SplitN(output, []byte("\n"), 2)[0]))
+	if version == "" {
+		return "", errors.New(path + " reports no version.")
+	}
+
+	return version, nil
+}
+
+// SetDownloader makes d the default downloader of the default queue.
+func SetDownloader(d Downloader) {
+	defaultQueue.SetDownloader(d)
+}
+
+// SetDownloader makes d run the tasks selecting no downloader,
+// and the tasks selecting it by name. Set it before Start.
+func (q *Queue) SetDownloader(d Downloader) {
+	q.downloader = d
+	q.AddDownloader(d)
+}
+
+// AddDownloader lets tasks of the default queue select d by name.
+func AddDownloader(d Downloader) {
+	defaultQueue.AddDownloader(d)
+}
+
+// AddDownloader lets tasks select d by name, replacing the downloader
+// of the same name. Add it before Start.
+func (q *Queue) AddDownloader(d Downloader) {
+	q.downloaders[d.Name()] = d
+}
+
+// downloaderOf returns the downloader selected by t,
+// or ErrUnknownDownloader when the queue has no such downloader.
+func (q *Queue) downloaderOf(t Task) (Downloader, error) {
+	if t.Downloader == "" && q.downloader != nil {
+		return q.downloader, nil
+	}
+
+	if d, ok := q.downloaders[t.Downloader]; ok {
+		return d, nil
+	}
+
+	return nil, ErrUnknownDownloader
+}
+
+// classifyFailure classifies by the messages of the downloader of t.
+func (q *Queue) classifyFailure(t Task, output string, cause error) FailureReason {
+	if d, err := q.downloaderOf(t); err == nil {
+		return d.ClassifyFailure(output, cause)
+	}
+
+	return ClassifyFailure(output, cause)
+}
+
+// logDownloaderVersions logs the version of each downloader,
+// or why it cannot be run.
+func (q *Queue) logDownloaderVersions(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	for name, d := range q.downloaders {
+		if version, err := d.Version(ctx); err != nil {
+			log.Printf("%s at %s: %s", name, d.Path(), err)
+		} else {
+			log.Printf("%s %s at %s", name, version, d.Path())
+		}
+	}
+}
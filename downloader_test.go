@@ -0,0 +1,369 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fake youtube-dl: prints its progress for two formats merged into one file,
+// downloads the single format 22 writing its info JSON,
+// or fails as a removed video when any argument contains "fail".
+const fakeYoutubeDlScript = `#!/bin/sh
+if [ "$1" = "--version" ]; then
+	echo "2021.12.17"
+	exit 0
+fi
+format=""
+output=""
+while [ $# -gt 0 ]; do
+	case "$1" in
+		-f) format="$2"; shift ;;
+		-o) output="$2"; shift ;;
+		*fail*) echo "ERROR: Video unavailable" >&2; exit 1 ;;
+	esac
+	shift
+done
+echo "[youtube] Fake: Downloading webpage"
+if [ "$format" = "22" ]; then
+	echo '{"id": "Fake", "format_id": "22"}' > "$output.info.json"
+	echo "[info] Writing video description metadata as JSON to: $output.info.json"
+	echo "[download] Destination: $output.mp4"
+	echo "[download] 100.0% of 1.00MiB at 1.00MiB/s ETA 00:00"
+	exit 0
+fi
+echo "[download] Destination: /tmp/output.f137.mp4"
+printf "[download]  25.0%% of 4.00MiB at 512.00KiB/s ETA 00:06\r"
+echo "[download] 100.0% of 4.00MiB at 1.00MiB/s ETA 00:00"
+echo "[download] Destination: /tmp/output.f140.m4a"
+echo "[download] 100.0% of 1.00MiB at 1.00MiB/s ETA 00:00"
+echo "[ffmpeg] Merging formats into \"/tmp/output.mp4\""
+`
+
+// fake yt-dlp: prints its progress through the progress template it is given,
+// downloads the single format 22, or asks to sign in when any argument
+// contains "fail".
+const fakeYtDlpScript = `#!/bin/sh
+if [ "$1" = "--version" ]; then
+	echo "2023.07.06"
+	exit 0
+fi
+template=""
+format=""
+output=""
+while [ $# -gt 0 ]; do
+	case "$1" in
+		--progress-template) template="$2"; shift ;;
+		-f) format="$2"; shift ;;
+		-o) output="$2"; shift ;;
+		*fail*) echo "ERROR: [youtube] Fake: Sign in to confirm you're not a bot" >&2; exit 1 ;;
+	esac
+	shift
+done
+if [ "$template" = "" ]; then
+	echo "ERROR: no progress template" >&2
+	exit 2
+fi
+echo "[youtube] Fake: Downloading webpage"
+if [ "$format" = "22" ]; then
+	echo "[info] Fake: Downloading 1 format(s): 22"
+	echo "[download] Destination: $output.mp4"
+	echo "[progress] 1048576 1048576 NA 0"
+	exit 0
+fi
+echo "[info] Fake: Downloading 1 format(s): 137+140"
+echo "[download] Destination: /tmp/output.f137.mp4"
+echo "[progress] 1048576 4194304 524288.5 6"
+echo "[progress] 4194304 4194304 NA 0"
+echo "[download] Destination: /tmp/output.f140.m4a"
+echo "[progress] 1048576 NA NA NA"
+echo "[Merger] Merging formats into \"/tmp/output.mp4\""
+`
+
+func writeFakeDownloaderForTest(t *testing.T, name string, script string) string {
+	dir, err := ioutil.TempDir("", "youtube-dl-queue-bin-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+type downloaderForTest struct {
+	downloader Downloader
+	version    string
+	// progress of the video format when it is downloaded
+	videoBytes int64
+	// progress of the audio format, whose size yt-dlp does not know
+	audioPercent float64
+	failure      FailureReason
+}
+
+func downloadersForTest(t *testing.T) []downloaderForTest {
+	return []downloaderForTest{
+		{
+			downloader:   NewYoutubeDl(writeFakeDownloaderForTest(t, "youtube-dl", fakeYoutubeDlScript)),
+			version:      "2021.12.17",
+			videoBytes:   4 << 20,
+			audioPercent: 100,
+			failure:      ReasonUnavailable,
+		},
+		{
+			downloader:   NewYtDlp(writeFakeDownloaderForTest(t, "yt-dlp", fakeYtDlpScript)),
+			version:      "2023.07.06",
+			videoBytes:   4 << 20,
+			audioPercent: 0,
+			failure:      ReasonRateLimited,
+		},
+	}
+}
+
+func newQueueForTest(t *testing.T, d Downloader) *Queue {
+	logDir, err := ioutil.TempDir("", "youtube-dl-queue-log-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q, err := New(Options{
+		Store:        NewMemoryStore(),
+		Downloader:   d,
+		LogDirectory: logDir,
+		RetryPolicy:  &RetryPolicy{MaxAttempts: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return q
+}
+
+func TestDownloaderArgs(t *testing.T) {
+	task := Task{
+		VideoFormat: "137",
+		AudioFormat: "140",
+		Url:         "https://www.youtube.com/watch?v=DownloaderArgs",
+		OutputPath:  "/tmp/output",
+		Parameters:  Parameters{"--no-mtime", "--sub-lang", "en"},
+	}
+
+	for _, d := range downloadersForTest(t) {
+		args := strings.Join(d.downloader.Args(task, "/usr/bin/ffmpeg"), " ")
+
+		if !strings.Contains(args, "--ffmpeg-location /usr/bin/ffmpeg -f 137+140 -o /tmp/output --no-mtime --sub-lang en https://www.youtube.com/watch?v=DownloaderArgs") {
+			t.Fatalf("%s: different args! %s", d.downloader.Name(), args)
+		}
+
+		if strings.Contains(args, "--progress-template") != (d.downloader.Name() == YtDlp) {
+			t.Fatalf("%s: different progress args! %s", d.downloader.Name(), args)
+		}
+
+		// youtube-dl tells the formats of a single file only in its info JSON
+		if strings.Contains(args, "--write-info-json") != (d.downloader.Name() == YoutubeDl) {
+			t.Fatalf("%s: different info JSON args! %s", d.downloader.Name(), args)
+		}
+	}
+
+	for _, format := range []Task{
+		{Format: "bestvideo[height<=1080]+bestaudio/best"},
+		{AudioFormat: "140"},
+	} {
+		args := NewYoutubeDl("youtube-dl").Args(format, "/usr/bin/ffmpeg")
+		if strings.Join(args[3:5], " ") != "-f "+format.FormatSpec() {
+			t.Fatalf("different format args! %s", args)
+		}
+	}
+}
+
+func TestDownloaderVersion(t *testing.T) {
+	for _, d := range downloadersForTest(t) {
+		version, err := d.downloader.Version(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if version != d.version {
+			t.Fatalf("%s: different version! %s", d.downloader.Name(), version)
+		}
+	}
+
+	if _, err := NewYtDlp("/nonexistent/yt-dlp").Version(context.Background()); err == nil {
+		t.Fatalf("missing executable has a version!")
+	}
+}
+
+func TestDownloaderConformance(t *testing.T) {
+	defaultInterval := progressEventInterval
+	progressEventInterval = 0
+	defer func() { progressEventInterval = defaultInterval }()
+
+	for _, d := range downloadersForTest(t) {
+		name := d.downloader.Name()
+		q := newQueueForTest(t, d.downloader)
+		s := q.Subscribe(256)
+
+		for _, url := range []string{
+			"https://www.youtube.com/watch?v=Conformance",
+			"https://www.youtube.com/watch?v=Conformancefail",
+		} {
+			task := Task{VideoFormat: "137", AudioFormat: "140", Url: url, OutputPath: "/tmp/output"}
+			if err := q.QueueTask(&task); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		tasks, err := q.popTasks("0", 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, task := range tasks {
+			if err := q.runTask(context.Background(), task); err != nil {
+				t.Fatal(err)
+			}
+		}
+		s.Unsubscribe()
+
+		phases := []ProgressPhase{}
+		var videoProgress, audioProgress Progress
+		var finished, failed *Event
+		for event := range s.C {
+			event := event
+			switch event.Type {
+			case EventProgress:
+				if len(phases) == 0 || phases[len(phases)-1] != event.Progress.Phase {
+					phases = append(phases, event.Progress.Phase)
+				}
+				if event.Progress.Phase == PhaseDownloadVideo {
+					videoProgress = *event.Progress
+				}
+				if event.Progress.Phase == PhaseDownloadAudio {
+					audioProgress = *event.Progress
+				}
+			case EventFinished:
+				finished = &event
+			case EventFailed:
+				failed = &event
+			}
+		}
+
+		if fmt.Sprint(phases) != "[download_video download_audio merging]" {
+			t.Fatalf("%s: different phases! %v", name, phases)
+		}
+
+		if videoProgress.DownloadedBytes != d.videoBytes || videoProgress.TotalBytes != d.videoBytes || videoProgress.Percent != 100 {
+			t.Fatalf("%s: different video progress! %+v", name, videoProgress)
+		}
+
+		if audioProgress.Percent != d.audioPercent {
+			t.Fatalf("%s: different audio progress! %+v", name, audioProgress)
+		}
+
+		if finished == nil || finished.OutputFile != "/tmp/output.mp4" || strings.Join(finished.FormatIds, "+") != "137+140" {
+			t.Fatalf("%s: different finished event! %+v", name, finished)
+		}
+
+		if failed == nil || failed.FailedTask.Reason != d.failure || failed.FailedTask.ExitCode != 1 {
+			t.Fatalf("%s: different failed event! %+v", name, failed)
+		}
+	}
+}
+
+func TestFinishedTaskFormatIds(t *testing.T) {
+	for _, d := range downloadersForTest(t) {
+		name := d.downloader.Name()
+		q := newQueueForTest(t, d.downloader)
+
+		dir, err := ioutil.TempDir("", "youtube-dl-queue-output-")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, parameters := range []Parameters{{}, {"--write-info-json"}} {
+			output := filepath.Join(dir, fmt.Sprintf("output%d", len(parameters)))
+			task := Task{Format: "22", Url: "https://www.youtube.com/watch?v=FinishedFormatIds", OutputPath: output, Parameters: parameters}
+			if err := q.QueueTask(&task); err != nil {
+				t.Fatal(err)
+			}
+
+			tasks, err := q.popTasks("0", 1)
+			if err != nil || len(tasks) != 1 {
+				t.Fatalf("%s: different popped tasks! %+v %v", name, tasks, err)
+			}
+
+			if err := q.runTask(context.Background(), tasks[0]); err != nil {
+				t.Fatal(err)
+			}
+
+			finishedTask, err := q.GetFinishedTask(task.Id)
+			if err != nil {
+				t.Fatalf("%s: %s", name, err)
+			}
+
+			if finishedTask.OutputFile != output+".mp4" || strings.Join(finishedTask.FormatIds, "+") != "22" {
+				t.Fatalf("%s: different finished task! %+v", name, finishedTask)
+			}
+
+			// the info JSON written for the format ids is kept only when asked for
+			_, err = ioutil.ReadFile(output + ".info.json")
+			if keep := name == YoutubeDl && len(parameters) > 0; (err == nil) != keep {
+				t.Fatalf("%s: different info JSON! keep: %v %v", name, keep, err)
+			}
+		}
+	}
+}
+
+func TestTaskSelectsDownloader(t *testing.T) {
+	downloaders := downloadersForTest(t)
+	youtubeDl, ytDlp := downloaders[0].downloader, downloaders[1].downloader
+
+	q := newQueueForTest(t, youtubeDl)
+	q.AddDownloader(ytDlp)
+
+	unknown := Task{VideoFormat: "137", AudioFormat: "140", Url: "https://www.youtube.com/watch?v=SelectsUnknown", Downloader: "aria2c"}
+	if err := q.QueueTask(&unknown); err != ErrUnknownDownloader {
+		t.Fatalf("expected unknown downloader error, got %v", err)
+	}
+
+	for _, downloader := range []string{"", YtDlp} {
+		task := Task{VideoFormat: "137", AudioFormat: "140", Url: "https://www.youtube.com/watch?v=Selects" + downloader, OutputPath: "/tmp/output", Downloader: downloader}
+		if err := q.QueueTask(&task); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := q.Exec(context.Background(), &task); err != nil {
+			t.Fatalf("%q: %s", downloader, err)
+		}
+
+		log, err := ioutil.ReadFile(q.LogPath(task.Id))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// only yt-dlp prints the progress template
+		if strings.Contains(string(log), "[progress]") != (downloader == YtDlp) {
+			t.Fatalf("%q: run by a different downloader! %s", downloader, log)
+		}
+	}
+
+	// a queue without downloaders queues tasks for other processes
+	other, err := New(Options{Store: NewMemoryStore()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := other.QueueTask(&unknown); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := other.Start(context.Background()); err == nil {
+		t.Fatalf("started without a downloader!")
+	}
+}
@@ -0,0 +1,111 @@
+package queue
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// EventType is the kind of change an Event reports.
+type EventType string
+
+const (
+	EventQueued   EventType = "queued"
+	EventStarted  EventType = "started"
+	EventProgress EventType = "progress"
+	EventFinished EventType = "finished"
+	EventFailed   EventType = "failed"
+	EventRequeued EventType = "requeued"
+)
+
+var (
+	// minimum interval between progress events of one task
+	progressEventInterval = time.Second
+)
+
+// Event is a state change of a task.
+// FailedTask is set for failed events and Progress for progress events.
+// OutputFile is the file youtube-dl reported for finished and failed events,
+// and FormatIds the ids of the formats it reported downloading,
+// empty when it reported none.
+type Event struct {
+	Type       EventType   `json:"type"`
+	Task       Task        `json:"task"`
+	FailedTask *FailedTask `json:"failed_task,omitempty"`
+	Progress   *Progress   `json:"progress,omitempty"`
+	OutputFile string      `json:"output_file,omitempty"`
+	FormatIds  FormatIds   `json:"format_ids,omitempty"`
+	At         int64       `json:"at"`
+}
+
+// Subscription receives events on C. Delivery never blocks the queue:
+// events which do not fit in the buffer of C are dropped and counted.
+type Subscription struct {
+	C       <-chan Event
+	events  chan Event
+	dropped uint64
+	queue   *Queue
+}
+
+// Subscribe registers a subscription to the default queue
+// whose channel buffers up to buffer events.
+func Subscribe(buffer int) *Subscription {
+	return defaultQueue.Subscribe(buffer)
+}
+
+func (q *Queue) Subscribe(buffer int) *Subscription {
+	events := make(chan Event, buffer)
+	s := &Subscription{
+		C:      events,
+		events: events,
+		queue:  q,
+	}
+
+	q.subscriptionsMutex.Lock()
+	q.subscriptions[s] = struct{}{}
+	q.subscriptionsMutex.Unlock()
+
+	return s
+}
+
+// Unsubscribe stops delivery and closes C.
+func (s *Subscription) Unsubscribe() {
+	q := s.queue
+
+	q.subscriptionsMutex.Lock()
+	defer q.subscriptionsMutex.Unlock()
+
+	if _, ok := q.subscriptions[s]; ok {
+		delete(q.subscriptions, s)
+		close(s.events)
+	}
+}
+
+// Dropped returns how many events were dropped because C was full.
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// publish sends event to the subscriptions, and keeps finished and failed
+// events in the webhook outbox, which does not drop them.
+func (q *Queue) publish(event Event) {
+	if event.At == 0 {
+		event.At = time.Now().Unix()
+	}
+
+	q.webhookOutbox.push(event)
+
+	q.subscriptionsMutex.RLock()
+	defer q.subscriptionsMutex.RUnlock()
+
+	for s := range q.subscriptions {
+		select {
+		case s.events <- event:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	}
+}
+
+func (q *Queue) publishTask(eventType EventType, t Task) {
+	q.publish(Event{Type: eventType, Task: t})
+}
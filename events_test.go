@@ -0,0 +1,179 @@
+package queue
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func receiveEventForTest(t *testing.T, s *Subscription) Event {
+	select {
+	case event := <-s.C:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatalf("event is not received.")
+	}
+
+	return Event{}
+}
+
+func TestSubscribe(t *testing.T) {
+	InitializeForTest(t)
+
+	s := Subscribe(10)
+
+	task := Task{
+		VideoFormat: "135",
+		AudioFormat: "140",
+		Url:         "https://www.youtube.com/watch?v=Subscribe",
+		Title:       "TestSubscribe",
+		OutputPath:  "/tmp/output",
+	}
+	if err := task.QueueTask(); err != nil {
+		t.Fatal(err)
+	}
+
+	event := receiveEventForTest(t, s)
+	if event.Type != EventQueued || event.Task.Id != task.Id || event.Task.VideoId != "Subscribe" || event.At == 0 {
+		t.Fatalf("different event! %+v", event)
+	}
+
+	s.Unsubscribe()
+	s.Unsubscribe()
+
+	if _, ok := <-s.C; ok {
+		t.Fatalf("channel is not closed!")
+	}
+}
+
+func TestTaskLifecycleEvents(t *testing.T) {
+	InitializeForTest(t)
+
+	defaultQueue.SetDownloader(NewYoutubeDl(writeStubDownloaderForTest(t)))
+
+	defaultRetryPolicy := GetRetryPolicy()
+	SetRetryPolicy(RetryPolicy{MaxAttempts: 1})
+	defer SetRetryPolicy(defaultRetryPolicy)
+
+	s := Subscribe(100)
+	defer s.Unsubscribe()
+
+	for _, url := range []string{
+		"https://www.youtube.com/watch?v=LifecycleEvents",
+		"https://www.youtube.com/watch?v=LifecycleEventsfail",
+	} {
+		insertTaskForTest(t, Task{
+			VideoFormat: "135",
+			AudioFormat: "140",
+			Url:         url,
+			Title:       "TestTaskLifecycleEvents",
+			OutputPath:  "/tmp/output",
+		})
+
+		tasks, err := defaultQueue.popTasks("0", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := defaultQueue.runTask(context.Background(), tasks[0]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	failedTasks, err := GetAllFailedTasks()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := failedTasks[0].RequeueTask(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []EventType{EventStarted, EventProgress, EventFinished, EventStarted, EventFailed, EventRequeued}
+	for _, eventType := range expected {
+		event := receiveEventForTest(t, s)
+		if event.Type != eventType {
+			t.Fatalf("expected %s, got %s", eventType, event.Type)
+		}
+
+		switch event.Type {
+		case EventProgress:
+			if event.Progress == nil || event.Progress.Percent != 100 {
+				t.Fatalf("different progress! %+v", event.Progress)
+			}
+		case EventFailed:
+			if event.FailedTask == nil || event.FailedTask.VideoId != "LifecycleEventsfail" {
+				t.Fatalf("different failed task! %+v", event.FailedTask)
+			}
+		}
+	}
+}
+
+func TestSlowSubscriberDoesNotStall(t *testing.T) {
+	InitializeForTest(t)
+
+	defaultQueue.SetDownloader(NewYoutubeDl(writeStubDownloaderForTest(t)))
+
+	// never received
+	slow := Subscribe(1)
+	defer slow.Unsubscribe()
+
+	fast := Subscribe(1000)
+	defer fast.Unsubscribe()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		for i := 1; i <= 10; i++ {
+			task := Task{
+				VideoFormat: "135",
+				AudioFormat: "140",
+				Url:         "https://www.youtube.com/watch?v=SlowSubscriber" + strconv.Itoa(i),
+				Title:       "TestSlowSubscriberDoesNotStall",
+				OutputPath:  "/tmp/output",
+			}
+			if err := task.QueueTask(); err != nil {
+				t.Error(err)
+				return
+			}
+
+			tasks, err := defaultQueue.popTasks("0", 1)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			if err := defaultQueue.runTask(context.Background(), tasks[0]); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("downloads are stalled by a slow subscriber!")
+	}
+
+	if slow.Dropped() == 0 {
+		t.Fatalf("events are not dropped for the slow subscriber!")
+	}
+
+	if fast.Dropped() != 0 {
+		t.Fatalf("events are dropped for the fast subscriber!")
+	}
+
+	finished := 0
+	for len(fast.C) > 0 {
+		if event := <-fast.C; event.Type == EventFinished {
+			finished += 1
+		}
+	}
+
+	if finished != 10 {
+		t.Fatalf("different finished events size! %d", finished)
+	}
+}
@@ -6,121 +6,121 @@ import (
 )
 
 type FailedTask struct {
-	Id          string `json:"id"`
-	VideoFormat string `json:"video_format"`
-	AudioFormat string `json:"audio_format"`
-	Url         string `json:"url"`
-	Title       string `json:"title"`
-	OutputPath  string `json:"output_path"`
-	Parameter   string `json:"parameter"`
-	CreatedAt   int64  `json:"created_at"`
-	UpdatedAt   int64  `json:"updated_at"`
-	StartedAt   int64  `json:"started_at"`
-	FailedAt    int64  `json:"failed_at"`
+	Id          int64           `json:"id"`
+	VideoId     string          `json:"video_id"`
+	VideoFormat string          `json:"video_format"`
+	AudioFormat string          `json:"audio_format"`
+	Url         string          `json:"url"`
+	Title       string          `json:"title"`
+	OutputPath  string          `json:"output_path"`
+	Parameters  Parameters      `json:"parameters"`
+	CreatedAt   int64           `json:"created_at"`
+	UpdatedAt   int64           `json:"updated_at"`
+	StartedAt   int64           `json:"started_at"`
+	FailedAt    int64           `json:"failed_at"`
+	ExitCode    int             `json:"exit_code"`
+	LogPath     string          `json:"log_path"`
+	Reason      FailureReason   `json:"reason"`
+	LogTail     string          `json:"log_tail"`
+	Attempts    int             `json:"attempts"`
+	Downloader  string          `json:"downloader"`
+	Options     DownloadOptions `json:"options"`
+	Format      string          `json:"format"`
+	FormatIds   FormatIds       `json:"format_ids"`
 }
 
 func (ft FailedTask) String() string {
 	return fmt.Sprintf(
-		"Id: %s\tVideoFormat:%s\tAudioFormat:%s\tUrl:%s\tTitle:%s\tOutputPath:%s\tParameter:%s",
+		"Id: %d\tVideoId:%s\tVideoFormat:%s\tAudioFormat:%s\tUrl:%s\tTitle:%s\tOutputPath:%s\tParameters:%s\tReason:%s\tExitCode:%d",
 		ft.Id,
+		ft.VideoId,
 		ft.VideoFormat,
 		ft.AudioFormat,
 		ft.Url,
 		ft.Title,
 		ft.OutputPath,
-		ft.Parameter,
+		ft.Parameters,
+		ft.Reason,
+		ft.ExitCode,
 	)
 }
 
 func (ft *FailedTask) AddTask() error {
-	stmt, err := createSqlStmt(`INSERT INTO failed_tasks (id, video_format, audio_format, url, title, output_path, parameter, created_at, updated_at, started_at, failed_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
-	if err != nil {
-		return err
-	}
+	return defaultQueue.AddFailedTask(ft)
+}
 
+// AddFailedTask inserts ft into the failed tasks as failed now.
+func (q *Queue) AddFailedTask(ft *FailedTask) error {
 	ft.FailedAt = time.Now().Unix()
 
-	_, err = stmt.Exec(
-		ft.Id,
-		ft.VideoFormat,
-		ft.AudioFormat,
-		ft.OutputPath,
-		ft.Url,
-		ft.Title,
-		ft.Parameter,
-		ft.CreatedAt,
-		ft.UpdatedAt,
-		ft.StartedAt,
-		ft.FailedAt,
-	)
-
-	return err
+	return q.store.AddFailed(*ft)
 }
 
+// RequeueTask moves the failed task back into tasks under the same job id.
 func (ft *FailedTask) RequeueTask() (task Task, err error) {
+	return defaultQueue.RequeueTask(*ft)
+}
+
+func (q *Queue) RequeueTask(ft FailedTask) (task Task, err error) {
+	if err = ft.Parameters.validate(); err != nil {
+		return task, err
+	}
+
 	task = Task{
 		Id:          ft.Id,
+		VideoId:     ft.VideoId,
 		VideoFormat: ft.VideoFormat,
 		AudioFormat: ft.AudioFormat,
 		Url:         ft.Url,
 		Title:       ft.Title,
 		OutputPath:  ft.OutputPath,
-		Parameter:   ft.Parameter,
+		Parameters:  ft.Parameters,
 		CreatedAt:   ft.CreatedAt,
 		UpdatedAt:   ft.UpdatedAt,
-		StartedAt:   ft.StartedAt,
+		Downloader:  ft.Downloader,
+		Options:     ft.Options,
+		Format:      ft.Format,
 	}
 
-	err = task.AddTask()
-
-	if err != nil {
+	if err = q.store.Requeue(&task); err != nil {
 		return task, err
 	}
 
-	stmt, err := createSqlStmt(`DELETE FROM failed_tasks WHERE id = ?`)
-	if err != nil {
-		return task, err
-	}
+	q.publishTask(EventRequeued, task)
+	q.wakeWorkers()
 
-	_, err = stmt.Exec(ft.Id)
+	return task, nil
+}
 
-	return task, err
+func (ft *FailedTask) RemoveFailedTask() error {
+	return defaultQueue.RemoveFailedTask(ft.Id)
 }
 
-func GetAllFailedTasks() (failedTasks []FailedTask, err error) {
-	stmt, err := createSqlStmt(`SELECT * FROM failed_tasks ORDER BY id DESC`)
-	if err != nil {
-		return failedTasks, err
-	}
+func (q *Queue) RemoveFailedTask(id int64) error {
+	return q.store.RemoveFailed(id)
+}
 
-	rows, err := stmt.Query()
-	if err != nil {
-		return failedTasks, err
-	}
+// GetFailedTask returns ErrTaskNotFound when no failed task has the job id.
+func GetFailedTask(id int64) (failedTask FailedTask, err error) {
+	return defaultQueue.GetFailedTask(id)
+}
 
-	failedTasks = []FailedTask{}
-
-	defer rows.Close()
-	for rows.Next() {
-		failedTask := FailedTask{}
-		err = rows.Scan(
-			&failedTask.Id,
-			&failedTask.VideoFormat,
-			&failedTask.AudioFormat,
-			&failedTask.Url,
-			&failedTask.Title,
-			&failedTask.OutputPath,
-			&failedTask.Parameter,
-			&failedTask.CreatedAt,
-			&failedTask.UpdatedAt,
-			&failedTask.StartedAt,
-			&failedTask.FailedAt,
-		)
-		if err != nil {
-			return []FailedTask{}, err
-		}
-		failedTasks = append(failedTasks, failedTask)
-	}
+func (q *Queue) GetFailedTask(id int64) (failedTask FailedTask, err error) {
+	return q.store.GetFailed(id)
+}
+
+func GetFailedTasksByVideoId(videoId string) (failedTasks []FailedTask, err error) {
+	return defaultQueue.GetFailedTasksByVideoId(videoId)
+}
+
+func (q *Queue) GetFailedTasksByVideoId(videoId string) (failedTasks []FailedTask, err error) {
+	return q.store.ListFailedByVideoId(videoId)
+}
+
+func GetAllFailedTasks() (failedTasks []FailedTask, err error) {
+	return defaultQueue.GetAllFailedTasks()
+}
 
-	return failedTasks, err
+func (q *Queue) GetAllFailedTasks() (failedTasks []FailedTask, err error) {
+	return q.store.ListFailed()
 }
@@ -9,14 +9,15 @@ import (
 
 func insertFailedTaskForTest(t *testing.T, failedTask FailedTask) {
 	if _, err := db.Exec(
-		`INSERT INTO failed_tasks (id, url, title, video_format, audio_format, output_path, parameter, created_at, updated_at, started_at, failed_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		`INSERT INTO failed_tasks (id, video_id, url, title, video_format, audio_format, output_path, parameter, created_at, updated_at, started_at, failed_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
 		&failedTask.Id,
+		&failedTask.VideoId,
 		&failedTask.Url,
 		&failedTask.Title,
 		&failedTask.VideoFormat,
 		&failedTask.AudioFormat,
 		&failedTask.OutputPath,
-		&failedTask.Parameter,
+		&failedTask.Parameters,
 		&failedTask.CreatedAt,
 		&failedTask.UpdatedAt,
 		&failedTask.StartedAt,
@@ -29,8 +30,9 @@ func insertFailedTaskForTest(t *testing.T, failedTask FailedTask) {
 func getFailedTaskForTest(t *testing.T) FailedTask {
 	failedTask := FailedTask{}
 
-	if err := db.QueryRow(`SELECT id, video_format, audio_format, title, created_at, updated_at FROM failed_tasks ORDER BY id DESC LIMIT 1`).Scan(
+	if err := db.QueryRow(`SELECT id, video_id, video_format, audio_format, title, created_at, updated_at FROM failed_tasks ORDER BY id DESC LIMIT 1`).Scan(
 		&failedTask.Id,
+		&failedTask.VideoId,
 		&failedTask.VideoFormat,
 		&failedTask.AudioFormat,
 		&failedTask.Title,
@@ -47,13 +49,14 @@ func TestRequeueTask(t *testing.T) {
 	InitializeForTest(t)
 
 	insertFailedTaskForTest(t, FailedTask{
-		Id:          "RequeueTask",
+		Id:          1,
+		VideoId:     "RequeueTask",
 		VideoFormat: "135",
 		AudioFormat: "140",
 		Url:         "https://www.youtube.com/watch?v=RequeueTask",
 		Title:       "TestRequeueTask",
 		OutputPath:  "/tmp/output",
-		Parameter:   "",
+		Parameters:  nil,
 		CreatedAt:   0,
 		UpdatedAt:   0,
 		StartedAt:   0,
@@ -67,7 +70,7 @@ func TestRequeueTask(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if task.Title != failedTask.Title {
+	if task.Title != failedTask.Title || task.Id != failedTask.Id || task.VideoId != failedTask.VideoId {
 		t.Fatalf("failed insert task!")
 	}
 
@@ -78,18 +81,53 @@ func TestRequeueTask(t *testing.T) {
 	}
 }
 
+func TestRequeueTaskFormatVariants(t *testing.T) {
+	InitializeForTest(t)
+
+	for i, videoFormat := range []string{"137", "136"} {
+		insertFailedTaskForTest(t, FailedTask{
+			Id:          int64(i + 1),
+			VideoId:     "RequeueTaskFormatVariants",
+			VideoFormat: videoFormat,
+			AudioFormat: "140",
+			Url:         "https://www.youtube.com/watch?v=RequeueTaskFormatVariants",
+			Title:       "TestRequeueTaskFormatVariants",
+			OutputPath:  "/tmp/output",
+		})
+	}
+
+	failedTasks, err := GetFailedTasksByVideoId("RequeueTaskFormatVariants")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	task, err := failedTasks[0].RequeueTask()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if task.Id != failedTasks[0].Id || task.VideoFormat != failedTasks[0].VideoFormat {
+		t.Fatalf("different task! %s", task)
+	}
+
+	if failedTasks, _ = GetFailedTasksByVideoId("RequeueTaskFormatVariants"); len(failedTasks) != 1 || failedTasks[0].Id == task.Id {
+		t.Fatalf("different failed tasks! %+v", failedTasks)
+	}
+}
+
 func TestGetAllFailedTasks(t *testing.T) {
 	InitializeForTest(t)
 
 	for i := 1; i <= 3; i++ {
 		insertFailedTaskForTest(t, FailedTask{
-			Id:          "GetAllFailedTasks" + strconv.Itoa(i),
+			Id:          int64(i),
+			VideoId:     "GetAllFailedTasks" + strconv.Itoa(i),
 			VideoFormat: "135",
 			AudioFormat: "140",
 			Url:         "https://www.youtube.com/watch?v=GetAllFailedTasks" + strconv.Itoa(i),
 			Title:       "TestGetAllFailedTasks" + strconv.Itoa(i),
 			OutputPath:  "/tmp/output",
-			Parameter:   "",
+			Parameters:  nil,
 			CreatedAt:   0,
 			UpdatedAt:   0,
 			StartedAt:   0,
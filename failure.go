@@ -0,0 +1,191 @@
+package queue
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// FailureReason classifies why youtube-dl failed.
+type FailureReason string
+
+const (
+	ReasonUnknown            FailureReason = "unknown"
+	ReasonUnavailable        FailureReason = "unavailable"
+	ReasonGeoBlocked         FailureReason = "geo_blocked"
+	ReasonFormatNotAvailable FailureReason = "format_not_available"
+	ReasonRateLimited        FailureReason = "rate_limited"
+	ReasonNetwork            FailureReason = "network"
+	ReasonFFmpeg             FailureReason = "ffmpeg_error"
+	ReasonKilled             FailureReason = "killed"
+	// the parameters of a task queued before they were validated
+	ReasonInvalidParameters FailureReason = "invalid_parameters"
+)
+
+var (
+	// lines of the task log kept in failed_tasks
+	logTailLines = 20
+	// bytes read from the end of the task log to find the tail
+	logTailBytes int64 = 64 * 1024
+)
+
+// Transient reports whether the failure may pass when the task is tried again,
+// unlike a video which is unavailable, geo blocked or lacks the format.
+func (r FailureReason) Transient() bool {
+	switch r {
+	case ReasonUnavailable, ReasonGeoBlocked, ReasonFormatNotAvailable, ReasonInvalidParameters:
+		return false
+	default:
+		return true
+	}
+}
+
+type failurePattern struct {
+	reason   FailureReason
+	patterns []string
+}
+
+// failurePatterns are matched in order against lower-cased output,
+// so that more specific messages win ("Video unavailable. ... in your country").
+var failurePatterns = []failurePattern{
+	{ReasonGeoBlocked, []string{
+		"not made this video available in your country",
+		"not available in your country",
+		"blocked it in your country",
+		"geo restrict",
+		"geo-restrict",
+	}},
+	{ReasonFormatNotAvailable, []string{
+		"requested format not available",
+		"requested format is not available",
+	}},
+	{ReasonRateLimited, []string{
+		"http error 429",
+		"too many requests",
+	}},
+	{ReasonUnavailable, []string{
+		"video unavailable",
+		"this video is unavailable",
+		"this video is no longer available",
+		"private video",
+		"has been removed",
+		"has been terminated",
+		"http error 404",
+		"this live event will begin",
+		"sign in to confirm your age",
+	}},
+	{ReasonFFmpeg, []string{
+		"ffmpeg",
+		"ffprobe",
+		"avconv",
+		"postprocessing",
+		"conversion failed",
+	}},
+	{ReasonNetwork, []string{
+		"urlopen error",
+		"connection reset",
+		"connection refused",
+		"timed out",
+		"name or service not known",
+		"temporary failure in name resolution",
+		"network is unreachable",
+		"unable to download webpage",
+		"unable to download video data",
+		"did not get any data blocks",
+		"giving up after",
+		"remote end closed connection",
+		"incompleteread",
+		"http error 5",
+		"ssl",
+	}},
+}
+
+// ClassifyFailure derives a FailureReason from the youtube-dl output and the
+// error returned by running it. Only ERROR lines are matched, since progress,
+// warnings and ffmpeg lines of a run mention failures which did not happen.
+func ClassifyFailure(output string, cause error) FailureReason {
+	return classifyFailure(output, cause, failurePatterns)
+}
+
+func classifyFailure(output string, cause error, patterns []failurePattern) FailureReason {
+	if exitErr, ok := cause.(*exec.ExitError); ok && exitErr.ExitCode() == -1 {
+		// terminated by a signal
+		return ReasonKilled
+	}
+
+	errorLines := []string{}
+	for _, line := range strings.Split(output, "\n") {
+		if strings.Contains(line, "ERROR:") {
+			errorLines = append(errorLines, line)
+		}
+	}
+
+	return matchFailure(strings.Join(errorLines, "\n"), patterns)
+}
+
+func matchFailure(output string, patterns []failurePattern) FailureReason {
+	output = strings.ToLower(output)
+	if output == "" {
+		return ReasonUnknown
+	}
+
+	for _, failurePattern := range patterns {
+		for _, pattern := range failurePattern.patterns {
+			if strings.Contains(output, pattern) {
+				return failurePattern.reason
+			}
+		}
+	}
+
+	return ReasonUnknown
+}
+
+// readLogTail returns the last lines written into the log file at path
+// from the offset from, which is where the current attempt started.
+// Progress lines separated by carriage returns count as lines.
+func readLogTail(path string, from int64, lines int) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	offset := info.Size() - logTailBytes
+	if offset < from {
+		offset = from
+	}
+
+	if _, err = file.Seek(offset, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	b, err := ioutil.ReadAll(file)
+	if err != nil {
+		return "", err
+	}
+
+	tail := []string{}
+	for _, line := range strings.Split(strings.Replace(string(b), "\r", "\n", -1), "\n") {
+		if strings.TrimSpace(line) != "" {
+			tail = append(tail, line)
+		}
+	}
+
+	// the first line may be cut in the middle
+	if offset > from && len(tail) > 0 {
+		tail = tail[1:]
+	}
+
+	if len(tail) > lines {
+		tail = tail[len(tail)-lines:]
+	}
+
+	return strings.Join(tail, "\n"), nil
+}
@@ -0,0 +1,147 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestClassifyFailure(t *testing.T) {
+	tests := []struct {
+		output string
+		reason FailureReason
+	}{
+		{"ERROR: Video unavailable", ReasonUnavailable},
+		{"ERROR: This video is unavailable.", ReasonUnavailable},
+		{"ERROR: Private video\nSign in if you've been granted access to this video", ReasonUnavailable},
+		{"ERROR: This video has been removed by the user", ReasonUnavailable},
+		{"ERROR: This video is no longer available because the YouTube account associated with this video has been terminated.", ReasonUnavailable},
+		{"ERROR: This live event will begin in 3 hours.", ReasonUnavailable},
+		{"ERROR: The uploader has not made this video available in your country.", ReasonGeoBlocked},
+		{"ERROR: Video unavailable. The uploader has not made this video available in your country.", ReasonGeoBlocked},
+		{"ERROR: This video is not available in your country due to a legal complaint.", ReasonGeoBlocked},
+		{"ERROR: requested format not available", ReasonFormatNotAvailable},
+		{"[youtube] abcdefg: Downloading webpage\nERROR: requested format not available", ReasonFormatNotAvailable},
+		{"ERROR: unable to download video data: HTTP Error 429: Too Many Requests", ReasonRateLimited},
+		{"ERROR: Unable to download webpage: HTTP Error 429: Too Many Requests (caused by HTTPError()); please report this issue on https://yt-dl.org/bug .", ReasonRateLimited},
+		{"ERROR: Unable to download webpage: <urlopen error [Errno -2] Name or service not known> (caused by URLError(gaierror(-2, 'Name or service not known')))", ReasonNetwork},
+		{"ERROR: unable to download video data: <urlopen error [Errno 110] Connection timed out>", ReasonNetwork},
+		{"ERROR: Did not get any data blocks", ReasonNetwork},
+		{"ERROR: Giving up after 10 fragment retries", ReasonNetwork},
+		{"ERROR: unable to download video data: HTTP Error 503: Service Unavailable", ReasonNetwork},
+		{"ERROR: [Errno 104] Connection reset by peer", ReasonNetwork},
+		{"ERROR: ffprobe/avprobe and ffmpeg/avconv not found. Please install one.", ReasonFFmpeg},
+		{"ERROR: Postprocessing: Conversion failed!", ReasonFFmpeg},
+		{"[ffmpeg] Merging formats into \"output.mp4\"\nERROR: Conversion failed!", ReasonFFmpeg},
+		// only ERROR lines are matched
+		{"[ffmpeg] Merging formats into \"output.mp4\"\nERROR: Did not get any data blocks", ReasonNetwork},
+		{"[ffmpeg] Merging formats into \"output.mp4\"", ReasonUnknown},
+		{"[download] Destination: SSL Tutorial.mp4\nERROR: something new happened", ReasonUnknown},
+		{"WARNING: unable to download video data: HTTP Error 500: Internal Server Error", ReasonUnknown},
+		{"ERROR: something new happened", ReasonUnknown},
+		{"", ReasonUnknown},
+	}
+
+	for _, test := range tests {
+		if reason := ClassifyFailure(test.output, errors.New("exit status 1")); reason != test.reason {
+			t.Errorf("%q: expected %s, got %s", test.output, test.reason, reason)
+		}
+	}
+}
+
+func TestClassifyFailureKilled(t *testing.T) {
+	command := exec.Command("sleep", "10")
+	if err := command.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	command.Process.Kill()
+	err := command.Wait()
+
+	if reason := ClassifyFailure("[download]  42.3% of 120.5MiB", err); reason != ReasonKilled {
+		t.Fatalf("expected %s, got %s", ReasonKilled, reason)
+	}
+}
+
+func TestReadLogTail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "youtube-dl-queue-log-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := []string{}
+	for i := 1; i <= 30; i++ {
+		lines = append(lines, "line"+strconv.Itoa(i))
+	}
+
+	path := filepath.Join(dir, "tail.log")
+	content := strings.Join(lines, "\n") + "\n[download]  10.0%\r[download] 100.0%\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	tail, err := readLogTail(path, 0, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tail != "line30\n[download]  10.0%\n[download] 100.0%" {
+		t.Fatalf("different tail! %q", tail)
+	}
+
+	// from the start of the last attempt, after line29
+	from := int64(strings.Index(content, "line30"))
+	if tail, err = readLogTail(path, from, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	if tail != "line30\n[download]  10.0%\n[download] 100.0%" {
+		t.Fatalf("different tail from %d! %q", from, tail)
+	}
+}
+
+func TestAddFailedTaskRecordsFailure(t *testing.T) {
+	InitializeForTest(t)
+
+	defaultQueue.SetDownloader(NewYoutubeDl(writeStubDownloaderForTest(t)))
+
+	insertTaskForTest(t, Task{
+		VideoFormat: "135",
+		AudioFormat: "140",
+		Url:         "https://www.youtube.com/watch?v=AddFailedTaskRecordsfail",
+		Title:       "TestAddFailedTaskRecordsFailure",
+		OutputPath:  "/tmp/output",
+	})
+
+	task := getTaskForTest(t)
+	task.Url = "https://www.youtube.com/watch?v=AddFailedTaskRecordsfail"
+	task.Attempts = 2
+
+	execErr := task.Exec(context.Background())
+	if execErr == nil {
+		t.Fatalf("stub did not fail!")
+	}
+
+	if _, err := task.AddFailedTask(execErr); err != nil {
+		t.Fatal(err)
+	}
+
+	failedTasks, err := GetAllFailedTasks()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failedTask := failedTasks[0]
+	if failedTask.ExitCode != 2 || failedTask.Reason != ReasonUnavailable || failedTask.Attempts != 3 {
+		t.Fatalf("different failure! %s attempts:%d", failedTask, failedTask.Attempts)
+	}
+
+	if failedTask.LogTail != "ERROR: Video unavailable" {
+		t.Fatalf("different log tail! %q", failedTask.LogTail)
+	}
+}
@@ -0,0 +1,100 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// NoFFmpeg as the ffmpeg path runs the downloaders without --ffmpeg-location.
+const NoFFmpeg = "none"
+
+// findFFmpeg resolves the ffmpeg path a queue is configured with: a path
+// is looked up as exec.LookPath does, empty looks up ffmpeg in $PATH,
+// and NoFFmpeg is no ffmpeg. It returns an empty path for no ffmpeg.
+func findFFmpeg(ctx context.Context, path string) (found string, version string, err error) {
+	switch path {
+	case NoFFmpeg:
+		return "", "", nil
+	case "":
+		if found, err = exec.LookPath("ffmpeg"); err != nil {
+			return "", "", nil
+		}
+	default:
+		if found, err = exec.LookPath(path); err != nil {
+			return "", "", err
+		}
+	}
+
+	if version, err = ffmpegVersion(ctx, found); err != nil {
+		return "", "", fmt.Errorf("%s: %s", found, err)
+	}
+
+	return found, version, nil
+}
+
+// ffmpegVersion returns the version ffmpeg -version reports, as "4.4.2".
+func ffmpegVersion(ctx context.Context, path string) (string, error) {
+	firstLine, err := commandVersion(ctx, path, "-version")
+	if err != nil {
+		return "", err
+	}
+
+	if !strings.HasPrefix(firstLine, "ffmpeg version ") {
+		return "", errors.New("reports no ffmpeg version.")
+	}
+
+	return strings.Fields(firstLine)[2], nil
+}
+
+// SetFFmpegPath makes the default queue merge formats with the ffmpeg at path,
+// see Queue.SetFFmpegPath.
+func SetFFmpegPath(path string) {
+	defaultQueue.SetFFmpegPath(path)
+}
+
+// SetFFmpegPath makes the downloaders merge formats with the ffmpeg at path,
+// the ffmpeg in $PATH when empty, or without --ffmpeg-location for NoFFmpeg.
+// Start validates it. Set it before Start.
+func (q *Queue) SetFFmpegPath(path string) {
+	q.ffmpegPath = path
+}
+
+// GetFFmpegPath returns the ffmpeg found by Start, empty for none.
+func GetFFmpegPath() string {
+	return defaultQueue.GetFFmpegPath()
+}
+
+func (q *Queue) GetFFmpegPath() string {
+	return q.ffmpeg
+}
+
+// findFFmpeg resolves the ffmpeg of the queue and logs its version.
+// An ffmpeg given by path must be found, while ffmpeg missing in $PATH is
+// left to the downloaders, which fail on tasks merging formats without it.
+func (q *Queue) findFFmpeg(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	found, version, err := findFFmpeg(ctx, q.ffmpegPath)
+	if err != nil {
+		return fmt.Errorf("ffmpeg is invalid: %s", err)
+	}
+
+	switch {
+	case found != "":
+		log.Printf("ffmpeg %s at %s", version, found)
+	case q.ffmpegPath == NoFFmpeg:
+		log.Printf("ffmpeg is disabled.")
+	default:
+		log.Printf("ffmpeg is not found in $PATH.")
+	}
+
+	q.ffmpeg = found
+
+	return nil
+}
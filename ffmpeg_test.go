@@ -0,0 +1,137 @@
+package queue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const stubFFmpegScript = `#!/bin/sh
+if [ "$1" = "-version" ]; then
+	echo "ffmpeg version 4.4.2 Copyright (c) 2000-2021 the FFmpeg developers"
+	echo "built with gcc 11"
+	exit 0
+fi
+exit 1
+`
+
+// stub downloader printing its arguments into the task log
+const argsDownloaderScript = `#!/bin/sh
+echo "$@"
+`
+
+// writeStubFFmpegForTest writes a stub ffmpeg into its own directory,
+// so that the directory can be $PATH.
+func writeStubFFmpegForTest(t *testing.T) string {
+	return writeFakeDownloaderForTest(t, "ffmpeg", stubFFmpegScript)
+}
+
+// setPathForTest makes $PATH dir, returning the function restoring it.
+func setPathForTest(dir string) func() {
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir)
+
+	return func() { os.Setenv("PATH", path) }
+}
+
+func emptyDirForTest(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "youtube-dl-queue-empty-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dir
+}
+
+func TestFindFFmpeg(t *testing.T) {
+	ffmpeg := writeStubFFmpegForTest(t)
+
+	found, version, err := findFFmpeg(context.Background(), ffmpeg)
+	if err != nil || found != ffmpeg || version != "4.4.2" {
+		t.Fatalf("different ffmpeg! %s %s %v", found, version, err)
+	}
+
+	// an ffmpeg given by path must be an ffmpeg
+	for _, path := range []string{
+		filepath.Join(filepath.Dir(ffmpeg), "missing"),
+		writeFakeDownloaderForTest(t, "youtube-dl", fakeYoutubeDlScript),
+	} {
+		if _, _, err := findFFmpeg(context.Background(), path); err == nil {
+			t.Fatalf("%s: found an invalid ffmpeg!", path)
+		}
+	}
+
+	defer setPathForTest(filepath.Dir(ffmpeg))()
+
+	if found, _, err := findFFmpeg(context.Background(), ""); err != nil || found != ffmpeg {
+		t.Fatalf("different ffmpeg in $PATH! %s %v", found, err)
+	}
+
+	if found, _, err := findFFmpeg(context.Background(), NoFFmpeg); err != nil || found != "" {
+		t.Fatalf("found a disabled ffmpeg! %s %v", found, err)
+	}
+
+	os.Setenv("PATH", emptyDirForTest(t))
+
+	if found, _, err := findFFmpeg(context.Background(), ""); err != nil || found != "" {
+		t.Fatalf("found a missing ffmpeg! %s %v", found, err)
+	}
+}
+
+func TestStartFFmpeg(t *testing.T) {
+	ffmpeg := writeStubFFmpegForTest(t)
+	downloader := NewYoutubeDl(writeFakeDownloaderForTest(t, "youtube-dl", argsDownloaderScript))
+
+	cases := []struct {
+		name       string
+		ffmpegPath string
+		pathDir    string
+		expected   string
+	}{
+		{"explicit", ffmpeg, emptyDirForTest(t), ffmpeg},
+		{"lookup", "", filepath.Dir(ffmpeg), ffmpeg},
+		{"missing", "", emptyDirForTest(t), ""},
+		{"none", NoFFmpeg, filepath.Dir(ffmpeg), ""},
+	}
+
+	defer setPathForTest(os.Getenv("PATH"))()
+
+	for i, c := range cases {
+		os.Setenv("PATH", c.pathDir)
+
+		q := newQueueForTest(t, downloader)
+		q.SetFFmpegPath(c.ffmpegPath)
+		if _, err := q.Start(context.Background()); err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+
+		if q.GetFFmpegPath() != c.expected {
+			t.Fatalf("%s: different ffmpeg! %s", c.name, q.GetFFmpegPath())
+		}
+
+		task := Task{Id: int64(i + 1), VideoFormat: "137", AudioFormat: "140", Url: "https://www.youtube.com/watch?v=StartFFmpeg", OutputPath: "/tmp/output"}
+		if err := q.Exec(context.Background(), &task); err != nil {
+			t.Fatal(err)
+		}
+		q.Stop()
+
+		log, err := ioutil.ReadFile(q.LogPath(task.Id))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if c.expected == "" && strings.Contains(string(log), "--ffmpeg-location") || c.expected != "" && !strings.Contains(string(log), "--ffmpeg-location "+c.expected+" ") {
+			t.Fatalf("%s: different args! %s", c.name, log)
+		}
+	}
+
+	q := newQueueForTest(t, downloader)
+	q.SetFFmpegPath(writeFakeDownloaderForTest(t, "ffmpeg", argsDownloaderScript))
+	if _, err := q.Start(context.Background()); err == nil {
+		q.Stop()
+		t.Fatalf("started with an invalid ffmpeg!")
+	}
+}
@@ -0,0 +1,21 @@
+package queue
+
+// FinishedTask records a task downloaded successfully, with the file
+// it was saved into and the ids of the formats the downloader resolved.
+type FinishedTask struct {
+	Id         int64     `json:"id"`
+	VideoId    string    `json:"video_id"`
+	Url        string    `json:"url"`
+	OutputFile string    `json:"output_file"`
+	FormatIds  FormatIds `json:"format_ids"`
+	FinishedAt int64     `json:"finished_at"`
+}
+
+// GetFinishedTask returns ErrTaskNotFound when no task finished under the job id.
+func GetFinishedTask(id int64) (FinishedTask, error) {
+	return defaultQueue.GetFinishedTask(id)
+}
+
+func (q *Queue) GetFinishedTask(id int64) (FinishedTask, error) {
+	return q.store.GetFinished(id)
+}
@@ -0,0 +1,245 @@
+package queue
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var ErrInvalidFormat = errors.New("format is invalid.")
+
+// formatSelector is a parsed format selection expression of youtube-dl:
+// a format name, as "137", "bestvideo" or "mp4", or the selectors
+// joined by op, which is '+' to merge them, '/' for the first available
+// and ',' for all of them, or '(' for the group of the only selector.
+// Filters, as "height<=1080", limit the formats selected.
+type formatSelector struct {
+	op        byte
+	name      string
+	filters   []string
+	selectors []formatSelector
+}
+
+var (
+	numericFormatFields = map[string]bool{
+		"width": true, "height": true, "tbr": true, "abr": true, "vbr": true, "asr": true,
+		"filesize": true, "filesize_approx": true, "fps": true, "audio_channels": true, "quality": true,
+	}
+	stringFormatFields = map[string]bool{
+		"ext": true, "acodec": true, "vcodec": true, "container": true, "protocol": true,
+		"format_id": true, "language": true, "format_note": true, "resolution": true, "dynamic_range": true,
+	}
+
+	numericFormatFilterRegexp = regexp.MustCompile(`^([a-z_]+)\s*(<=|>=|<|>|!=|=)\??\s*(\d+(\.\d+)?([kKmMgGtTpP]i?[bB]?)?)$`)
+	stringFormatFilterRegexp  = regexp.MustCompile(`^([a-z_]+)\s*!?(\^=|\$=|\*=|~=|=)\??\s*(.+)$`)
+)
+
+func validateFormatFilter(filter string) error {
+	if matches := numericFormatFilterRegexp.FindStringSubmatch(filter); matches != nil && numericFormatFields[matches[1]] {
+		return nil
+	}
+
+	matches := stringFormatFilterRegexp.FindStringSubmatch(filter)
+	switch {
+	case matches == nil:
+		return fmt.Errorf("filter [%s] is not field, operator and value", filter)
+	case numericFormatFields[matches[1]]:
+		return fmt.Errorf("filter [%s] compares the number %s to a string", filter, matches[1])
+	case !stringFormatFields[matches[1]]:
+		return fmt.Errorf("filter [%s] has an unknown field %s", filter, matches[1])
+	}
+
+	return nil
+}
+
+// formatParser parses format selection expressions by precedence,
+// from the lowest: ',', '/', '+', and the format names and groups.
+type formatParser struct {
+	spec string
+	pos  int
+}
+
+// parseFormat parses spec, returning an error wrapping ErrInvalidFormat
+// for the expressions youtube-dl would not take.
+func parseFormat(spec string) (selector formatSelector, err error) {
+	p := &formatParser{spec: spec}
+
+	if selector, err = p.parseJoined(','); err == nil && p.peek() != 0 {
+		err = p.errorf("unexpected %q", p.peek())
+	}
+
+	if err != nil {
+		return formatSelector{}, fmt.Errorf("format %q: %s: %w", spec, err, ErrInvalidFormat)
+	}
+
+	return selector, nil
+}
+
+// ValidateFormat returns an error wrapping ErrInvalidFormat when spec
+// is not a format selection expression.
+func ValidateFormat(spec string) error {
+	_, err := parseFormat(spec)
+
+	return err
+}
+
+var joinedBy = map[byte]byte{',': '/', '/': '+'}
+
+// parseJoined parses the selectors joined by op.
+func (p *formatParser) parseJoined(op byte) (selector formatSelector, err error) {
+	parse := p.parseSingle
+	if next, ok := joinedBy[op]; ok {
+		parse = func() (formatSelector, error) { return p.parseJoined(next) }
+	}
+
+	joined := formatSelector{op: op}
+	for {
+		if selector, err = parse(); err != nil {
+			return selector, err
+		}
+		joined.selectors = append(joined.selectors, selector)
+
+		if p.peek() != op {
+			break
+		}
+		p.pos++
+	}
+
+	if len(joined.selectors) == 1 {
+		return joined.selectors[0], nil
+	}
+
+	return joined, nil
+}
+
+func (p *formatParser) parseSingle() (selector formatSelector, err error) {
+	switch p.peek() {
+	case '(':
+		p.pos++
+		group, err := p.parseJoined(',')
+		if err != nil {
+			return selector, err
+		}
+		if p.peek() != ')' {
+			return selector, p.errorf("unclosed (")
+		}
+		p.pos++
+		selector = formatSelector{op: '(', selectors: []formatSelector{group}}
+	default:
+		start := p.pos
+		for p.pos < len(p.spec) && !strings.ContainsRune(",/+()[] \t", rune(p.spec[p.pos])) {
+			p.pos++
+		}
+		selector.name = p.spec[start:p.pos]
+	}
+
+	for p.peek() == '[' {
+		end := strings.IndexByte(p.spec[p.pos:], ']')
+		if end < 0 {
+			return selector, p.errorf("unclosed [")
+		}
+
+		filter := strings.TrimSpace(p.spec[p.pos+1 : p.pos+end])
+		if err := validateFormatFilter(filter); err != nil {
+			return selector, p.errorf("%s", err)
+		}
+
+		selector.filters = append(selector.filters, filter)
+		p.pos += end + 1
+	}
+
+	if selector.op == 0 && selector.name == "" && len(selector.filters) == 0 {
+		if p.peek() == 0 {
+			return selector, p.errorf("missing format")
+		}
+		return selector, p.errorf("unexpected %q", p.peek())
+	}
+
+	return selector, nil
+}
+
+// peek returns the next character which is no blank, 0 at the end.
+func (p *formatParser) peek() byte {
+	for p.pos < len(p.spec) && (p.spec[p.pos] == ' ' || p.spec[p.pos] == '\t') {
+		p.pos++
+	}
+
+	if p.pos == len(p.spec) {
+		return 0
+	}
+
+	return p.spec[p.pos]
+}
+
+func (p *formatParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%s at %d", fmt.Sprintf(format, args...), p.pos)
+}
+
+// FormatSpec is the format selection expression downloading t: Format,
+// or else its video and audio formats merged, or either of them alone
+// for a video only or audio only download.
+func (t Task) FormatSpec() string {
+	return formatSpec(t.Format, t.VideoFormat, t.AudioFormat)
+}
+
+func (ft FailedTask) FormatSpec() string {
+	return formatSpec(ft.Format, ft.VideoFormat, ft.AudioFormat)
+}
+
+func formatSpec(format string, videoFormat string, audioFormat string) string {
+	switch {
+	case format != "":
+		return format
+	case videoFormat != "" && audioFormat != "":
+		return videoFormat + "+" + audioFormat
+	default:
+		return videoFormat + audioFormat
+	}
+}
+
+// validateFormat requires t to select its formats either by Format,
+// or by its video format, audio format or both.
+func (t Task) validateFormat() error {
+	if t.Format != "" && (t.VideoFormat != "" || t.AudioFormat != "") {
+		return fmt.Errorf("format cannot be combined with video_format and audio_format: %w", ErrInvalidFormat)
+	}
+
+	if t.FormatSpec() == "" {
+		return fmt.Errorf("format, video_format or audio_format is required: %w", ErrInvalidFormat)
+	}
+
+	if t.Format == "" && strings.ContainsAny(t.VideoFormat+t.AudioFormat, ",/+()[] \t") {
+		return fmt.Errorf("video_format and audio_format must be format ids: %w", ErrInvalidFormat)
+	}
+
+	return ValidateFormat(t.FormatSpec())
+}
+
+// FormatIds are the ids of the formats a task downloaded, as youtube-dl
+// reported them. They are stored separated by commas, which no id contains.
+type FormatIds []string
+
+func (ids FormatIds) Value() (driver.Value, error) {
+	return strings.Join(ids, ","), nil
+}
+
+func (ids *FormatIds) Scan(src interface{}) error {
+	var value string
+	switch src := src.(type) {
+	case []byte:
+		value = string(src)
+	case string:
+		value = src
+	default:
+		return fmt.Errorf("cannot scan %T into format ids.", src)
+	}
+
+	*ids = nil
+	if value != "" {
+		*ids = strings.Split(value, ",")
+	}
+
+	return nil
+}
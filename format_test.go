@@ -0,0 +1,111 @@
+package queue
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseFormat(t *testing.T) {
+	valids := []string{
+		"137",
+		"137+140",
+		"137 + 140",
+		"hls-1080p",
+		"137+140+251",
+		"best",
+		"bestaudio",
+		"mp4",
+		"bv*+ba/b",
+		"bv.2",
+		"137+140/best",
+		"137/22",
+		"137,140",
+		"bestvideo[height<=1080]+bestaudio/best",
+		"bestvideo[height<=?1080][fps>30]+bestaudio[ext=m4a]",
+		"(mp4,webm)[height<480]",
+		"[filesize<50M]",
+		"best[vcodec!^=avc1][format_id*=dash]",
+		"((bv+ba)/b)[protocol!=m3u8]",
+	}
+
+	for _, spec := range valids {
+		if _, err := parseFormat(spec); err != nil {
+			t.Fatalf("%s: %s", spec, err)
+		}
+	}
+
+	invalids := []string{
+		"",
+		" ",
+		"137+",
+		"+140",
+		"137//22",
+		"137,",
+		"(best",
+		"best)",
+		"()",
+		"best[height<=1080",
+		"best[]",
+		"best[height]",
+		"best[heigth<=1080]",
+		"best[height<=large]",
+		"best[ext<mp4]",
+		"best[height^=10]",
+		"best(mp4)",
+	}
+
+	for _, spec := range invalids {
+		if _, err := parseFormat(spec); !errors.Is(err, ErrInvalidFormat) {
+			t.Fatalf("%q: expected invalid format error, got %v", spec, err)
+		}
+	}
+}
+
+func TestQueueTaskFormat(t *testing.T) {
+	InitializeForTest(t)
+
+	cases := []struct {
+		task Task
+		spec string
+	}{
+		{Task{VideoFormat: "137", AudioFormat: "140"}, "137+140"},
+		{Task{VideoFormat: "137"}, "137"},
+		{Task{AudioFormat: "140"}, "140"},
+		{Task{Format: "bestvideo[height<=1080]+bestaudio/best"}, "bestvideo[height<=1080]+bestaudio/best"},
+		{Task{Format: "bestaudio"}, "bestaudio"},
+	}
+
+	for _, c := range cases {
+		task := c.task
+		task.Url = "https://www.youtube.com/watch?v=QueueTaskFormat"
+		task.OutputPath = "/tmp/output"
+
+		// each spec is another download of the same video
+		if err := task.QueueTask(); err != nil {
+			t.Fatalf("%s: %s", c.spec, err)
+		}
+
+		queued, err := GetTask(task.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if queued.FormatSpec() != c.spec {
+			t.Fatalf("different format spec! %s expected %s", queued.FormatSpec(), c.spec)
+		}
+	}
+
+	invalids := []Task{
+		{},
+		{Format: "best", VideoFormat: "137"},
+		{Format: "best[height<=]"},
+		{VideoFormat: "bestvideo/best", AudioFormat: "140"},
+	}
+
+	for _, task := range invalids {
+		task.Url = "https://www.youtube.com/watch?v=QueueTaskFormatInvalid"
+		if err := task.QueueTask(); !errors.Is(err, ErrInvalidFormat) {
+			t.Fatalf("%+v: expected invalid format error, got %v", task, err)
+		}
+	}
+}
@@ -2,4 +2,8 @@ module github.com/satom9to5/youtube-dl-queue
 
 go 1.13
 
-require github.com/satom9to5/pidfile v0.0.0-20190604150648-b4983bc136e3
+require (
+	github.com/lib/pq v1.9.0
+	github.com/mattn/go-sqlite3 v1.14.6
+	github.com/satom9to5/pidfile v0.0.0-20190604150648-b4983bc136e3
+)
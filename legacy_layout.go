@@ -0,0 +1,244 @@
+package queue
+
+import (
+	"database/sql"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// Before job ids, tasks and failed_tasks were keyed on
+// (video id, video_format, audio_format) and logs were named after the video id.
+
+// hasLegacyLayout reports whether the tasks table is keyed on video ids.
+func hasLegacyLayout(db *sql.DB) (bool, error) {
+	columns, err := tableColumns(db, "tasks")
+	if err != nil {
+		return false, err
+	}
+
+	return len(columns) > 0 && !columns["video_id"], nil
+}
+
+// tableColumns returns the column names of table, none when it does not exist.
+func tableColumns(q queryer, table string) (columns map[string]bool, err error) {
+	rows, err := q.Query(`PRAGMA table_info("` + table + `")`)
+	if err != nil {
+		return columns, err
+	}
+
+	columns = make(map[string]bool)
+
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			columnType string
+			notNull    int
+			dflt       sql.NullString
+			pk         int
+		)
+		if err = rows.Scan(&cid, &name, &columnType, &notNull, &dflt, &pk); err != nil {
+			return columns, err
+		}
+		columns[name] = true
+	}
+
+	return columns, rows.Err()
+}
+
+// migrateLegacyLayout gives every task and failed task a job id, keeping the
+// video id in video_id, and copies the log of each video in logDirectory
+// to each of its jobs.
+// Leases and progress are dropped, so that started tasks are run again.
+// The tables are left in the baseline schema, which migrate upgrades.
+func migrateLegacyLayout(db *sql.DB, logDirectory string) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	legacyColumns := map[string]map[string]bool{}
+	for _, table := range []string{"tasks", "failed_tasks", "webhook_deliveries"} {
+		if legacyColumns[table], err = tableColumns(tx, table); err != nil {
+			return err
+		}
+
+		if len(legacyColumns[table]) == 0 {
+			continue
+		}
+
+		if _, err = tx.Exec(`ALTER TABLE "` + table + `" RENAME TO "legacy_` + table + `"`); err != nil {
+			return err
+		}
+	}
+
+	for _, table := range []string{"current_task", "task_progress"} {
+		if _, err = tx.Exec(`DROP TABLE IF EXISTS "` + table + `"`); err != nil {
+			return err
+		}
+	}
+
+	if err = execSqls(tx, baselineSqls); err != nil {
+		return err
+	}
+
+	columns := legacyColumnsOf(legacyColumns["tasks"], "video_format", "audio_format", "url", "title", "output_path", "parameter", "created_at", "updated_at", "attempts", "next_attempt_at")
+	if _, err = tx.Exec(`INSERT INTO tasks (video_id, started_at, ` + columns + `)
+		SELECT id, 0, ` + columns + ` FROM legacy_tasks ORDER BY created_at ASC, rowid ASC`); err != nil {
+		return err
+	}
+
+	if len(legacyColumns["failed_tasks"]) > 0 {
+		// failed tasks get job ids after the tasks, and the sequence of tasks
+		// is moved past them, as a failed task keeps its id when requeued
+		columns = legacyColumnsOf(legacyColumns["failed_tasks"], "video_format", "audio_format", "url", "title", "output_path", "parameter", "created_at", "updated_at", "started_at", "failed_at", "exit_code", "log_path", "reason", "log_tail", "attempts")
+		if _, err = tx.Exec(`INSERT INTO failed_tasks (id, video_id, ` + columns + `)
+			SELECT (SELECT COALESCE(MAX(id), 0) FROM tasks) + ROW_NUMBER() OVER (ORDER BY failed_at ASC, rowid ASC), id, ` + columns + ` FROM legacy_failed_tasks`); err != nil {
+			return err
+		}
+
+		if _, err = tx.Exec(`DELETE FROM sqlite_sequence WHERE name = 'tasks'`); err != nil {
+			return err
+		}
+
+		if _, err = tx.Exec(`INSERT INTO sqlite_sequence (name, seq)
+			SELECT 'tasks', seq FROM (SELECT MAX(id) AS seq FROM (SELECT id FROM tasks UNION ALL SELECT id FROM failed_tasks)) WHERE seq IS NOT NULL`); err != nil {
+			return err
+		}
+	}
+
+	if len(legacyColumns["webhook_deliveries"]) > 0 {
+		// only deliveries of failed tasks still have a job to point to
+		if _, err = tx.Exec(`INSERT INTO webhook_deliveries (id, webhook_id, event, task_id, video_id, attempt, status_code, error, delivered_at)
+			SELECT d.id, d.webhook_id, d.event, COALESCE((
+				SELECT f.id FROM failed_tasks f WHERE f.video_id = d.task_id AND f.video_format = d.video_format AND f.audio_format = d.audio_format
+			), 0), d.task_id, d.attempt, d.status_code, d.error, d.delivered_at FROM legacy_webhook_deliveries d`); err != nil {
+			return err
+		}
+	}
+
+	legacyLogs, copiedLogs, err := copyLegacyLogs(tx, logDirectory)
+
+	// the copies would otherwise be taken for the logs of new jobs
+	defer func() {
+		if err != nil {
+			for _, path := range copiedLogs {
+				os.Remove(path)
+			}
+		}
+	}()
+
+	if err != nil {
+		return err
+	}
+
+	for table := range legacyColumns {
+		if len(legacyColumns[table]) == 0 {
+			continue
+		}
+
+		if _, err = tx.Exec(`DROP TABLE "legacy_` + table + `"`); err != nil {
+			return err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	for _, path := range legacyLogs {
+		if err := os.Remove(path); err != nil {
+			log.Println(err)
+		}
+	}
+
+	return nil
+}
+
+// legacyColumnsOf joins the names among columns which the legacy table has.
+func legacyColumnsOf(legacy map[string]bool, columns ...string) string {
+	found := []string{}
+	for _, column := range columns {
+		if legacy[column] {
+			found = append(found, column)
+		}
+	}
+
+	return strings.Join(found, ", ")
+}
+
+// copyLegacyLogs copies the log named after each video id to the log
+// of each job of the video, and points failed tasks to their new logs.
+func copyLegacyLogs(tx *sql.Tx, logDirectory string) (legacyLogs []string, copiedLogs []string, err error) {
+	rows, err := tx.Query(`SELECT id, video_id FROM tasks UNION ALL SELECT id, video_id FROM failed_tasks`)
+	if err != nil {
+		return legacyLogs, copiedLogs, err
+	}
+
+	jobs := map[int64]string{}
+
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			id      int64
+			videoId string
+		)
+		if err = rows.Scan(&id, &videoId); err != nil {
+			return legacyLogs, copiedLogs, err
+		}
+		jobs[id] = videoId
+	}
+	if err = rows.Err(); err != nil {
+		return legacyLogs, copiedLogs, err
+	}
+	rows.Close()
+
+	copied := map[string]bool{}
+	for id, videoId := range jobs {
+		legacyLog := logDirectory + string(os.PathSeparator) + videoId + ".log"
+		if _, err = os.Stat(legacyLog); os.IsNotExist(err) {
+			continue
+		}
+
+		jobLog := logPath(logDirectory, id)
+		if err = copyFile(legacyLog, jobLog); err != nil {
+			return legacyLogs, copiedLogs, err
+		}
+		copiedLogs = append(copiedLogs, jobLog)
+
+		if _, err = tx.Exec(`UPDATE failed_tasks SET log_path = ? WHERE id = ? AND log_path = ?`, jobLog, id, legacyLog); err != nil {
+			return legacyLogs, copiedLogs, err
+		}
+
+		if !copied[legacyLog] {
+			copied[legacyLog] = true
+			legacyLogs = append(legacyLogs, legacyLog)
+		}
+	}
+
+	return legacyLogs, copiedLogs, nil
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
@@ -0,0 +1,495 @@
+package queue
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryStore keeps everything in maps, for tests and embedded use
+// where the queue does not need to outlive the process.
+type memoryStore struct {
+	mutex       sync.Mutex
+	tasks       map[int64]Task
+	failedTasks map[int64]FailedTask
+	finished    map[int64]FinishedTask
+	leases      map[int64]CurrentTask
+	progresses  map[int64]Progress
+	webhooks    []Webhook
+	deliveries  []WebhookDelivery
+	// the last job id, never reused like the AUTOINCREMENT of tasks
+	lastId         int64
+	lastWebhookId  int64
+	lastDeliveryId int64
+}
+
+func NewMemoryStore() Store {
+	return &memoryStore{
+		tasks:       make(map[int64]Task),
+		failedTasks: make(map[int64]FailedTask),
+		finished:    make(map[int64]FinishedTask),
+		leases:      make(map[int64]CurrentTask),
+		progresses:  make(map[int64]Progress),
+	}
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+func (s *memoryStore) Enqueue(t *Task) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.addTask(t)
+}
+
+func (s *memoryStore) addTask(t *Task) error {
+	for _, queued := range s.tasks {
+		if queued.VideoId == t.VideoId && queued.VideoFormat == t.VideoFormat && queued.AudioFormat == t.AudioFormat && queued.Format == t.Format && queued.OutputPath == t.OutputPath && queued.Parameters.equal(t.Parameters) {
+			return ErrDuplicateTask
+		}
+	}
+
+	if t.Id == 0 {
+		t.Id = s.lastId + 1
+	} else if _, ok := s.tasks[t.Id]; ok {
+		return fmt.Errorf("job id %d is already used.", t.Id)
+	}
+
+	if t.Id > s.lastId {
+		s.lastId = t.Id
+	}
+
+	s.tasks[t.Id] = *t
+
+	return nil
+}
+
+func (s *memoryStore) Claim(workerId string, limit int) (tasks []Task, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now().Unix()
+
+	tasks = []Task{}
+	for _, task := range s.tasks {
+		if _, leased := s.leases[task.Id]; task.StartedAt == 0 && task.NextAttemptAt <= now && !leased {
+			tasks = append(tasks, task)
+		}
+	}
+
+	sort.Slice(tasks, func(i, j int) bool {
+		if tasks[i].CreatedAt != tasks[j].CreatedAt {
+			return tasks[i].CreatedAt < tasks[j].CreatedAt
+		}
+		return tasks[i].Id < tasks[j].Id
+	})
+
+	if len(tasks) > limit {
+		tasks = tasks[:limit]
+	}
+
+	for i := range tasks {
+		tasks[i].StartedAt = now
+		s.tasks[tasks[i].Id] = tasks[i]
+		s.leases[tasks[i].Id] = CurrentTask{
+			Id:          tasks[i].Id,
+			WorkerId:    workerId,
+			Pid:         os.Getpid(),
+			HeartbeatAt: now,
+		}
+	}
+
+	return tasks, nil
+}
+
+func (s *memoryStore) MarkStarted(id int64, startedAt int64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if task, ok := s.tasks[id]; ok {
+		task.StartedAt = startedAt
+		s.tasks[id] = task
+	}
+
+	return nil
+}
+
+func (s *memoryStore) Release(t Task) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if task, ok := s.tasks[t.Id]; ok {
+		task.StartedAt = 0
+		task.Attempts = t.Attempts
+		task.NextAttemptAt = t.NextAttemptAt
+		task.UpdatedAt = t.UpdatedAt
+		s.tasks[t.Id] = task
+	}
+
+	delete(s.leases, t.Id)
+	delete(s.progresses, t.Id)
+
+	return nil
+}
+
+func (s *memoryStore) Finish(ft FinishedTask) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.finished[ft.Id] = ft
+	s.deleteTask(ft.Id)
+
+	return nil
+}
+
+func (s *memoryStore) Fail(ft FailedTask) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.addFailed(ft); err != nil {
+		return err
+	}
+
+	s.deleteTask(ft.Id)
+
+	return nil
+}
+
+func (s *memoryStore) deleteTask(id int64) {
+	delete(s.tasks, id)
+	delete(s.leases, id)
+	delete(s.progresses, id)
+}
+
+func (s *memoryStore) Requeue(t *Task) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.failedTasks[t.Id]; !ok {
+		return ErrTaskNotFound
+	}
+
+	if err := s.addTask(t); err != nil {
+		return err
+	}
+
+	delete(s.failedTasks, t.Id)
+
+	return nil
+}
+
+func (s *memoryStore) Remove(id int64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	task, ok := s.tasks[id]
+	if !ok {
+		return ErrTaskNotFound
+	}
+
+	if task.StartedAt != 0 {
+		return ErrTaskRunning
+	}
+
+	delete(s.tasks, id)
+
+	return nil
+}
+
+func (s *memoryStore) Get(id int64) (Task, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	task, ok := s.tasks[id]
+	if !ok {
+		return task, ErrTaskNotFound
+	}
+
+	return task, nil
+}
+
+func (s *memoryStore) List() ([]Task, error) {
+	return s.listTasks(func(Task) bool { return true }), nil
+}
+
+func (s *memoryStore) ListByVideoId(videoId string) ([]Task, error) {
+	return s.listTasks(func(t Task) bool { return t.VideoId == videoId }), nil
+}
+
+func (s *memoryStore) Query(query TaskQuery, now int64) ([]Task, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	tasks := []Task{}
+	for _, task := range s.tasks {
+		if query.matches(task, now) {
+			tasks = append(tasks, task)
+		}
+	}
+
+	return query.sortAndPage(tasks), nil
+}
+
+// listTasks returns the tasks matching filter, the latest first.
+func (s *memoryStore) listTasks(filter func(Task) bool) []Task {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	tasks := []Task{}
+	for _, task := range s.tasks {
+		if filter(task) {
+			tasks = append(tasks, task)
+		}
+	}
+
+	sort.Slice(tasks, func(i, j int) bool {
+		if tasks[i].CreatedAt != tasks[j].CreatedAt {
+			return tasks[i].CreatedAt > tasks[j].CreatedAt
+		}
+		if tasks[i].UpdatedAt != tasks[j].UpdatedAt {
+			return tasks[i].UpdatedAt > tasks[j].UpdatedAt
+		}
+		return tasks[i].Id > tasks[j].Id
+	})
+
+	return tasks
+}
+
+func (s *memoryStore) AddFailed(ft FailedTask) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.addFailed(ft)
+}
+
+func (s *memoryStore) addFailed(ft FailedTask) error {
+	if _, ok := s.failedTasks[ft.Id]; ok {
+		return fmt.Errorf("job id %d is already used.", ft.Id)
+	}
+
+	if ft.Id > s.lastId {
+		s.lastId = ft.Id
+	}
+
+	s.failedTasks[ft.Id] = ft
+
+	return nil
+}
+
+func (s *memoryStore) RemoveFailed(id int64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.failedTasks[id]; !ok {
+		return ErrTaskNotFound
+	}
+
+	delete(s.failedTasks, id)
+
+	return nil
+}
+
+func (s *memoryStore) GetFailed(id int64) (FailedTask, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	failedTask, ok := s.failedTasks[id]
+	if !ok {
+		return failedTask, ErrTaskNotFound
+	}
+
+	return failedTask, nil
+}
+
+func (s *memoryStore) ListFailed() ([]FailedTask, error) {
+	failedTasks := s.listFailedTasks(func(FailedTask) bool { return true })
+
+	sort.Slice(failedTasks, func(i, j int) bool {
+		return failedTasks[i].Id > failedTasks[j].Id
+	})
+
+	return failedTasks, nil
+}
+
+func (s *memoryStore) ListFailedByVideoId(videoId string) ([]FailedTask, error) {
+	failedTasks := s.listFailedTasks(func(ft FailedTask) bool { return ft.VideoId == videoId })
+
+	sort.Slice(failedTasks, func(i, j int) bool {
+		if failedTasks[i].FailedAt != failedTasks[j].FailedAt {
+			return failedTasks[i].FailedAt > failedTasks[j].FailedAt
+		}
+		return failedTasks[i].Id > failedTasks[j].Id
+	})
+
+	return failedTasks, nil
+}
+
+func (s *memoryStore) GetFinished(id int64) (FinishedTask, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	finishedTask, ok := s.finished[id]
+	if !ok {
+		return finishedTask, ErrTaskNotFound
+	}
+
+	return finishedTask, nil
+}
+
+func (s *memoryStore) listFailedTasks(filter func(FailedTask) bool) []FailedTask {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	failedTasks := []FailedTask{}
+	for _, failedTask := range s.failedTasks {
+		if filter(failedTask) {
+			failedTasks = append(failedTasks, failedTask)
+		}
+	}
+
+	return failedTasks
+}
+
+func (s *memoryStore) Heartbeat(id int64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if lease, ok := s.leases[id]; ok {
+		lease.HeartbeatAt = time.Now().Unix()
+		s.leases[id] = lease
+	}
+
+	return nil
+}
+
+func (s *memoryStore) ListLeases() ([]CurrentTask, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	currentTasks := []CurrentTask{}
+	for _, lease := range s.leases {
+		currentTasks = append(currentTasks, lease)
+	}
+
+	sort.Slice(currentTasks, func(i, j int) bool {
+		if currentTasks[i].WorkerId != currentTasks[j].WorkerId {
+			return currentTasks[i].WorkerId < currentTasks[j].WorkerId
+		}
+		return currentTasks[i].Id < currentTasks[j].Id
+	})
+
+	return currentTasks, nil
+}
+
+func (s *memoryStore) RecoverStaleLeases(heartbeatBefore int64) (recovered int64, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for id, lease := range s.leases {
+		if lease.HeartbeatAt < heartbeatBefore {
+			delete(s.leases, id)
+		}
+	}
+
+	for id, task := range s.tasks {
+		if _, leased := s.leases[id]; task.StartedAt != 0 && !leased {
+			task.StartedAt = 0
+			s.tasks[id] = task
+			recovered++
+		}
+	}
+
+	return recovered, nil
+}
+
+func (s *memoryStore) SaveProgress(progress Progress) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.progresses[progress.Id] = progress
+
+	return nil
+}
+
+func (s *memoryStore) GetProgress(id int64) (Progress, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	progress, ok := s.progresses[id]
+	if !ok {
+		return progress, sql.ErrNoRows
+	}
+
+	return progress, nil
+}
+
+func (s *memoryStore) AddWebhook(webhook *Webhook) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.lastWebhookId++
+	webhook.Id = s.lastWebhookId
+
+	stored := *webhook
+	stored.Events = append([]EventType{}, webhook.Events...)
+	s.webhooks = append(s.webhooks, stored)
+
+	return nil
+}
+
+func (s *memoryStore) RemoveWebhook(id int64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i, webhook := range s.webhooks {
+		if webhook.Id == id {
+			s.webhooks = append(s.webhooks[:i], s.webhooks[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
+func (s *memoryStore) ListWebhooks() ([]Webhook, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	webhooks := []Webhook{}
+	for _, webhook := range s.webhooks {
+		webhook.Events = append([]EventType{}, webhook.Events...)
+		webhooks = append(webhooks, webhook)
+	}
+
+	return webhooks, nil
+}
+
+func (s *memoryStore) AddWebhookDelivery(delivery *WebhookDelivery) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.lastDeliveryId++
+	delivery.Id = s.lastDeliveryId
+	s.deliveries = append(s.deliveries, *delivery)
+
+	return nil
+}
+
+func (s *memoryStore) ListWebhookDeliveries(webhookId int64) ([]WebhookDelivery, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	deliveries := []WebhookDelivery{}
+	for _, delivery := range s.deliveries {
+		if delivery.WebhookId == webhookId {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+
+	return deliveries, nil
+}
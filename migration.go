@@ -0,0 +1,140 @@
+package queue
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// migration upgrades the schema from version-1 to version. Released
+// migrations must not be edited, a change to the schema is a new migration.
+type migration struct {
+	version int
+	name    string
+	sqls    []string
+	// convert rewrites the rows after sqls, for changes SQL cannot express
+	convert func(tx *sql.Tx) error
+}
+
+// migrations are the migrations of the SQLite store,
+// see postgresMigrations for the PostgreSQL store.
+var migrations = []migration{
+	// the tables are created IF NOT EXISTS, so that a db created
+	// before schema_version is taken as version 1
+	{1, "baseline", baselineSqls, nil},
+	{2, "tasks_pending", []string{
+		`CREATE INDEX "tasks_pending" ON "tasks" ("started_at", "next_attempt_at", "created_at")`,
+	}, nil},
+	// the downloader selected by the task, empty for the default of the queue
+	{3, "downloader", []string{
+		`ALTER TABLE "tasks" ADD COLUMN "downloader" TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE "failed_tasks" ADD COLUMN "downloader" TEXT NOT NULL DEFAULT ''`,
+	}, nil},
+	// parameter holds the JSON array of Parameters instead of one string
+	{4, "parameters", nil, convertParameters},
+	// the JSON object of DownloadOptions
+	{5, "options", []string{
+		`ALTER TABLE "tasks" ADD COLUMN "options" TEXT NOT NULL DEFAULT '{}'`,
+		`ALTER TABLE "failed_tasks" ADD COLUMN "options" TEXT NOT NULL DEFAULT '{}'`,
+	}, nil},
+	// the format selection expression, which is a part of the download
+	{6, "format", []string{
+		`ALTER TABLE "tasks" ADD COLUMN "format" TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE "failed_tasks" ADD COLUMN "format" TEXT NOT NULL DEFAULT ''`,
+		`DROP INDEX "tasks_download"`,
+		`CREATE UNIQUE INDEX "tasks_download" ON "tasks" ("video_id", "video_format", "audio_format", "format", "output_path", "parameter")`,
+	}, nil},
+	// the ids of the formats downloaded, see FormatIds
+	{7, "format_ids", []string{
+		`ALTER TABLE "failed_tasks" ADD COLUMN "format_ids" TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE "webhook_deliveries" ADD COLUMN "format_ids" TEXT NOT NULL DEFAULT ''`,
+	}, nil},
+	// the token of the claim taking the lease, see sqliteStore.Claim
+	{8, "claim", []string{
+		`ALTER TABLE "current_task" ADD COLUMN "claim" TEXT NOT NULL DEFAULT ''`,
+	}, nil},
+	// the tasks downloaded, with the file and the formats they resolved to
+	{9, "finished_tasks", []string{
+		`CREATE TABLE "finished_tasks" (
+			"id" INTEGER NOT NULL PRIMARY KEY,
+			"video_id" TEXT NOT NULL,
+			"url" TEXT NOT NULL,
+			"output_file" TEXT NOT NULL,
+			"format_ids" TEXT NOT NULL,
+			"finished_at" INTEGER NOT NULL
+		)`,
+		`CREATE INDEX "finished_tasks_video_id" ON "finished_tasks" ("video_id")`,
+	}, nil},
+}
+
+// migrate applies the migrations newer than the schema version of db,
+// each in a transaction with the row recording it in schema_version.
+// Its own statements are understood by both SQLite and PostgreSQL.
+func migrate(db *sql.DB, migrations []migration) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS "schema_version" (
+			"version" INTEGER NOT NULL PRIMARY KEY,
+	    "name" TEXT NOT NULL,	
+			"applied_at" INTEGER NOT NULL
+		)`); err != nil {
+		return err
+	}
+
+	version, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	if latest := migrations[len(migrations)-1].version; version > latest {
+		return fmt.Errorf("schema version %d is newer than %d of this build.", version, latest)
+	}
+
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+
+		if err = m.apply(db); err != nil {
+			return fmt.Errorf("migration %d %s: %s", m.version, m.name, err)
+		}
+	}
+
+	return nil
+}
+
+func (m migration) apply(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// recording the version first takes the write lock, so that
+	// another process applying the same migration waits for this one
+	result, err := tx.Exec(`INSERT INTO schema_version (version, name, applied_at) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`, m.version, m.name, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+
+	if applied, err := result.RowsAffected(); err != nil || applied == 0 {
+		return err
+	}
+
+	if err = execSqls(tx, m.sqls); err != nil {
+		return err
+	}
+
+	if m.convert != nil {
+		if err = m.convert(tx); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// schemaVersion returns the version of the latest migration applied to db.
+func schemaVersion(db *sql.DB) (version int, err error) {
+	err = db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&version)
+
+	return version, err
+}
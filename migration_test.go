@@ -0,0 +1,200 @@
+package queue
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func openDBForTest(t *testing.T) *sql.DB {
+	sqlitePath, err := TempFileName()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testDb, err := sql.Open("sqlite3", sqlitePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return testDb
+}
+
+func hasTableForTest(t *testing.T, testDb *sql.DB, name string) bool {
+	count := 0
+	if err := testDb.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE name = ?`, name).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+
+	return count > 0
+}
+
+func TestMigrateBaseline(t *testing.T) {
+	InitializeForTest(t)
+
+	// a db created by InitializeSchema before schema_version
+	testDb := openDBForTest(t)
+	if err := execSqls(testDb, baselineSqls); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := testDb.Exec(`INSERT INTO tasks (video_id, video_format, audio_format, url, title, output_path, parameter, created_at, updated_at, started_at)
+		VALUES ('Baseline', '137', '140', 'https://www.youtube.com/watch?v=Baseline', 'TestBaseline', '/tmp/output', '', 1, 1, 0)`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := InitializeSchema(testDb); err != nil {
+		t.Fatal(err)
+	}
+
+	latest := migrations[len(migrations)-1].version
+	if version, err := schemaVersion(testDb); err != nil || version != latest {
+		t.Fatalf("different schema version! %d %v", version, err)
+	}
+
+	if !hasTableForTest(t, testDb, "tasks_pending") {
+		t.Fatalf("migration is not applied!")
+	}
+
+	tasks, err := GetTasksByVideoId("Baseline")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tasks) != 1 || tasks[0].Title != "TestBaseline" {
+		t.Fatalf("different tasks! %+v", tasks)
+	}
+
+	// applied migrations are not applied again
+	if err := InitializeSchema(testDb); err != nil {
+		t.Fatal(err)
+	}
+
+	count := 0
+	if err := testDb.QueryRow(`SELECT COUNT(*) FROM schema_version`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+
+	if count != len(migrations) {
+		t.Fatalf("different schema_version size! %d", count)
+	}
+}
+
+func TestMigrateRollback(t *testing.T) {
+	testDb := openDBForTest(t)
+	if err := InitializeSchema(testDb); err != nil {
+		t.Fatal(err)
+	}
+
+	latest := migrations[len(migrations)-1].version
+
+	released := migrations
+	defer func() { migrations = released }()
+
+	migrations = append(append([]migration{}, released...), migration{latest + 1, "broken", []string{
+		`CREATE TABLE "rollback_test" ("id" INTEGER NOT NULL PRIMARY KEY)`,
+		`INSERT INTO "missing_table" VALUES (1)`,
+	}, nil})
+
+	if err := InitializeSchema(testDb); err == nil {
+		t.Fatalf("broken migration is applied!")
+	}
+
+	if version, _ := schemaVersion(testDb); version != latest {
+		t.Fatalf("broken migration is recorded! %d", version)
+	}
+
+	if hasTableForTest(t, testDb, "rollback_test") {
+		t.Fatalf("broken migration is not rolled back!")
+	}
+
+	// a build older than the db
+	migrations = released[:len(released)-1]
+	if err := InitializeSchema(testDb); err == nil {
+		t.Fatalf("accepted a newer schema version!")
+	}
+}
+
+func TestMigrateParameters(t *testing.T) {
+	InitializeForTest(t)
+
+	testDb := openDBForTest(t)
+	if err := execSqls(testDb, baselineSqls); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, parameter := range []string{"", "--write-sub --sub-lang en", "--write-sub  --sub-lang 'en'", `"unterminated`, "--exec 'rm -rf ~'"} {
+		if _, err := testDb.Exec(`INSERT INTO tasks (video_id, video_format, audio_format, url, title, output_path, parameter, created_at, updated_at, started_at)
+			VALUES ('MigrateParameters', '137', '140', 'https://www.youtube.com/watch?v=MigrateParameters', 'TestMigrateParameters', '/tmp/output', ?, ?, ?, 0)`, parameter, i, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := testDb.Exec(`INSERT INTO failed_tasks (id, video_id, video_format, audio_format, url, title, output_path, parameter, created_at, updated_at, started_at, failed_at)
+		VALUES (10, 'MigrateParameters', '137', '140', 'https://www.youtube.com/watch?v=MigrateParameters', 'TestMigrateParameters', '/tmp/output', '--no-mtime', 1, 1, 1, 1)`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := InitializeSchema(testDb); err != nil {
+		t.Fatal(err)
+	}
+
+	tasks, err := GetTasksByVideoId("MigrateParameters")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Parameters{
+		{},
+		{"--write-sub", "--sub-lang", "en"},
+	}
+
+	if len(tasks) != len(expected) {
+		t.Fatalf("different tasks size! %d", len(tasks))
+	}
+
+	for _, task := range tasks {
+		if !task.Parameters.equal(expected[task.CreatedAt]) {
+			t.Fatalf("%d: different parameters! %q", task.CreatedAt, task.Parameters)
+		}
+	}
+
+	failedTasks, err := GetFailedTasksByVideoId("MigrateParameters")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the same download as a task before, unterminated, and invalid
+	failedParameters := map[int64]Parameters{2: {"--write-sub", "--sub-lang", "en"}, 3: {`"unterminated`}, 4: {"--exec", "rm -rf ~"}}
+	moved := 0
+	for _, failedTask := range failedTasks {
+		parameter, ok := failedParameters[failedTask.CreatedAt]
+		if !ok || failedTask.Id == 10 {
+			continue
+		}
+		moved++
+
+		if !failedTask.Parameters.equal(parameter) || failedTask.Reason != ReasonInvalidParameters || failedTask.LogTail == "" {
+			t.Fatalf("%d: different failed task! %+v", failedTask.CreatedAt, failedTask)
+		}
+
+		if _, err := failedTask.RequeueTask(); failedTask.CreatedAt == 4 && !errors.Is(err, ErrInvalidParameter) {
+			t.Fatalf("requeued invalid parameters! %v", err)
+		}
+	}
+
+	if moved != len(failedParameters) {
+		t.Fatalf("different failed tasks! %+v", failedTasks)
+	}
+
+	failedTask, err := GetFailedTask(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !failedTask.Parameters.equal(Parameters{"--no-mtime"}) {
+		t.Fatalf("different failed task parameters! %q", failedTask.Parameters)
+	}
+}
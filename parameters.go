@@ -0,0 +1,299 @@
+package queue
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var ErrInvalidParameter = errors.New("parameter is invalid.")
+
+// Parameters are the extra arguments of a task, each passed to the
+// downloader as one argument. They are stored as a JSON array.
+type Parameters []string
+
+// controlledOptions are given by the queue itself, see Downloader.Args,
+// or would let a task run commands, write where the queue does not expect,
+// or read more options or urls from files.
+var controlledOptions = []string{
+	"--output", "--format", "--ffmpeg-location", "--exec", "--paths",
+	"--config-location", "--config-locations", "--batch-file",
+	"--use-postprocessor", "--netrc-cmd", "--print-to-file",
+	"--external-downloader", "--external-downloader-args", "--downloader", "--downloader-args",
+}
+
+// abbreviatingOptions are options of their own whose names abbreviate
+// one of controlledOptions.
+var abbreviatingOptions = map[string]bool{"--netrc": true, "--print": true}
+
+// controlledOptionPrefix starts the options running commands, as yt-dlp's
+// --exec-before-download, all of which the queue controls.
+const controlledOptionPrefix = "--exec"
+
+// controlledShortOptions are the short forms of controlledOptions.
+const controlledShortOptions = "aofP"
+
+// valueShortOptions are the short options of youtube-dl and yt-dlp which take
+// a value, the rest of a bundle as "-rox" or else the next argument.
+const valueShortOptions = "2afINoPprRSu"
+
+// validate rejects the options the queue controls, see controlledOptions,
+// in any of the forms youtube-dl takes: "--output x", "--output=x",
+// an abbreviation as "--outp", and a short option with or without its value
+// attached, as "-ox",
+// or bundled after other short options, as "-xf best".
+func (p Parameters) validate() error {
+	for _, param := range p {
+		if strings.HasPrefix(param, "--") && len(param) > 2 {
+			name := strings.SplitN(param, "=", 2)[0]
+			if strings.HasPrefix(name, controlledOptionPrefix) {
+				return fmt.Errorf("option %s is set by the queue: %w", param, ErrInvalidParameter)
+			}
+
+			for _, option := range controlledOptions {
+				if strings.HasPrefix(option, name) && !abbreviatingOptions[name] {
+					return fmt.Errorf("option %s is set by the queue: %w", param, ErrInvalidParameter)
+				}
+			}
+			continue
+		}
+
+		if !strings.HasPrefix(param, "-") || param == "--" {
+			continue
+		}
+
+		for _, option := range param[1:] {
+			if strings.ContainsRune(controlledShortOptions, option) {
+				return fmt.Errorf("option %s is set by the queue: %w", param, ErrInvalidParameter)
+			}
+
+			// the rest of the bundle is the value of option
+			if strings.ContainsRune(valueShortOptions, option) {
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+func (p Parameters) equal(other Parameters) bool {
+	if len(p) != len(other) {
+		return false
+	}
+
+	for i := range p {
+		if p[i] != other[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// String quotes the parameters as ParseParameters reads them.
+func (p Parameters) String() string {
+	quoted := make([]string, len(p))
+	for i, param := range p {
+		quoted[i] = quoteParameter(param)
+	}
+
+	return strings.Join(quoted, " ")
+}
+
+func quoteParameter(param string) string {
+	if param != "" && strings.IndexFunc(param, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_=+,.:/@%", r))
+	}) < 0 {
+		return param
+	}
+
+	return "'" + strings.Replace(param, "'", `'\''`, -1) + "'"
+}
+
+// Value stores the parameters as a JSON array, [] for none.
+func (p Parameters) Value() (driver.Value, error) {
+	if p == nil {
+		p = Parameters{}
+	}
+
+	value, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+
+	return string(value), nil
+}
+
+func (p *Parameters) Scan(src interface{}) error {
+	var value []byte
+	switch src := src.(type) {
+	case []byte:
+		value = src
+	case string:
+		value = []byte(src)
+	default:
+		return fmt.Errorf("cannot scan %T into parameters.", src)
+	}
+
+	*p = Parameters{}
+
+	return json.Unmarshal(value, p)
+}
+
+// ParseParameters splits s into arguments as a POSIX shell does, without
+// expanding anything: words are separated by blanks, quoted by single or
+// double quotes, and a backslash escapes the next character, in double quotes
+// only $, `, ", \ and newline.
+// It returns an error wrapping ErrInvalidParameter for an unterminated quote.
+func ParseParameters(s string) (params Parameters, err error) {
+	params = Parameters{}
+
+	var word strings.Builder
+	inWord := false
+	var quote rune
+
+	runes := []rune(s)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+
+		switch {
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			} else if r == '\\' && i+1 < len(runes) && strings.ContainsRune("$`\"\\\n", runes[i+1]) {
+				i++
+				if runes[i] != '\n' {
+					word.WriteRune(runes[i])
+				}
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case r == '\\':
+			inWord = true
+			if i+1 < len(runes) {
+				i++
+				// an escaped newline continues the line
+				if runes[i] != '\n' {
+					word.WriteRune(runes[i])
+				}
+			}
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				params = append(params, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+
+	if quote != 0 {
+		return Parameters{}, fmt.Errorf("unterminated %c in %q: %w", quote, s, ErrInvalidParameter)
+	}
+
+	if inWord {
+		params = append(params, word.String())
+	}
+
+	return params, nil
+}
+
+// convertParameters converts the parameter strings of tasks and failed tasks
+// into Parameters. A task whose string cannot be parsed, whose parameters are
+// invalid or would duplicate another task, is moved into failed_tasks first.
+// A failed task keeps a string which cannot be parsed as the one argument
+// it was passed as, and is validated when it is requeued.
+func convertParameters(tx *sql.Tx) error {
+	type row struct {
+		id        int64
+		download  [4]string
+		parameter string
+	}
+
+	for _, table := range []string{"tasks", "failed_tasks"} {
+		rows, err := tx.Query(`SELECT id, video_id, video_format, audio_format, output_path, parameter FROM "` + table + `" ORDER BY id ASC`)
+		if err != nil {
+			return err
+		}
+
+		legacy := []row{}
+		for rows.Next() {
+			r := row{}
+			if err = rows.Scan(&r.id, &r.download[0], &r.download[1], &r.download[2], &r.download[3], &r.parameter); err != nil {
+				rows.Close()
+				return err
+			}
+			legacy = append(legacy, r)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		// the unique index of the downloads of tasks
+		converted := make(map[[5]string]int64)
+		for _, r := range legacy {
+			params, invalid := ParseParameters(r.parameter)
+			if invalid != nil {
+				params = Parameters{r.parameter}
+			} else {
+				invalid = params.validate()
+			}
+
+			value, _ := params.Value()
+			download := [5]string{r.download[0], r.download[1], r.download[2], r.download[3], value.(string)}
+			if duplicate, ok := converted[download]; table == "tasks" && invalid == nil && ok {
+				invalid = fmt.Errorf("parameters duplicate task %d: %w", duplicate, ErrInvalidParameter)
+			}
+
+			// converted with the failed tasks
+			if table == "tasks" && invalid != nil {
+				if err = failInvalidParameters(tx, r.id, invalid); err != nil {
+					return err
+				}
+				continue
+			}
+			converted[download] = r.id
+
+			if _, err = tx.Exec(`UPDATE "`+table+`" SET parameter = $1 WHERE id = $2`, value, r.id); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// failInvalidParameters moves the task of id into failed_tasks, recording
+// invalid as its log tail, in the schema convertParameters runs on.
+func failInvalidParameters(tx *sql.Tx, id int64, invalid error) error {
+	if _, err := tx.Exec(`INSERT INTO failed_tasks (id, video_id, video_format, audio_format, url, title, output_path, parameter, created_at, updated_at, started_at, failed_at, exit_code, reason, log_tail, attempts, downloader)
+		SELECT id, video_id, video_format, audio_format, url, title, output_path, parameter, created_at, updated_at, 0, $1, -1, $2, $3, attempts, downloader FROM tasks WHERE id = $4`,
+		time.Now().Unix(), ReasonInvalidParameters, invalid.Error(), id); err != nil {
+		return err
+	}
+
+	for _, table := range []string{"current_task", "task_progress", "tasks"} {
+		if _, err := tx.Exec(`DELETE FROM "`+table+`" WHERE id = $1`, id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
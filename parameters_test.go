@@ -0,0 +1,97 @@
+package queue
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseParameters(t *testing.T) {
+	cases := []struct {
+		s        string
+		expected Parameters
+	}{
+		{"", Parameters{}},
+		{"  --no-mtime  ", Parameters{"--no-mtime"}},
+		{"--write-sub --sub-lang en", Parameters{"--write-sub", "--sub-lang", "en"}},
+		{`--metadata-from-title "%(artist)s - %(title)s"`, Parameters{"--metadata-from-title", "%(artist)s - %(title)s"}},
+		{`--user-agent 'a "quoted" agent' ''`, Parameters{"--user-agent", `a "quoted" agent`, ""}},
+		{`"a \"b\" \$HOME \n" a\ b`, Parameters{`a "b" $HOME \n`, "a b"}},
+		{"$HOME `id` *", Parameters{"$HOME", "`id`", "*"}},
+		{"--a\\\n--b\t--c", Parameters{"--a--b", "--c"}},
+	}
+
+	for _, c := range cases {
+		params, err := ParseParameters(c.s)
+		if err != nil {
+			t.Fatalf("%q: %s", c.s, err)
+		}
+
+		if !params.equal(c.expected) {
+			t.Fatalf("%q: different parameters! %q", c.s, params)
+		}
+
+		// String quotes them back
+		if reparsed, err := ParseParameters(params.String()); err != nil || !reparsed.equal(params) {
+			t.Fatalf("%q: different quoted parameters! %s", c.s, params)
+		}
+	}
+
+	for _, s := range []string{`"unterminated`, `'unterminated`, `a "b' c`} {
+		if _, err := ParseParameters(s); !errors.Is(err, ErrInvalidParameter) {
+			t.Fatalf("%q: expected invalid parameter error, got %v", s, err)
+		}
+	}
+}
+
+func TestParametersValidate(t *testing.T) {
+	valid := Parameters{"--write-sub", "--sub-lang", "en", "-x", "--format-sort", "res", "--", "-", "--no-mtime", "%(title)s -o", "-rox", "-xS", "res,ext", "--netrc", "--print", "title"}
+	if err := valid.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, param := range []string{"-o", "-ofile", "-f", "-fbest", "--output", "--output=file", "--outp", "--format", "--form=best", "--ffmpeg-location", "--exec", "--exec=rm",
+		"--exec-before-download", "--exec-before-download=rm", "-xf", "-xfbest", "-wo", "-iwo/tmp/x",
+		"--config-location", "--config-locations=/tmp", "--use-postprocessor", "--use-postprocessor=Exec:rm", "--netrc-cmd", "-a", "-xa", "--batch-file",
+		"-P", "--paths", "--print-to-file", "--external-downloader", "--downloader", "--downloader-args"} {
+		if err := (Parameters{"--no-mtime", param, "value"}).validate(); !errors.Is(err, ErrInvalidParameter) {
+			t.Fatalf("%q: expected invalid parameter error, got %v", param, err)
+		}
+	}
+}
+
+func TestQueueTaskParameters(t *testing.T) {
+	InitializeForTest(t)
+
+	task := Task{
+		VideoFormat: "137",
+		AudioFormat: "140",
+		Url:         "https://www.youtube.com/watch?v=QueueTaskParameters",
+		OutputPath:  "/tmp/output",
+		Parameters:  Parameters{"--write-sub", "--sub-lang", "en"},
+	}
+	if err := task.QueueTask(); err != nil {
+		t.Fatal(err)
+	}
+
+	queued, err := GetTask(task.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !queued.Parameters.equal(task.Parameters) {
+		t.Fatalf("different parameters! %q", queued.Parameters)
+	}
+
+	// the same download with parameters in other words
+	task.Id = 0
+	task.Parameters = Parameters{"--write-sub --sub-lang en"}
+	if err := task.QueueTask(); err != nil {
+		t.Fatal(err)
+	}
+
+	task.Id = 0
+	task.Parameters = Parameters{"--exec", "rm {}"}
+	if err := task.QueueTask(); !errors.Is(err, ErrInvalidParameter) {
+		t.Fatalf("expected invalid parameter error, got %v", err)
+	}
+}
@@ -0,0 +1,379 @@
+package queue
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// postgresDSNForTest names a PostgreSQL database whose tables are dropped
+// by the tests, such as "postgres://localhost/youtube_dl_queue_test?sslmode=disable".
+// The PostgreSQL store is tested on fakePostgresDriver without it.
+var postgresDSNForTest = os.Getenv("YOUTUBE_DL_QUEUE_TEST_POSTGRES")
+
+// postgresStoreForTest returns an empty PostgreSQL store.
+func postgresStoreForTest(t *testing.T) Store {
+	if postgresDSNForTest == "" {
+		return fakePostgresStoreForTest(t)
+	}
+
+	testDb, err := sql.Open("postgres", postgresDSNForTest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	if _, err = testDb.Exec(`DROP TABLE IF EXISTS schema_version, current_task, tasks, task_progress, failed_tasks, finished_tasks, webhooks, webhook_deliveries`); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewPostgresStore(postgresDSNForTest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+// fakePostgresStoreForTest returns a PostgreSQL store on fakePostgresDriver.
+func fakePostgresStoreForTest(t *testing.T) Store {
+	sqlitePath, err := TempFileName()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// transactions take the write lock first, as rows are locked by FOR UPDATE
+	testDb, err := sql.Open("fake-postgres", sqlitePath+"?_txlock=immediate&_busy_timeout=5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	notifications := make(chan *pq.Notification, 16)
+	fakePostgresChannels.Store(sqlitePath, notifications)
+
+	s, err := newPostgresStore(testDb, notifications, closerFunc(func() error {
+		fakePostgresChannels.Delete(sqlitePath)
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
+
+// fakePostgresDriver runs the PostgreSQL dialect of the store on SQLite,
+// which takes $1 placeholders and ON CONFLICT clauses as they are.
+// NOTIFY is delivered to fakePostgresChannels at commit.
+type fakePostgresDriver struct{}
+
+// fakePostgresChannels are the notification channels by SQLite path.
+var fakePostgresChannels sync.Map
+
+func init() {
+	sql.Register("fake-postgres", fakePostgresDriver{})
+}
+
+func (fakePostgresDriver) Open(dsn string) (driver.Conn, error) {
+	conn, err := (&sqlite3.SQLiteDriver{}).Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fakePostgresConn{Conn: conn, path: strings.SplitN(dsn, "?", 2)[0]}, nil
+}
+
+type fakePostgresConn struct {
+	driver.Conn
+	path string
+	// notifications waiting for the commit of the transaction
+	pending int
+	inTx    bool
+}
+
+var fakePostgresRewrites = strings.NewReplacer(
+	"BIGSERIAL PRIMARY KEY", "INTEGER PRIMARY KEY AUTOINCREMENT",
+	" FOR UPDATE SKIP LOCKED", "",
+)
+
+func (c *fakePostgresConn) Prepare(query string) (driver.Stmt, error) {
+	if strings.HasPrefix(query, "NOTIFY ") {
+		return fakePostgresNotify{c}, nil
+	}
+
+	query = fakePostgresRewrites.Replace(query)
+
+	returning := strings.HasSuffix(query, " RETURNING id")
+	query = strings.TrimSuffix(query, " RETURNING id")
+
+	stmt, err := c.Conn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fakePostgresStmt{Stmt: stmt, returning: returning}, nil
+}
+
+func (c *fakePostgresConn) Begin() (driver.Tx, error) {
+	tx, err := c.Conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	c.inTx = true
+	c.pending = 0
+
+	return &fakePostgresTx{Tx: tx, conn: c}, nil
+}
+
+func (c *fakePostgresConn) deliver() {
+	notifications, ok := fakePostgresChannels.Load(c.path)
+	if !ok {
+		return
+	}
+
+	select {
+	case notifications.(chan *pq.Notification) <- &pq.Notification{Channel: postgresChannel}:
+	default:
+	}
+}
+
+type fakePostgresTx struct {
+	driver.Tx
+	conn *fakePostgresConn
+}
+
+func (tx *fakePostgresTx) Commit() error {
+	tx.conn.inTx = false
+
+	if err := tx.Tx.Commit(); err != nil {
+		return err
+	}
+
+	for ; tx.conn.pending > 0; tx.conn.pending-- {
+		tx.conn.deliver()
+	}
+
+	return nil
+}
+
+func (tx *fakePostgresTx) Rollback() error {
+	tx.conn.inTx = false
+	tx.conn.pending = 0
+
+	return tx.Tx.Rollback()
+}
+
+type fakePostgresNotify struct {
+	conn *fakePostgresConn
+}
+
+func (n fakePostgresNotify) Close() error {
+	return nil
+}
+
+func (n fakePostgresNotify) NumInput() int {
+	return 0
+}
+
+func (n fakePostgresNotify) Exec(args []driver.Value) (driver.Result, error) {
+	if n.conn.inTx {
+		n.conn.pending++
+	} else {
+		n.conn.deliver()
+	}
+
+	return driver.RowsAffected(0), nil
+}
+
+func (n fakePostgresNotify) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, driver.ErrSkip
+}
+
+// fakePostgresStmt returns the inserted id for RETURNING id,
+// which SQLite of this driver does not support.
+type fakePostgresStmt struct {
+	driver.Stmt
+	returning bool
+}
+
+func (s *fakePostgresStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if !s.returning {
+		return s.Stmt.Query(args)
+	}
+
+	result, err := s.Stmt.Exec(args)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := &fakePostgresRows{}
+	if inserted, err := result.RowsAffected(); err != nil || inserted == 0 {
+		return rows, err
+	}
+
+	id, err := result.LastInsertId()
+	rows.ids = []int64{id}
+
+	return rows, err
+}
+
+type fakePostgresRows struct {
+	ids []int64
+}
+
+func (r *fakePostgresRows) Columns() []string {
+	return []string{"id"}
+}
+
+func (r *fakePostgresRows) Close() error {
+	return nil
+}
+
+func (r *fakePostgresRows) Next(dest []driver.Value) error {
+	if len(r.ids) == 0 {
+		return io.EOF
+	}
+
+	dest[0] = r.ids[0]
+	r.ids = r.ids[1:]
+
+	return nil
+}
+
+func TestPostgresStoreClaimConcurrently(t *testing.T) {
+	s := postgresStoreForTest(t)
+	defer s.Close()
+
+	for i := 0; i < 20; i++ {
+		enqueueForTest(t, s, "PostgresClaim"+strconv.Itoa(i), int64(i))
+	}
+
+	var wg sync.WaitGroup
+	claimed := make(chan Task, 40)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(workerId string) {
+			defer wg.Done()
+
+			for {
+				tasks, err := s.Claim(workerId, 2)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if len(tasks) == 0 {
+					return
+				}
+				for _, task := range tasks {
+					claimed <- task
+				}
+			}
+		}("worker-" + strconv.Itoa(i))
+	}
+	wg.Wait()
+	close(claimed)
+
+	ids := map[int64]bool{}
+	for task := range claimed {
+		if ids[task.Id] {
+			t.Fatalf("task %d is claimed twice!", task.Id)
+		}
+		ids[task.Id] = true
+	}
+
+	if len(ids) != 20 {
+		t.Fatalf("different claimed size! %d", len(ids))
+	}
+
+	if leases, _ := s.ListLeases(); len(leases) != 20 {
+		t.Fatalf("different leases size! %d", len(leases))
+	}
+}
+
+func TestPostgresStoreNotified(t *testing.T) {
+	s := postgresStoreForTest(t)
+	defer s.Close()
+
+	notifier, ok := s.(Notifier)
+	if !ok {
+		t.Fatalf("postgres store is not a notifier!")
+	}
+
+	notified := notifier.Notified()
+	task := enqueueForTest(t, s, "PostgresNotified", 1)
+
+	select {
+	case <-notified:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("enqueue is not notified!")
+	}
+
+	tasks, err := s.Claim("worker-1", 1)
+	if err != nil || len(tasks) != 1 {
+		t.Fatalf("different claimed tasks! %+v %v", tasks, err)
+	}
+
+	notified = notifier.Notified()
+	if err := s.Release(task); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-notified:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("release is not notified!")
+	}
+}
+
+func TestWorkerWokenByStore(t *testing.T) {
+	InitializeForTest(t)
+	SetStore(postgresStoreForTest(t))
+
+	defaultQueue.SetDownloader(NewYoutubeDl(writeStubDownloaderForTest(t)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defaultQueue.work(ctx, ctx, "worker-1")
+	}()
+
+	// the worker finds the queue empty and waits
+	time.Sleep(100 * time.Millisecond)
+
+	// as queued by another process, which wakes this one only through the store
+	enqueueForTest(t, defaultQueue.store, "WokenByStore", time.Now().Unix())
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if tasks, _ := GetAllTasks(); len(tasks) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("worker is not woken!")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	<-done
+}
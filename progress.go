@@ -0,0 +1,351 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProgressPhase is what youtube-dl is doing for a task.
+type ProgressPhase string
+
+const (
+	PhasePreparing     ProgressPhase = "preparing"
+	PhaseDownloadVideo ProgressPhase = "download_video"
+	PhaseDownloadAudio ProgressPhase = "download_audio"
+	PhaseMerging       ProgressPhase = "merging"
+)
+
+var (
+	progressPersistInterval = 5 * time.Second
+
+	formatFileRegexp = regexp.MustCompile(`\.f([^./\\]+)\.\w+$`)
+
+	byteUnits = map[string]float64{
+		"B":   1,
+		"KB":  1000,
+		"MB":  1000 * 1000,
+		"GB":  1000 * 1000 * 1000,
+		"TB":  1000 * 1000 * 1000 * 1000,
+		"KiB": 1 << 10,
+		"MiB": 1 << 20,
+		"GiB": 1 << 30,
+		"TiB": 1 << 40,
+	}
+)
+
+// Progress is the latest download progress reported by youtube-dl for a task.
+type Progress struct {
+	Id              int64         `json:"id"`
+	Phase           ProgressPhase `json:"phase"`
+	Percent         float64       `json:"percent"`
+	DownloadedBytes int64         `json:"downloaded_bytes"`
+	TotalBytes      int64         `json:"total_bytes"`
+	Speed           int64         `json:"speed"` // bytes per second
+	Eta             int64         `json:"eta"`   // seconds
+	Filename        string        `json:"filename"`
+	UpdatedAt       int64         `json:"updated_at"`
+}
+
+// progressTracker parses the downloader output written into it.
+type progressTracker struct {
+	mutex        sync.Mutex
+	queue        *Queue
+	downloader   Downloader
+	task         Task
+	progress     Progress
+	buf          []byte
+	destinations int
+	publishedAt  time.Time
+	formatIds    []string
+	infoJsons    []string
+}
+
+func newProgressTracker(q *Queue, d Downloader, t *Task) *progressTracker {
+	return &progressTracker{
+		queue:      q,
+		downloader: d,
+		task:       *t,
+		progress: Progress{
+			Id:        t.Id,
+			Phase:     PhasePreparing,
+			UpdatedAt: time.Now().Unix(),
+		},
+	}
+}
+
+// Write splits output into lines on both newlines and carriage returns,
+// since youtube-dl redraws progress lines with carriage returns.
+func (pt *progressTracker) Write(p []byte) (int, error) {
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+
+	pt.buf = append(pt.buf, p...)
+
+	for {
+		i := strings.IndexAny(string(pt.buf), "\r\n")
+		if i < 0 {
+			break
+		}
+
+		phase := pt.progress.Phase
+		if pt.parseLine(strings.TrimSpace(string(pt.buf[:i]))) {
+			pt.publish(phase != pt.progress.Phase)
+		}
+		pt.buf = pt.buf[i+1:]
+	}
+
+	return len(p), nil
+}
+
+func (pt *progressTracker) Progress() Progress {
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+
+	return pt.progress
+}
+
+// FormatIds returns the ids of the formats downloaded so far,
+// as the downloader reported them or named their files.
+func (pt *progressTracker) FormatIds() []string {
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+
+	return append([]string{}, pt.formatIds...)
+}
+
+func (pt *progressTracker) addFormatIds(ids ...string) {
+	for _, id := range ids {
+		if !hasString(pt.formatIds, id) {
+			pt.formatIds = append(pt.formatIds, id)
+		}
+	}
+}
+
+// infoJson is the part of the info JSON of a video telling its formats,
+// as "137+140" when they are merged.
+type infoJson struct {
+	FormatId string `json:"format_id"`
+}
+
+// readInfoJsons adds the format ids in the info JSON files the downloader
+// wrote, removing the files unless keep.
+func (pt *progressTracker) readInfoJsons(keep bool) {
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+
+	for _, path := range pt.infoJsons {
+		if ids, err := readInfoJsonFormatIds(path); err != nil {
+			log.Println(err)
+		} else {
+			pt.addFormatIds(ids...)
+		}
+
+		if keep {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Println(err)
+		}
+	}
+}
+
+func readInfoJsonFormatIds(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var info infoJson
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if info.FormatId == "" {
+		return nil, nil
+	}
+
+	return strings.Split(info.FormatId, "+"), nil
+}
+
+func hasString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// publish sends a progress event, at most once per progressEventInterval
+// unless the phase changed.
+func (pt *progressTracker) publish(phaseChanged bool) {
+	if !phaseChanged && time.Since(pt.publishedAt) < progressEventInterval {
+		return
+	}
+
+	pt.publishedAt = time.Now()
+	progress := pt.progress
+	pt.queue.publish(Event{Type: EventProgress, Task: pt.task, Progress: &progress})
+}
+
+// parseLine updates the progress from a line of output
+// and reports whether the line changed it.
+func (pt *progressTracker) parseLine(line string) bool {
+	if line == "" {
+		return false
+	}
+
+	parsed, ok := pt.downloader.ParseProgress(line)
+	if !ok {
+		return false
+	}
+
+	// the file of each format is named after its id, as title.f137.mp4
+	if matches := formatFileRegexp.FindStringSubmatch(parsed.Filename); matches != nil && parsed.Kind != LineMerging && parsed.Kind != LineInfoJson {
+		pt.addFormatIds(matches[1])
+	}
+
+	switch parsed.Kind {
+	case LineFormats:
+		pt.addFormatIds(parsed.FormatIds...)
+		return false
+	case LineInfoJson:
+		pt.infoJsons = append(pt.infoJsons, parsed.Filename)
+		return false
+	case LineDestination:
+		pt.destinations += 1
+		pt.progress.Phase = pt.destinationPhase(parsed.Filename)
+		pt.progress.Filename = parsed.Filename
+		pt.progress.Percent = 0
+		pt.progress.DownloadedBytes = 0
+		pt.progress.TotalBytes = 0
+		pt.progress.Speed = 0
+		pt.progress.Eta = 0
+	case LineDownloaded:
+		pt.progress.Filename = parsed.Filename
+	case LineMerging:
+		pt.progress.Phase = PhaseMerging
+		pt.progress.Filename = parsed.Filename
+		pt.progress.Speed = 0
+		pt.progress.Eta = 0
+	case LineDownload:
+		if pt.progress.Phase == PhasePreparing {
+			pt.progress.Phase = PhaseDownloadVideo
+		}
+		pt.progress.Percent = parsed.Percent
+		pt.progress.TotalBytes = parsed.TotalBytes
+		pt.progress.DownloadedBytes = parsed.DownloadedBytes
+		pt.progress.Speed = parsed.Speed
+		pt.progress.Eta = parsed.Eta
+	default:
+		return false
+	}
+	pt.progress.UpdatedAt = time.Now().Unix()
+
+	return true
+}
+
+// destinationPhase tells video from audio by the format id in the file name
+// (title.f137.mp4), falling back to the order youtube-dl downloads them in.
+func (pt *progressTracker) destinationPhase(destination string) ProgressPhase {
+	switch {
+	case pt.task.VideoFormat != "" && strings.Contains(destination, ".f"+pt.task.VideoFormat+"."):
+		return PhaseDownloadVideo
+	case pt.task.AudioFormat != "" && strings.Contains(destination, ".f"+pt.task.AudioFormat+"."):
+		return PhaseDownloadAudio
+	case pt.task.AudioFormat != "" && pt.task.VideoFormat == "":
+		return PhaseDownloadAudio
+	case pt.destinations > 1:
+		return PhaseDownloadAudio
+	default:
+		return PhaseDownloadVideo
+	}
+}
+
+func parseBytes(value string, unit string) int64 {
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0
+	}
+
+	return int64(v * byteUnits[unit])
+}
+
+// parseEta converts [[hh:]mm:]ss into seconds.
+func parseEta(eta string) (seconds int64) {
+	for _, part := range strings.Split(eta, ":") {
+		v, err := strconv.ParseInt(part, 10, 64)
+		if err != nil {
+			return 0
+		}
+		seconds = seconds*60 + v
+	}
+
+	return seconds
+}
+
+func (q *Queue) registerProgress(tracker *progressTracker) {
+	q.runningProgressesMutex.Lock()
+	defer q.runningProgressesMutex.Unlock()
+
+	q.runningProgresses[tracker.progress.Id] = tracker
+}
+
+func (q *Queue) unregisterProgress(tracker *progressTracker) {
+	q.runningProgressesMutex.Lock()
+	defer q.runningProgressesMutex.Unlock()
+
+	if q.runningProgresses[tracker.progress.Id] == tracker {
+		delete(q.runningProgresses, tracker.progress.Id)
+	}
+}
+
+// persistProgress saves the progress of tracker every progressPersistInterval until ctx is done.
+func (q *Queue) persistProgress(ctx context.Context, tracker *progressTracker) {
+	ticker := time.NewTicker(progressPersistInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := q.saveProgress(tracker.Progress()); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func (q *Queue) saveProgress(progress Progress) error {
+	return q.store.SaveProgress(progress)
+}
+
+// GetTaskProgress returns the progress of a running task, from memory when the
+// task runs in this process and from the store otherwise.
+// It returns sql.ErrNoRows when no progress is known.
+func GetTaskProgress(id int64) (progress Progress, err error) {
+	return defaultQueue.GetTaskProgress(id)
+}
+
+func (q *Queue) GetTaskProgress(id int64) (progress Progress, err error) {
+	q.runningProgressesMutex.Lock()
+	tracker, ok := q.runningProgresses[id]
+	q.runningProgressesMutex.Unlock()
+
+	if ok {
+		return tracker.Progress(), nil
+	}
+
+	return q.store.GetProgress(id)
+}
@@ -0,0 +1,132 @@
+package queue
+
+import (
+	"database/sql"
+	"testing"
+)
+
+func TestProgressTrackerParseLine(t *testing.T) {
+	tests := []struct {
+		line     string
+		percent  float64
+		total    int64
+		speed    int64
+		eta      int64
+		download int64
+	}{
+		{"[download]  42.3% of 120.5MiB at 2.1MiB/s ETA 00:40", 42.3, 126353408, 2202009, 40, 53447491},
+		{"[download]   0.0% of 120.50MiB at 50.00KiB/s ETA 41:07", 0, 126353408, 51200, 2467, 0},
+		{"[download]  10.0% of ~1.00GiB at  1.00MiB/s ETA 01:02:03", 10, 1073741824, 1048576, 3723, 107374182},
+		{"[download]  42.3% of 100.00B at Unknown speed ETA Unknown ETA", 42.3, 100, 0, 0, 42},
+		{"[download] 100% of 120.50MiB in 00:57", 100, 126353408, 0, 0, 126353408},
+		{"[download]  42.3% of  120.50MiB at    2.10MiB/s ETA 00:40 (frag 3/10)", 42.3, 126353408, 2202009, 40, 53447491},
+	}
+
+	for _, test := range tests {
+		tracker := newProgressTracker(defaultQueue, NewYoutubeDl(""), &Task{VideoId: "ParseLine"})
+		tracker.parseLine(test.line)
+		progress := tracker.Progress()
+
+		if progress.Percent != test.percent || progress.TotalBytes != test.total || progress.Speed != test.speed || progress.Eta != test.eta || progress.DownloadedBytes != test.download {
+			t.Errorf("%q: unexpected progress %+v", test.line, progress)
+		}
+	}
+}
+
+func TestProgressTrackerPhases(t *testing.T) {
+	tracker := newProgressTracker(defaultQueue, NewYoutubeDl(""), &Task{VideoId: "Phases", VideoFormat: "137", AudioFormat: "140"})
+
+	if tracker.Progress().Phase != PhasePreparing {
+		t.Fatalf("different phase! %s", tracker.Progress().Phase)
+	}
+
+	steps := []struct {
+		output string
+		phase  ProgressPhase
+	}{
+		{"[youtube] abcdefg: Downloading webpage\n", PhasePreparing},
+		{"[download] Destination: title.f137.mp4\n", PhaseDownloadVideo},
+		{"[download]  10.0% of 10.00MiB at 1.00MiB/s ETA 00:09\r[download]  50.0% of 10.00MiB", PhaseDownloadVideo},
+		// the rest of a line split across writes
+		{" at 1.00MiB/s ETA 00:05\r", PhaseDownloadVideo},
+		{"[download] Destination: title.f140.m4a\n", PhaseDownloadAudio},
+		{"[download]  30.0% of 2.00MiB at 1.00MiB/s ETA 00:01\r", PhaseDownloadAudio},
+		{"[ffmpeg] Merging formats into \"title.mp4\"\n", PhaseMerging},
+	}
+
+	for _, step := range steps {
+		tracker.Write([]byte(step.output))
+		if phase := tracker.Progress().Phase; phase != step.phase {
+			t.Fatalf("%q: expected %s, got %s", step.output, step.phase, phase)
+		}
+	}
+
+	if filename := tracker.Progress().Filename; filename != "title.mp4" {
+		t.Fatalf("different filename! %s", filename)
+	}
+
+	tracker = newProgressTracker(defaultQueue, NewYoutubeDl(""), &Task{VideoId: "Phases"})
+	tracker.Write([]byte("[download]  50.0% of 10.00MiB at 1.00MiB/s ETA 00:05\r"))
+	if tracker.Progress().Percent != 50 {
+		t.Fatalf("different percent! %f", tracker.Progress().Percent)
+	}
+
+	tracker.Write([]byte("[download] Destination: first.mp4\n[download] Destination: second.m4a\n"))
+	if phase := tracker.Progress().Phase; phase != PhaseDownloadAudio {
+		t.Fatalf("second destination is not audio! %s", phase)
+	}
+
+	if tracker.Progress().Percent != 0 {
+		t.Fatalf("percent is not reset!")
+	}
+}
+
+func TestGetTaskProgress(t *testing.T) {
+	InitializeForTest(t)
+
+	task := &Task{Id: 1, VideoId: "GetTaskProgress", VideoFormat: "137", AudioFormat: "140"}
+	if _, err := GetTaskProgress(task.Id); err != sql.ErrNoRows {
+		t.Fatalf("expected no rows, got %v", err)
+	}
+
+	tracker := newProgressTracker(defaultQueue, NewYoutubeDl(""), task)
+	tracker.Write([]byte("[download]  42.3% of 120.5MiB at 2.1MiB/s ETA 00:40\r"))
+
+	defaultQueue.registerProgress(tracker)
+
+	progress, err := GetTaskProgress(task.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if progress.Percent != 42.3 {
+		t.Fatalf("different running progress! %+v", progress)
+	}
+
+	if err := defaultQueue.saveProgress(tracker.Progress()); err != nil {
+		t.Fatal(err)
+	}
+
+	defaultQueue.unregisterProgress(tracker)
+
+	progress, err = GetTaskProgress(task.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := GetTaskProgress(task.Id + 1); err != sql.ErrNoRows {
+		t.Fatalf("progress of another task! %v", err)
+	}
+
+	if progress.Percent != 42.3 || progress.Phase != PhaseDownloadVideo || progress.Eta != 40 {
+		t.Fatalf("different persisted progress! %+v", progress)
+	}
+
+	if err := defaultQueue.store.Release(*task); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := GetTaskProgress(task.Id); err != sql.ErrNoRows {
+		t.Fatalf("progress is not released! %v", err)
+	}
+}
@@ -0,0 +1,386 @@
+package queue
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidQuery = errors.New("task query is invalid.")
+
+// TaskStatus is where a task is in the queue.
+type TaskStatus string
+
+const (
+	// TaskQueued tasks are waiting for a worker.
+	TaskQueued TaskStatus = "queued"
+	// TaskRetrying tasks failed and wait for their next attempt.
+	TaskRetrying TaskStatus = "retrying"
+	TaskRunning  TaskStatus = "running"
+)
+
+// TaskOrder is the field tasks are sorted by. Tasks of the same value
+// are sorted by job id in the same direction.
+type TaskOrder string
+
+const (
+	OrderByCreatedAt TaskOrder = "created_at"
+	OrderByUpdatedAt TaskOrder = "updated_at"
+	OrderByStartedAt TaskOrder = "started_at"
+	OrderByTitle     TaskOrder = "title"
+	OrderById        TaskOrder = "id"
+)
+
+// TaskQuery selects tasks matching all of its filters. Empty filters match
+// any task. Time ranges are unix seconds, After inclusive and Before exclusive,
+// and a started range matches started tasks only.
+type TaskQuery struct {
+	Ids          []int64
+	VideoIds     []string
+	Statuses     []TaskStatus
+	VideoFormats []string
+	AudioFormats []string
+
+	CreatedAfter  int64
+	CreatedBefore int64
+	StartedAfter  int64
+	StartedBefore int64
+
+	// Title matches titles containing it, ignoring case.
+	Title string
+
+	// OrderBy is OrderByCreatedAt by default, the latest first
+	// unless Ascending.
+	OrderBy   TaskOrder
+	Ascending bool
+
+	// Limit is 0 for no limit.
+	Limit  int
+	Offset int
+}
+
+func (query TaskQuery) validate() error {
+	for _, status := range query.Statuses {
+		if status != TaskQueued && status != TaskRetrying && status != TaskRunning {
+			return fmt.Errorf("unknown task status %q: %w", status, ErrInvalidQuery)
+		}
+	}
+
+	if _, ok := taskOrderColumns[query.OrderBy]; !ok {
+		return fmt.Errorf("cannot order tasks by %q: %w", query.OrderBy, ErrInvalidQuery)
+	}
+
+	if query.Limit < 0 || query.Offset < 0 {
+		return fmt.Errorf("limit and offset must not be negative: %w", ErrInvalidQuery)
+	}
+
+	return nil
+}
+
+var taskOrderColumns = map[TaskOrder]string{
+	"":               "created_at",
+	OrderByCreatedAt: "created_at",
+	OrderByUpdatedAt: "updated_at",
+	OrderByStartedAt: "started_at",
+	OrderByTitle:     "title",
+	OrderById:        "id",
+}
+
+// taskQuerySql builds the SELECT of query, with $1 placeholders which both
+// SQLite and PostgreSQL take. Statuses are evaluated at now.
+func taskQuerySql(query TaskQuery, now int64) (string, []interface{}) {
+	conditions := []string{}
+	args := []interface{}{}
+
+	placeholder := func(arg interface{}) string {
+		args = append(args, arg)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	in := func(column string, values []interface{}) {
+		if len(values) == 0 {
+			return
+		}
+
+		placeholders := make([]string, len(values))
+		for i, value := range values {
+			placeholders[i] = placeholder(value)
+		}
+		conditions = append(conditions, column+" IN ("+strings.Join(placeholders, ", ")+")")
+	}
+
+	ids := make([]interface{}, len(query.Ids))
+	for i, id := range query.Ids {
+		ids[i] = id
+	}
+	in("id", ids)
+	in("video_id", stringValues(query.VideoIds))
+	in("video_format", stringValues(query.VideoFormats))
+	in("audio_format", stringValues(query.AudioFormats))
+
+	if len(query.Statuses) > 0 {
+		statuses := []string{}
+		for _, status := range query.Statuses {
+			switch status {
+			case TaskQueued:
+				statuses = append(statuses, "(started_at = 0 AND next_attempt_at <= "+placeholder(now)+")")
+			case TaskRetrying:
+				statuses = append(statuses, "(started_at = 0 AND next_attempt_at > "+placeholder(now)+")")
+			case TaskRunning:
+				statuses = append(statuses, "started_at != 0")
+			}
+		}
+		conditions = append(conditions, "("+strings.Join(statuses, " OR ")+")")
+	}
+
+	if query.CreatedAfter != 0 {
+		conditions = append(conditions, "created_at >= "+placeholder(query.CreatedAfter))
+	}
+	if query.CreatedBefore != 0 {
+		conditions = append(conditions, "created_at < "+placeholder(query.CreatedBefore))
+	}
+	if query.StartedAfter != 0 || query.StartedBefore != 0 {
+		conditions = append(conditions, "started_at != 0")
+	}
+	if query.StartedAfter != 0 {
+		conditions = append(conditions, "started_at >= "+placeholder(query.StartedAfter))
+	}
+	if query.StartedBefore != 0 {
+		conditions = append(conditions, "started_at < "+placeholder(query.StartedBefore))
+	}
+
+	if query.Title != "" {
+		conditions = append(conditions, `LOWER(title) LIKE `+placeholder("%"+escapeLike(strings.ToLower(query.Title))+"%")+` ESCAPE '\'`)
+	}
+
+	sql := "SELECT * FROM tasks"
+	if len(conditions) > 0 {
+		sql += " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	direction := " DESC"
+	if query.Ascending {
+		direction = " ASC"
+	}
+	sql += " ORDER BY " + taskOrderColumns[query.OrderBy] + direction + ", id" + direction
+
+	if query.Limit > 0 || query.Offset > 0 {
+		limit := int64(query.Limit)
+		if limit == 0 {
+			limit = math.MaxInt64
+		}
+		sql += " LIMIT " + placeholder(limit) + " OFFSET " + placeholder(int64(query.Offset))
+	}
+
+	return sql, args
+}
+
+func stringValues(values []string) []interface{} {
+	args := make([]interface{}, len(values))
+	for i, value := range values {
+		args[i] = value
+	}
+
+	return args
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
+
+// scanTasks reads the rows of SELECT * FROM tasks.
+func scanTasks(rows *sql.Rows) (tasks []Task, err error) {
+	tasks = []Task{}
+
+	defer rows.Close()
+	for rows.Next() {
+		task := Task{}
+		err = rows.Scan(
+			&task.Id,
+			&task.VideoId,
+			&task.VideoFormat,
+			&task.AudioFormat,
+			&task.Url,
+			&task.Title,
+			&task.OutputPath,
+			&task.Parameters,
+			&task.CreatedAt,
+			&task.UpdatedAt,
+			&task.StartedAt,
+			&task.Attempts,
+			&task.NextAttemptAt,
+			&task.Downloader,
+			&task.Options,
+			&task.Format,
+		)
+		if err != nil {
+			return []Task{}, err
+		}
+		tasks = append(tasks, task)
+	}
+
+	return tasks, rows.Err()
+}
+
+// matches is the WHERE of taskQuerySql for stores without SQL.
+func (query TaskQuery) matches(t Task, now int64) bool {
+	if len(query.Ids) > 0 {
+		found := false
+		for _, id := range query.Ids {
+			found = found || id == t.Id
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if !containsString(query.VideoIds, t.VideoId) || !containsString(query.VideoFormats, t.VideoFormat) || !containsString(query.AudioFormats, t.AudioFormat) {
+		return false
+	}
+
+	if len(query.Statuses) > 0 {
+		found := false
+		for _, status := range query.Statuses {
+			found = found || status == t.status(now)
+		}
+		if !found {
+			return false
+		}
+	}
+
+	switch {
+	case query.CreatedAfter != 0 && t.CreatedAt < query.CreatedAfter:
+		return false
+	case query.CreatedBefore != 0 && t.CreatedAt >= query.CreatedBefore:
+		return false
+	case (query.StartedAfter != 0 || query.StartedBefore != 0) && t.StartedAt == 0:
+		return false
+	case query.StartedAfter != 0 && t.StartedAt < query.StartedAfter:
+		return false
+	case query.StartedBefore != 0 && t.StartedAt >= query.StartedBefore:
+		return false
+	}
+
+	return strings.Contains(strings.ToLower(t.Title), strings.ToLower(query.Title))
+}
+
+// containsString reports whether values contain value, or are empty.
+func containsString(values []string, value string) bool {
+	if len(values) == 0 {
+		return true
+	}
+
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (t Task) status(now int64) TaskStatus {
+	switch {
+	case t.StartedAt != 0:
+		return TaskRunning
+	case t.NextAttemptAt > now:
+		return TaskRetrying
+	default:
+		return TaskQueued
+	}
+}
+
+// sortAndPage is the ORDER BY and LIMIT of taskQuerySql for stores without SQL.
+func (query TaskQuery) sortAndPage(tasks []Task) []Task {
+	key := func(t Task) int64 {
+		switch query.OrderBy {
+		case OrderByUpdatedAt:
+			return t.UpdatedAt
+		case OrderByStartedAt:
+			return t.StartedAt
+		case OrderById:
+			return t.Id
+		default:
+			return t.CreatedAt
+		}
+	}
+
+	sort.Slice(tasks, func(i, j int) bool {
+		less := tasks[i].Id < tasks[j].Id
+		if query.OrderBy == OrderByTitle && tasks[i].Title != tasks[j].Title {
+			less = tasks[i].Title < tasks[j].Title
+		} else if query.OrderBy != OrderByTitle && key(tasks[i]) != key(tasks[j]) {
+			less = key(tasks[i]) < key(tasks[j])
+		}
+
+		if query.Ascending {
+			return less
+		}
+		return !less
+	})
+
+	if query.Offset >= len(tasks) {
+		return []Task{}
+	}
+	tasks = tasks[query.Offset:]
+
+	if query.Limit > 0 && query.Limit < len(tasks) {
+		tasks = tasks[:query.Limit]
+	}
+
+	return tasks
+}
+
+// QueryTasks returns the tasks of the default queue matching query.
+// It returns an error wrapping ErrInvalidQuery for an invalid query.
+func QueryTasks(query TaskQuery) (tasks []Task, err error) {
+	return defaultQueue.QueryTasks(query)
+}
+
+func (q *Queue) QueryTasks(query TaskQuery) (tasks []Task, err error) {
+	if err = query.validate(); err != nil {
+		return []Task{}, err
+	}
+
+	return q.store.Query(query, time.Now().Unix())
+}
+
+// QueryTasksMap is QueryTasks keyed by job id.
+func QueryTasksMap(query TaskQuery) (tasks map[int64]Task, err error) {
+	return defaultQueue.QueryTasksMap(query)
+}
+
+func (q *Queue) QueryTasksMap(query TaskQuery) (tasks map[int64]Task, err error) {
+	list, err := q.QueryTasks(query)
+	if err != nil {
+		return map[int64]Task{}, err
+	}
+
+	tasks = make(map[int64]Task, len(list))
+	for _, task := range list {
+		tasks[task.Id] = task
+	}
+
+	return tasks, nil
+}
+
+// GetTasksMapByIds returns the tasks of the job ids, keyed by job id.
+// Job ids of no task are missing from the map.
+func GetTasksMapByIds(ids []int64) (tasks map[int64]Task, err error) {
+	return defaultQueue.GetTasksMapByIds(ids)
+}
+
+func (q *Queue) GetTasksMapByIds(ids []int64) (tasks map[int64]Task, err error) {
+	if len(ids) == 0 {
+		return map[int64]Task{}, nil
+	}
+
+	return q.QueryTasksMap(TaskQuery{Ids: ids})
+}
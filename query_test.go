@@ -0,0 +1,184 @@
+package queue
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func taskIdsForTest(tasks []Task) []int64 {
+	ids := []int64{}
+	for _, task := range tasks {
+		ids = append(ids, task.Id)
+	}
+
+	return ids
+}
+
+func equalIdsForTest(tasks []Task, expected ...int64) bool {
+	ids := taskIdsForTest(tasks)
+	if len(ids) != len(expected) {
+		return false
+	}
+
+	for i := range ids {
+		if ids[i] != expected[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestStoreQuery(t *testing.T) {
+	now := time.Now().Unix()
+
+	for name, s := range storesForTest(t) {
+		first := enqueueForTest(t, s, "StoreQuery1", 100)
+		second := enqueueForTest(t, s, "StoreQuery2", 200)
+		third := enqueueForTest(t, s, "StoreQuery3", 300)
+
+		fourth := Task{
+			VideoId:     "StoreQuery1",
+			VideoFormat: "22",
+			AudioFormat: "140",
+			Url:         "https://www.youtube.com/watch?v=StoreQuery1",
+			Title:       "100%_Query",
+			OutputPath:  "/tmp/output",
+			CreatedAt:   400,
+			UpdatedAt:   400,
+		}
+		if err := s.Enqueue(&fourth); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.MarkStarted(second.Id, 250); err != nil {
+			t.Fatal(err)
+		}
+
+		third.Attempts = 1
+		third.NextAttemptAt = now + 3600
+		if err := s.Release(third); err != nil {
+			t.Fatal(err)
+		}
+
+		cases := []struct {
+			query    TaskQuery
+			expected []int64
+		}{
+			{TaskQuery{}, []int64{fourth.Id, third.Id, second.Id, first.Id}},
+			{TaskQuery{Ids: []int64{first.Id, third.Id, fourth.Id + 1}}, []int64{third.Id, first.Id}},
+			{TaskQuery{VideoIds: []string{"StoreQuery1"}}, []int64{fourth.Id, first.Id}},
+			{TaskQuery{Statuses: []TaskStatus{TaskQueued}}, []int64{fourth.Id, first.Id}},
+			{TaskQuery{Statuses: []TaskStatus{TaskRetrying}}, []int64{third.Id}},
+			{TaskQuery{Statuses: []TaskStatus{TaskRunning, TaskRetrying}}, []int64{third.Id, second.Id}},
+			{TaskQuery{VideoFormats: []string{"22"}}, []int64{fourth.Id}},
+			{TaskQuery{AudioFormats: []string{"140"}, VideoFormats: []string{"137"}}, []int64{third.Id, second.Id, first.Id}},
+			{TaskQuery{CreatedAfter: 200, CreatedBefore: 400}, []int64{third.Id, second.Id}},
+			{TaskQuery{StartedBefore: 300}, []int64{second.Id}},
+			{TaskQuery{StartedAfter: 300}, []int64{}},
+			{TaskQuery{Title: "storequery"}, []int64{third.Id, second.Id, first.Id}},
+			{TaskQuery{Title: "%_"}, []int64{fourth.Id}},
+			{TaskQuery{Title: "y_Q"}, []int64{}},
+			{TaskQuery{Ascending: true}, []int64{first.Id, second.Id, third.Id, fourth.Id}},
+			{TaskQuery{OrderBy: OrderByTitle, Ascending: true}, []int64{fourth.Id, first.Id, second.Id, third.Id}},
+			{TaskQuery{OrderBy: OrderByStartedAt, Limit: 2}, []int64{second.Id, fourth.Id}},
+			{TaskQuery{Limit: 2, Offset: 1}, []int64{third.Id, second.Id}},
+			{TaskQuery{Offset: 3}, []int64{first.Id}},
+			{TaskQuery{Offset: 4}, []int64{}},
+		}
+
+		for _, c := range cases {
+			tasks, err := s.Query(c.query, now)
+			if err != nil {
+				t.Fatalf("%s: %+v: %s", name, c.query, err)
+			}
+
+			if !equalIdsForTest(tasks, c.expected...) {
+				t.Fatalf("%s: %+v: different tasks! %v expected %v", name, c.query, taskIdsForTest(tasks), c.expected)
+			}
+		}
+
+		s.Close()
+	}
+}
+
+func TestQueryTasks(t *testing.T) {
+	InitializeForTest(t)
+
+	first := insertTaskForTest(t, Task{
+		VideoFormat: "135",
+		AudioFormat: "140",
+		Url:         "https://www.youtube.com/watch?v=QueryTasks",
+		Title:       "TestQueryTasks",
+		OutputPath:  "/tmp/output",
+	})
+	second := insertTaskForTest(t, Task{
+		VideoFormat: "137",
+		AudioFormat: "140",
+		Url:         "https://www.youtube.com/watch?v=QueryTasks",
+		Title:       "TestQueryTasks",
+		OutputPath:  "/tmp/output",
+	})
+
+	tasks, err := QueryTasks(TaskQuery{VideoFormats: []string{"137"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !equalIdsForTest(tasks, second.Id) {
+		t.Fatalf("different tasks! %v", taskIdsForTest(tasks))
+	}
+
+	tasksMap, err := QueryTasksMap(TaskQuery{VideoIds: []string{"QueryTasks"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tasksMap) != 2 || tasksMap[first.Id].VideoFormat != "135" || tasksMap[second.Id].VideoFormat != "137" {
+		t.Fatalf("different tasks map! %+v", tasksMap)
+	}
+
+	for _, query := range []TaskQuery{
+		{Statuses: []TaskStatus{"finished"}},
+		{OrderBy: "video_id"},
+		{Limit: -1},
+		{Offset: -1},
+	} {
+		if _, err := QueryTasks(query); !errors.Is(err, ErrInvalidQuery) {
+			t.Fatalf("%+v: expected invalid query error, got %v", query, err)
+		}
+	}
+}
+
+func TestGetTasksMapByIds(t *testing.T) {
+	InitializeForTest(t)
+
+	first := insertTaskForTest(t, Task{
+		VideoFormat: "135",
+		AudioFormat: "140",
+		Url:         "https://www.youtube.com/watch?v=TasksMapByIds",
+		Title:       "TestGetTasksMapByIds",
+		OutputPath:  "/tmp/output",
+	})
+	second := insertTaskForTest(t, Task{
+		VideoFormat: "135",
+		AudioFormat: "140",
+		Url:         "https://www.youtube.com/watch?v=TasksMapByIds2",
+		Title:       "TestGetTasksMapByIds",
+		OutputPath:  "/tmp/output",
+	})
+
+	tasks, err := GetTasksMapByIds([]int64{first.Id, second.Id, second.Id + 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tasks) != 2 || tasks[first.Id].VideoId != "TasksMapByIds" || tasks[second.Id].VideoId != "TasksMapByIds2" {
+		t.Fatalf("different tasks map! %+v", tasks)
+	}
+
+	if tasks, err := GetTasksMapByIds([]int64{}); err != nil || len(tasks) != 0 {
+		t.Fatalf("different tasks map of no ids! %+v %v", tasks, err)
+	}
+}
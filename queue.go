@@ -1,59 +1,508 @@
 package queue
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"log"
+	"net"
+	"os"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/satom9to5/pidfile"
 )
 
+// Queue downloads the tasks of its store with its own workers, so that one
+// process can run several queues, such as one for podcasts and one for 4K
+// videos. The package-level functions work on the default queue.
+type Queue struct {
+	store Store
+
+	// runs tasks selecting no downloader, among downloaders by name
+	downloader  Downloader
+	downloaders map[string]Downloader
+
+	// ffmpeg is the one found by Start for ffmpegPath, see SetFFmpegPath
+	ffmpegPath      string
+	ffmpeg          string
+	logDirectory    string
+	pidfilePath     string
+	stopGracePeriod time.Duration
+	workerIdentity  string
+	notifyDirectory string
+
+	// tells the queues of a process apart, 0 for the default queue
+	instance int
+
+	workerNum      int
+	workerNumMutex sync.Mutex
+	resizeWorkers  chan struct{}
+
+	retryPolicy      RetryPolicy
+	retryPolicyMutex sync.Mutex
+
+	pollInterval      time.Duration
+	pollIntervalMutex sync.Mutex
+
+	// starting and workerIdentity are read by GetWorkerStatus
+	// while Start and Stop write them
+	starting       bool
+	startingMutex  sync.Mutex
+	dispatch       func(ctx context.Context, taskCtx context.Context) error
+	cancelDispatch context.CancelFunc
+	killTasks      context.CancelFunc
+	dispatchDone   chan struct{}
+	stopWebhooks   context.CancelFunc
+	webhooksDone   chan struct{}
+	webhookOutbox  *webhookOutbox
+
+	// workers of this queue wait on wakeups when the queue is empty
+	wakeups          *announcer
+	wakeupListener   *net.UnixConn
+	wakeupSocketPath string
+
+	subscriptions      map[*Subscription]struct{}
+	subscriptionsMutex sync.RWMutex
+
+	runningProgresses      map[int64]*progressTracker
+	runningProgressesMutex sync.Mutex
+}
+
+// Options configure a queue created by New. Zero values take the defaults.
+type Options struct {
+	// Store is required, see NewSQLiteStore, NewPostgresStore and NewMemoryStore.
+	// Stop closes it.
+	Store Store
+	// Downloader runs the tasks selecting no other downloader, and is
+	// youtube-dl at YoutubeDlPath by default. One of them is required to Start.
+	Downloader    Downloader
+	YoutubeDlPath string
+	// Downloaders are the others tasks can select by name.
+	Downloaders []Downloader
+	// FFmpegPath is the ffmpeg merging formats, looked up in $PATH by default,
+	// or NoFFmpeg for none. Start validates it, see SetFFmpegPath.
+	FFmpegPath string
+	// LogDirectory holds the youtube-dl log of each task, ./log by default.
+	LogDirectory string
+	// PidfilePath guards the queue against another process, see Start.
+	// Only one queue of a process can have a pidfile.
+	PidfilePath string
+	// WorkerNum is 1 by default.
+	WorkerNum int
+	// WorkerIdentity is hostname:pid followed by the number of the queue
+	// in the process by default.
+	WorkerIdentity string
+	// StopGracePeriod is 30 seconds by default.
+	StopGracePeriod time.Duration
+	// PollInterval is a minute by default.
+	PollInterval time.Duration
+	// NotifyDirectory is empty to wake only the workers of this process,
+	// see SetNotifyDirectory.
+	NotifyDirectory string
+	// RetryPolicy is 3 attempts backing off from a minute by default.
+	RetryPolicy *RetryPolicy
+}
+
 var (
-	youtubeDlPath string
-	ffmpegPath    string
-	logDirectory  = "./log"
-	starting      = false
-	workerNum     = 1
-	dispatch      = runWorker
+	defaultQueue = newQueue()
+
+	// queues created by New in this process
+	queueInstances int32
 )
 
-func Start(varDB *sql.DB, pidfilePath string, varYoutubeDlPath string, varFFmpegPath string) (pid int, err error) {
-	if starting {
-		return pid, errors.New("worker is already start.")
+func newQueue() *Queue {
+	q := &Queue{
+		logDirectory:    "./log",
+		stopGracePeriod: 30 * time.Second,
+		workerNum:       1,
+		resizeWorkers:   make(chan struct{}, 1),
+		retryPolicy: RetryPolicy{
+			MaxAttempts: 3,
+			BaseDelay:   time.Minute,
+			MaxDelay:    time.Hour,
+			Jitter:      0.2,
+		},
+		downloaders:       make(map[string]Downloader),
+		pollInterval:      time.Minute,
+		wakeups:           newAnnouncer(),
+		subscriptions:     make(map[*Subscription]struct{}),
+		webhookOutbox:     newWebhookOutbox(),
+		runningProgresses: make(map[int64]*progressTracker),
+	}
+	q.dispatch = q.runWorker
+
+	return q
+}
+
+// New returns a queue on options.Store, which is started by Start.
+func New(options Options) (*Queue, error) {
+	if options.Store == nil {
+		return nil, errors.New("store is required.")
+	}
+
+	q := newQueue()
+	q.instance = int(atomic.AddInt32(&queueInstances, 1))
+	q.store = options.Store
+	for _, d := range options.Downloaders {
+		q.AddDownloader(d)
+	}
+	if options.Downloader != nil {
+		q.SetDownloader(options.Downloader)
+	} else if options.YoutubeDlPath != "" {
+		q.SetDownloader(NewYoutubeDl(options.YoutubeDlPath))
 	}
+	q.ffmpegPath = options.FFmpegPath
+	q.pidfilePath = options.PidfilePath
+	q.workerIdentity = options.WorkerIdentity
+	q.notifyDirectory = options.NotifyDirectory
 
-	pidfile.Initialize(pidfilePath)
-	if err = writePidfile(); err != nil {
+	if options.LogDirectory != "" {
+		q.logDirectory = options.LogDirectory
+	}
+
+	if options.StopGracePeriod != 0 {
+		q.stopGracePeriod = options.StopGracePeriod
+	}
+
+	if options.WorkerNum != 0 {
+		if err := q.SetWorkerNum(options.WorkerNum); err != nil {
+			return nil, err
+		}
+	}
+
+	if options.PollInterval != 0 {
+		if err := q.SetPollInterval(options.PollInterval); err != nil {
+			return nil, err
+		}
+	}
+
+	if options.RetryPolicy != nil {
+		if err := q.SetRetryPolicy(*options.RetryPolicy); err != nil {
+			return nil, err
+		}
+	}
+
+	return q, nil
+}
+
+// Default returns the queue of the package-level functions.
+func Default() *Queue {
+	return defaultQueue
+}
+
+// Start launches the dispatcher of the default queue on a SQLite store on varDB.
+// Cancelling ctx stops dispatching new tasks, but the queue keeps its db and
+// pidfile until Stop is called.
+// An empty pidfilePath disables the pidfile guard, so that several processes
+// can work on one db; give each worker identity its own pidfile otherwise.
+// Processes sharing a db need it opened with a _busy_timeout, as the CLI does.
+// An empty varFFmpegPath looks up ffmpeg in $PATH, see SetFFmpegPath.
+func Start(ctx context.Context, varDB *sql.DB, pidfilePath string, varYoutubeDlPath string, varFFmpegPath string) (pid int, err error) {
+	s, err := NewSQLiteStore(varDB, defaultQueue.logDirectory)
+	if err != nil {
 		return pid, err
 	}
 
-	if err = InitializeSchema(varDB); err != nil {
+	return StartWithStore(ctx, s, pidfilePath, varYoutubeDlPath, varFFmpegPath)
+}
+
+// StartWithStore is Start on any store, such as NewMemoryStore for embedded use.
+// Stop closes s.
+func StartWithStore(ctx context.Context, s Store, pidfilePath string, varYoutubeDlPath string, varFFmpegPath string) (pid int, err error) {
+	if defaultQueue.isStarting() {
+		return pid, errors.New("worker is already start.")
+	}
+
+	SetStore(s)
+	defaultQueue.pidfilePath = pidfilePath
+	defaultQueue.ffmpegPath = varFFmpegPath
+
+	// youtube-dl is the default downloader unless SetDownloader set another
+	if varYoutubeDlPath != "" {
+		youtubeDl := NewYoutubeDl(varYoutubeDlPath)
+		if defaultQueue.downloader == nil || defaultQueue.downloader.Name() == YoutubeDl {
+			defaultQueue.SetDownloader(youtubeDl)
+		} else {
+			defaultQueue.AddDownloader(youtubeDl)
+		}
+	}
+
+	return defaultQueue.Start(ctx)
+}
+
+// Start launches the dispatcher. Cancelling ctx stops dispatching new tasks,
+// but the queue keeps its store and pidfile until Stop is called.
+func (q *Queue) Start(ctx context.Context) (pid int, err error) {
+	if q.isStarting() {
+		return pid, errors.New("worker is already start.")
+	}
+
+	if q.downloader == nil || q.downloader.Path() == "" {
+		return pid, errors.New("downloader is not set.")
+	}
+
+	if err = q.findFFmpeg(ctx); err != nil {
 		return pid, err
 	}
 
-	if varYoutubeDlPath == "" {
-		return pid, errors.New("youtube-dl path is empty.")
+	usePidfile := q.pidfilePath != ""
+	if usePidfile {
+		pidfile.Initialize(q.pidfilePath)
+		if err = writePidfile(); err != nil {
+			return pid, err
+		}
+	}
+
+	// a failed start leaves no pidfile or socket behind to block the next one
+	abort := func(err error) (int, error) {
+		q.stopWakeups()
+		if usePidfile {
+			pidfile.Remove()
+		}
+
+		return 0, err
+	}
+
+	// tasks whose worker died without finishing them
+	recovered, err := q.recoverStaleLeases()
+	if err != nil {
+		return abort(err)
+	}
+	if recovered > 0 {
+		log.Printf("%d interrupted tasks are requeued.", recovered)
+	}
+
+	if err = q.listenWakeups(); err != nil {
+		return abort(err)
+	}
+
+	q.logDownloaderVersions(ctx)
+
+	q.startingMutex.Lock()
+	if q.workerIdentity == "" {
+		q.workerIdentity = defaultWorkerIdentity() + q.instanceSuffix()
 	}
+	q.starting = true
+	q.startingMutex.Unlock()
+
+	// open before dispatching so that no event is missed
+	q.webhookOutbox.setOpen(true)
+	webhookCtx, cancelWebhooks := context.WithCancel(context.Background())
+	q.stopWebhooks = cancelWebhooks
+	q.webhooksDone = make(chan struct{})
 
-	youtubeDlPath = varYoutubeDlPath
+	go func() {
+		defer close(q.webhooksDone)
+		q.runWebhooks(webhookCtx)
+	}()
 
-	starting = true
+	dispatchCtx, cancel := context.WithCancel(ctx)
+	taskCtx, kill := context.WithCancel(context.Background())
+	q.cancelDispatch = cancel
+	q.killTasks = kill
+	q.dispatchDone = make(chan struct{})
 
-	go dispatch()
+	go func() {
+		defer close(q.dispatchDone)
+
+		if err := q.dispatch(dispatchCtx, taskCtx); err != nil {
+			log.Println(err)
+		}
+	}()
+
+	if !usePidfile {
+		return os.Getpid(), nil
+	}
 
 	return pidfile.Read()
 }
 
+// Stop stops the default queue.
 func Stop() {
-	starting = false
-	CloseDB()
-	pidfile.Remove()
+	defaultQueue.Stop()
+}
+
+// Stop cancels dispatching and waits for running youtube-dl processes.
+// Processes still running after the grace period are killed and their tasks
+// are put back into the queue. Then the events left are delivered to webhooks
+// for up to webhookShutdownTimeout, the store is closed and the pidfile removed.
+func (q *Queue) Stop() {
+	if !q.isStarting() {
+		return
+	}
+
+	q.cancelDispatch()
+
+	select {
+	case <-q.dispatchDone:
+	case <-time.After(q.stopGracePeriod):
+		q.killTasks()
+		<-q.dispatchDone
+	}
+
+	q.killTasks()
+
+	// retries still pending after webhookShutdownTimeout are abandoned
+	q.stopWebhooks()
+	<-q.webhooksDone
+
+	q.startingMutex.Lock()
+	q.starting = false
+	q.startingMutex.Unlock()
+
+	q.stopWakeups()
+	q.Close()
+
+	if q.pidfilePath != "" {
+		pidfile.Remove()
+	}
+}
+
+func (q *Queue) isStarting() bool {
+	q.startingMutex.Lock()
+	defer q.startingMutex.Unlock()
+
+	return q.starting
+}
+
+// Close closes the store of the queue.
+func (q *Queue) Close() error {
+	return q.store.Close()
+}
+
+// WorkerStatus describes the workers of this process
+// and the tasks running on any process sharing the db.
+type WorkerStatus struct {
+	Running        bool          `json:"running"`
+	WorkerIdentity string        `json:"worker_identity"`
+	WorkerNum      int           `json:"worker_num"`
+	CurrentTasks   []CurrentTask `json:"current_tasks"`
+	Progresses     []Progress    `json:"progresses"`
+}
+
+func GetWorkerStatus() (status WorkerStatus, err error) {
+	return defaultQueue.GetWorkerStatus()
+}
+
+func (q *Queue) GetWorkerStatus() (status WorkerStatus, err error) {
+	q.startingMutex.Lock()
+	status = WorkerStatus{
+		Running:        q.starting,
+		WorkerIdentity: q.workerIdentity,
+		WorkerNum:      q.GetWorkerNum(),
+		Progresses:     []Progress{},
+	}
+	q.startingMutex.Unlock()
+
+	if status.CurrentTasks, err = q.GetCurrentTasks(); err != nil {
+		return status, err
+	}
+
+	for _, currentTask := range status.CurrentTasks {
+		progress, err := q.GetTaskProgress(currentTask.Id)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return status, err
+		}
+		status.Progresses = append(status.Progresses, progress)
+	}
+
+	return status, nil
 }
 
 func SetLogDirectory(varLogDirectory string) {
-	logDirectory = varLogDirectory
+	defaultQueue.logDirectory = varLogDirectory
+}
+
+// SetStopGracePeriod sets how long Stop waits for running tasks before killing them.
+func SetStopGracePeriod(d time.Duration) {
+	defaultQueue.SetStopGracePeriod(d)
+}
+
+func (q *Queue) SetStopGracePeriod(d time.Duration) {
+	q.stopGracePeriod = d
+}
+
+// SetWorkerNum sets how many tasks are downloaded concurrently.
+// It can be changed while the queue is running.
+func SetWorkerNum(num int) error {
+	return defaultQueue.SetWorkerNum(num)
+}
+
+func (q *Queue) SetWorkerNum(num int) error {
+	if num < 1 {
+		return errors.New("worker num must be positive.")
+	}
+
+	q.workerNumMutex.Lock()
+	q.workerNum = num
+	q.workerNumMutex.Unlock()
+
+	select {
+	case q.resizeWorkers <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+func GetWorkerNum() int {
+	return defaultQueue.GetWorkerNum()
+}
+
+func (q *Queue) GetWorkerNum() int {
+	q.workerNumMutex.Lock()
+	defer q.workerNumMutex.Unlock()
+
+	return q.workerNum
+}
+
+// SetWorkerIdentity names this process in the leases of its workers.
+// It must be unique among processes sharing one db, and defaults to hostname:pid.
+func SetWorkerIdentity(identity string) {
+	defaultQueue.SetWorkerIdentity(identity)
+}
+
+func (q *Queue) SetWorkerIdentity(identity string) {
+	q.startingMutex.Lock()
+	defer q.startingMutex.Unlock()
+
+	q.workerIdentity = identity
+}
+
+func GetWorkerIdentity() string {
+	return defaultQueue.GetWorkerIdentity()
+}
+
+func (q *Queue) GetWorkerIdentity() string {
+	q.startingMutex.Lock()
+	defer q.startingMutex.Unlock()
+
+	return q.workerIdentity
+}
+
+func defaultWorkerIdentity() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+
+	return hostname + ":" + strconv.Itoa(os.Getpid())
+}
+
+// instanceSuffix tells the queues of a process apart
+// in worker identities and wakeup sockets.
+func (q *Queue) instanceSuffix() string {
+	if q.instance == 0 {
+		return ""
+	}
+
+	return "." + strconv.Itoa(q.instance)
 }
 
 func writePidfile() error {
@@ -65,30 +514,120 @@ func writePidfile() error {
 	return pidfile.Write()
 }
 
-func runWorker() (err error) {
-	limits := make(chan struct{}, workerNum)
-
+// runWorker keeps GetWorkerNum() workers running until ctx is done.
+// youtube-dl processes are killed when taskCtx is done.
+func (q *Queue) runWorker(ctx context.Context, taskCtx context.Context) (err error) {
 	var wg sync.WaitGroup
 
+	// cancel funcs of running workers
+	workers := []context.CancelFunc{}
+	// numbers the workers started, so that no worker id is reused
+	started := 0
+
+	// leases of workers in crashed processes sharing the db
+	recoverTicker := time.NewTicker(leaseTimeout)
+	defer recoverTicker.Stop()
+
+	resize := func() {
+		num := q.GetWorkerNum()
+
+		for len(workers) < num {
+			workerCtx, cancel := context.WithCancel(ctx)
+			workers = append(workers, cancel)
+			started++
+
+			wg.Add(1)
+			go func(workerId string) {
+				defer wg.Done()
+				q.work(workerCtx, taskCtx, workerId)
+			}(q.GetWorkerIdentity() + "/" + strconv.Itoa(started))
+		}
+
+		// removed workers finish their current task before exiting
+		for len(workers) > num {
+			workers[len(workers)-1]()
+			workers = workers[:len(workers)-1]
+		}
+	}
+
+	resize()
+
 	for {
-		tasks, err := popTasks()
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return nil
+		case <-q.resizeWorkers:
+			resize()
+		case <-recoverTicker.C:
+			if recovered, err := q.recoverStaleLeases(); err != nil {
+				log.Println(err)
+			} else if recovered > 0 {
+				log.Printf("%d interrupted tasks are requeued.", recovered)
+			}
+		}
+	}
+}
+
+// work claims and runs tasks one by one until ctx is done.
+func (q *Queue) work(ctx context.Context, taskCtx context.Context, workerId string) {
+	for ctx.Err() == nil {
+		// taken before claiming, so that a task queued meanwhile wakes the worker
+		notified := q.storeNotified()
+		wakened := q.wakeups.wait()
+
+		tasks, err := q.popTasks(workerId, 1)
 		if err != nil {
-			log.Println(err)
-			continue
+			log.Printf("worker %s: %s", workerId, err)
 		}
+
 		if len(tasks) == 0 {
-			time.Sleep(time.Minute)
+			select {
+			case <-ctx.Done():
+			case <-notified:
+			case <-wakened:
+			case <-time.After(q.GetPollInterval()):
+			}
 			continue
 		}
 
-		// ひとまず複数実行はしないが後で治す
-		for _, task := range tasks {
-			wg.Add(1)
-			go task.Exec(limits, wg)
+		if err := q.runTask(taskCtx, tasks[0]); err != nil {
+			log.Printf("worker %s: %s", workerId, err)
+		}
+	}
+}
+
+// runTask executes youtube-dl for a task claimed by popTasks and then removes
+// it from tasks. A task failing transiently is retried according to the retry
+// policy and moved into failed_tasks once it runs out of attempts, any other
+// failed task at once.
+// A task killed through ctx is put back into the queue.
+func (q *Queue) runTask(ctx context.Context, task Task) (err error) {
+	heartbeatCtx, stopHeartbeat := context.WithCancel(context.Background())
+	go q.heartbeat(heartbeatCtx, task.Id)
+
+	execErr := q.Exec(ctx, &task)
+	stopHeartbeat()
+
+	if execErr != nil {
+		if ctx.Err() != nil {
+			log.Printf("task %d interrupted: %s", task.Id, execErr)
+			return q.resetTask(&task)
 		}
 
-		wg.Wait()
+		log.Printf("task %d failed: %s", task.Id, execErr)
+
+		// an unreadable log classifies as unknown, which is retried
+		logTail, _ := readLogTail(q.LogPath(task.Id), task.logOffset, logTailLines)
+		reason := q.classifyFailure(task, logTail, execErr)
+
+		if policy := q.GetRetryPolicy(); reason.Transient() && policy.Retryable(task.Attempts+1) {
+			return q.retryTask(&task, policy)
+		}
+
+		_, err = q.FailTask(&task, execErr)
+		return err
 	}
 
-	return nil
+	return q.FinishTask(&task)
 }
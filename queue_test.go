@@ -1,8 +1,12 @@
 package queue
 
 import (
+	"context"
 	"database/sql"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
 	"testing"
 	"time"
 
@@ -35,13 +39,15 @@ func TestStartAndStop(t *testing.T) {
 	}
 
 	dispatchFlag := false
-	dispatch = func() error { dispatchFlag = true; return nil }
+	defaultQueue.dispatch = func(ctx context.Context, taskCtx context.Context) error { dispatchFlag = true; return nil }
+	defer func() { defaultQueue.dispatch = defaultQueue.runWorker }()
 
 	pid, err := Start(
+		context.Background(),
 		db,
 		pidfilePath,
 		"/tmp/youtubel-dl",
-		"/tmp/ffmpeg",
+		writeStubFFmpegForTest(t),
 	)
 
 	if err != nil {
@@ -55,7 +61,7 @@ func TestStartAndStop(t *testing.T) {
 		t.Fatalf("pid is zero.")
 	}
 
-	if starting == false {
+	if !defaultQueue.isStarting() {
 		t.Fatalf("starting flag is false.")
 	}
 
@@ -65,7 +71,593 @@ func TestStartAndStop(t *testing.T) {
 
 	Stop()
 
-	if starting == true {
+	if defaultQueue.isStarting() {
 		t.Fatalf("starting flag is true.")
 	}
 }
+
+func TestStartWithoutPidfile(t *testing.T) {
+	sqlitePath, err := TempFileName()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open("sqlite3", sqlitePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defaultQueue.dispatch = func(ctx context.Context, taskCtx context.Context) error { return nil }
+	defer func() { defaultQueue.dispatch = defaultQueue.runWorker }()
+
+	SetWorkerIdentity("disk1")
+	defer SetWorkerIdentity("")
+
+	pid, err := Start(context.Background(), db, "", "/tmp/youtube-dl", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pid != os.Getpid() {
+		t.Fatalf("different pid! %d", pid)
+	}
+
+	if GetWorkerIdentity() != "disk1" {
+		t.Fatalf("different worker identity!")
+	}
+
+	Stop()
+}
+
+func TestStartRemovesPidfileOnError(t *testing.T) {
+	pidfilePath, err := TempFileName()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a file where the notify directory would be created
+	notDirectory, err := TempFileName()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	closedDb := openDBForTest(t)
+	closedStore, err := NewSQLiteStore(closedDb, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedDb.Close()
+
+	for name, options := range map[string]Options{
+		"recoverStaleLeases": {Store: closedStore},
+		"listenWakeups":      {Store: NewMemoryStore(), NotifyDirectory: filepath.Join(notDirectory, "notify")},
+	} {
+		options.YoutubeDlPath = writeStubDownloaderForTest(t)
+		options.FFmpegPath = NoFFmpeg
+		options.PidfilePath = pidfilePath
+
+		q, err := New(options)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := q.Start(context.Background()); err == nil {
+			t.Fatalf("%s: started without an error!", name)
+		}
+
+		if _, err := os.Stat(pidfilePath); !os.IsNotExist(err) {
+			t.Fatalf("%s: pidfile is left! %v", name, err)
+		}
+
+		if q.isStarting() {
+			t.Fatalf("%s: queue is started!", name)
+		}
+	}
+}
+
+func TestGetWorkerStatusWhileStarting(t *testing.T) {
+	q := newQueueForTest(t, NewYoutubeDl(writeStubDownloaderForTest(t)))
+	q.ffmpegPath = NoFFmpeg
+
+	// read by the API while the queue starts and stops
+	done := make(chan struct{})
+	polled := make(chan struct{})
+	go func() {
+		defer close(polled)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if _, err := q.GetWorkerStatus(); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	if _, err := q.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if status, err := q.GetWorkerStatus(); err != nil || !status.Running || status.WorkerIdentity == "" {
+		t.Fatalf("different status of started queue! %+v %v", status, err)
+	}
+
+	q.Stop()
+	close(done)
+	<-polled
+
+	if status, err := q.GetWorkerStatus(); err != nil || status.Running {
+		t.Fatalf("different status of stopped queue! %+v %v", status, err)
+	}
+}
+
+func TestRunTask(t *testing.T) {
+	InitializeForTest(t)
+
+	defaultQueue.SetDownloader(NewYoutubeDl(writeStubDownloaderForTest(t)))
+
+	defaultRetryPolicy := GetRetryPolicy()
+	SetRetryPolicy(RetryPolicy{MaxAttempts: 1})
+	defer SetRetryPolicy(defaultRetryPolicy)
+
+	for _, url := range []string{
+		"https://www.youtube.com/watch?v=RunTask",
+		"https://www.youtube.com/watch?v=RunTaskfail",
+	} {
+		insertTaskForTest(t, Task{
+			VideoFormat: "135",
+			AudioFormat: "140",
+			Url:         url,
+			Title:       "TestRunTask",
+			OutputPath:  "/tmp/output",
+		})
+	}
+
+	tasks, err := defaultQueue.popTasks("0", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, task := range tasks {
+		if err := defaultQueue.runTask(context.Background(), task); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tasks, err = GetAllTasks()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tasks) != 0 {
+		t.Fatalf("tasks are not removed!")
+	}
+
+	failedTasks, err := GetAllFailedTasks()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(failedTasks) != 1 {
+		t.Fatalf("different failed tasks size!")
+	}
+
+	failedTask := failedTasks[0]
+	if failedTask.VideoId != "RunTaskfail" {
+		t.Fatalf("different failed task! %s", failedTask.VideoId)
+	}
+
+	if failedTask.ExitCode != 2 {
+		t.Fatalf("different exit code! %d", failedTask.ExitCode)
+	}
+
+	if failedTask.StartedAt == 0 {
+		t.Fatalf("Not set StartedAt!")
+	}
+
+	if failedTask.LogPath != defaultQueue.logDirectory+string(os.PathSeparator)+strconv.FormatInt(failedTask.Id, 10)+".log" {
+		t.Fatalf("different log path! %s", failedTask.LogPath)
+	}
+}
+
+func startWorkerForTest(t *testing.T, url string) (sqlitePath string) {
+	InitializeForTest(t)
+
+	sqlitePath, err := TempFileName()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testDb, err := sql.Open("sqlite3", sqlitePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := InitializeSchema(testDb); err != nil {
+		t.Fatal(err)
+	}
+	db = testDb
+
+	task := Task{
+		VideoFormat: "135",
+		AudioFormat: "140",
+		Url:         url,
+		Title:       "TestStop",
+		OutputPath:  "/tmp/output",
+	}
+	if err := task.QueueTask(); err != nil {
+		t.Fatal(err)
+	}
+
+	pidfilePath, err := TempFileName()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Start(context.Background(), testDb, pidfilePath, writeStubDownloaderForTest(t), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// wait running task
+	for i := 0; i < 50; i++ {
+		startedAt := int64(0)
+		if err := db.QueryRow(`SELECT started_at FROM tasks WHERE id = ?`, task.Id).Scan(&startedAt); err != nil {
+			t.Fatal(err)
+		}
+		if startedAt != 0 {
+			return sqlitePath
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	t.Fatalf("task is not started.")
+	return sqlitePath
+}
+
+func countTasksForTest(t *testing.T, sqlitePath string, table string) (count int, startedAt int64) {
+	testDb, err := sql.Open("sqlite3", sqlitePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	if err := testDb.QueryRow(`SELECT COUNT(*), IFNULL(MAX(started_at), 0) FROM `+table).Scan(&count, &startedAt); err != nil {
+		t.Fatal(err)
+	}
+
+	return count, startedAt
+}
+
+func TestStopDrainsRunningTasks(t *testing.T) {
+	SetStopGracePeriod(10 * time.Second)
+
+	sqlitePath := startWorkerForTest(t, "https://www.youtube.com/watch?v=sleep")
+
+	Stop()
+
+	if count, _ := countTasksForTest(t, sqlitePath, "tasks"); count != 0 {
+		t.Fatalf("running task is not finished!")
+	}
+
+	if count, _ := countTasksForTest(t, sqlitePath, "failed_tasks"); count != 0 {
+		t.Fatalf("running task is failed!")
+	}
+}
+
+func TestStopKillsRunningTasks(t *testing.T) {
+	SetStopGracePeriod(100 * time.Millisecond)
+	defer SetStopGracePeriod(30 * time.Second)
+
+	sqlitePath := startWorkerForTest(t, "https://www.youtube.com/watch?v=sleeplong")
+
+	stopStarted := time.Now()
+	Stop()
+
+	if time.Since(stopStarted) > 10*time.Second {
+		t.Fatalf("running task is not killed!")
+	}
+
+	count, startedAt := countTasksForTest(t, sqlitePath, "tasks")
+	if count != 1 {
+		t.Fatalf("interrupted task is not requeued!")
+	}
+
+	if startedAt != 0 {
+		t.Fatalf("interrupted task is still started!")
+	}
+
+	if count, _ := countTasksForTest(t, sqlitePath, "failed_tasks"); count != 0 {
+		t.Fatalf("interrupted task is failed!")
+	}
+}
+
+func TestRunTaskRetries(t *testing.T) {
+	InitializeForTest(t)
+
+	defaultQueue.SetDownloader(NewYoutubeDl(writeStubDownloaderForTest(t)))
+
+	defaultRetryPolicy := GetRetryPolicy()
+	defer SetRetryPolicy(defaultRetryPolicy)
+
+	if err := SetRetryPolicy(RetryPolicy{MaxAttempts: 3, BaseDelay: time.Hour, MaxDelay: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+
+	insertTaskForTest(t, Task{
+		VideoFormat: "135",
+		AudioFormat: "140",
+		Url:         "https://www.youtube.com/watch?v=RunTaskRetriesflaky",
+		Title:       "TestRunTaskRetries",
+		OutputPath:  "/tmp/output",
+	})
+
+	tasks, err := defaultQueue.popTasks("0", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := defaultQueue.runTask(context.Background(), tasks[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	tasks, err = GetAllTasks()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tasks) != 1 || tasks[0].Attempts != 1 || tasks[0].StartedAt != 0 {
+		t.Fatalf("failed task is not retried! %+v", tasks)
+	}
+
+	if tasks[0].NextAttemptAt < time.Now().Add(59*time.Minute).Unix() {
+		t.Fatalf("next attempt is not delayed!")
+	}
+
+	// not popped until next_attempt_at
+	if tasks, _ := defaultQueue.popTasks("0", 1); len(tasks) != 0 {
+		t.Fatalf("delayed task is popped!")
+	}
+
+	if _, err := db.Exec(`UPDATE tasks SET next_attempt_at = 0, attempts = 2`); err != nil {
+		t.Fatal(err)
+	}
+
+	tasks, err = defaultQueue.popTasks("0", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tasks) != 1 {
+		t.Fatalf("retried task is not popped!")
+	}
+
+	if err := defaultQueue.runTask(context.Background(), tasks[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	if tasks, _ := GetAllTasks(); len(tasks) != 0 {
+		t.Fatalf("exhausted task is not removed!")
+	}
+
+	if failedTasks, _ := GetAllFailedTasks(); len(failedTasks) != 1 || failedTasks[0].Reason != ReasonRateLimited {
+		t.Fatalf("exhausted task is not failed!")
+	}
+}
+
+func TestRunTaskFailsWithoutRetries(t *testing.T) {
+	InitializeForTest(t)
+
+	defaultQueue.SetDownloader(NewYoutubeDl(writeStubDownloaderForTest(t)))
+
+	defaultRetryPolicy := GetRetryPolicy()
+	defer SetRetryPolicy(defaultRetryPolicy)
+
+	if err := SetRetryPolicy(RetryPolicy{MaxAttempts: 3, BaseDelay: time.Hour, MaxDelay: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+
+	// an unavailable video is never retried
+	insertTaskForTest(t, Task{
+		VideoFormat: "135",
+		AudioFormat: "140",
+		Url:         "https://www.youtube.com/watch?v=RunTaskFailsWithoutRetriesfail",
+		Title:       "TestRunTaskFailsWithoutRetries",
+		OutputPath:  "/tmp/output",
+	})
+
+	tasks, err := defaultQueue.popTasks("0", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only the output of the last attempt is classified
+	previous := "ERROR: unable to download video data: HTTP Error 429: Too Many Requests\n"
+	if err := ioutil.WriteFile(tasks[0].LogPath(), []byte(previous), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := defaultQueue.runTask(context.Background(), tasks[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	if tasks, _ := GetAllTasks(); len(tasks) != 0 {
+		t.Fatalf("unavailable video is retried! %+v", tasks)
+	}
+
+	failedTasks, err := GetAllFailedTasks()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(failedTasks) != 1 || failedTasks[0].Reason != ReasonUnavailable || failedTasks[0].Attempts != 1 {
+		t.Fatalf("different failed tasks! %+v", failedTasks)
+	}
+
+	if failedTasks[0].LogTail != "ERROR: Video unavailable" {
+		t.Fatalf("different log tail! %q", failedTasks[0].LogTail)
+	}
+}
+
+func TestSetWorkerNum(t *testing.T) {
+	if err := SetWorkerNum(0); err == nil {
+		t.Fatalf("accepted zero workers!")
+	}
+
+	if err := SetWorkerNum(3); err != nil {
+		t.Fatal(err)
+	}
+	defer SetWorkerNum(1)
+
+	if GetWorkerNum() != 3 {
+		t.Fatalf("different worker num!")
+	}
+}
+
+func TestRunWorkerConcurrently(t *testing.T) {
+	InitializeForTest(t)
+
+	defaultQueue.SetDownloader(NewYoutubeDl(writeStubDownloaderForTest(t)))
+
+	for i := 1; i <= 3; i++ {
+		insertTaskForTest(t, Task{
+			VideoFormat: "135",
+			AudioFormat: "140",
+			Url:         "https://www.youtube.com/watch?v=sleeplong" + strconv.Itoa(i),
+			Title:       "TestRunWorkerConcurrently",
+			OutputPath:  "/tmp/output",
+		})
+	}
+
+	SetWorkerNum(1)
+	defer SetWorkerNum(1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	taskCtx, kill := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		defaultQueue.runWorker(ctx, taskCtx)
+	}()
+
+	countStarted := func(expected int) int {
+		count := 0
+		for i := 0; i < 50; i++ {
+			if err := db.QueryRow(`SELECT COUNT(*) FROM tasks WHERE started_at != 0`).Scan(&count); err != nil {
+				t.Fatal(err)
+			}
+			if count == expected {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		return count
+	}
+
+	if count := countStarted(1); count != 1 {
+		t.Fatalf("different started tasks size! %d", count)
+	}
+
+	// grow the pool while running
+	SetWorkerNum(3)
+
+	if count := countStarted(3); count != 3 {
+		t.Fatalf("different started tasks size! %d", count)
+	}
+
+	cancel()
+	kill()
+	<-done
+
+	if count := countStarted(0); count != 0 {
+		t.Fatalf("interrupted tasks are not requeued! %d", count)
+	}
+}
+
+func TestNewQueuesRunIndependently(t *testing.T) {
+	if _, err := New(Options{}); err == nil {
+		t.Fatalf("accepted no store!")
+	}
+
+	youtubeDlPath := writeStubDownloaderForTest(t)
+
+	queues := []*Queue{}
+	for i := 0; i < 2; i++ {
+		logDir, err := ioutil.TempDir("", "youtube-dl-queue-log-")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		q, err := New(Options{
+			Store:         NewMemoryStore(),
+			YoutubeDlPath: youtubeDlPath,
+			LogDirectory:  logDir,
+			WorkerNum:     2,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		queues = append(queues, q)
+	}
+
+	podcasts, videos := queues[0], queues[1]
+
+	task := Task{
+		VideoFormat: "135",
+		AudioFormat: "140",
+		Url:         "https://www.youtube.com/watch?v=NewQueues",
+		Title:       "TestNewQueuesRunIndependently",
+		OutputPath:  "/tmp/output",
+	}
+	if err := podcasts.QueueTask(&task); err != nil {
+		t.Fatal(err)
+	}
+
+	if tasks, _ := videos.GetAllTasks(); len(tasks) != 0 {
+		t.Fatalf("task is queued into another queue!")
+	}
+
+	if podcasts.GetWorkerNum() != 2 || GetWorkerNum() == 2 {
+		t.Fatalf("worker num is shared!")
+	}
+
+	for _, q := range queues {
+		if _, err := q.Start(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if podcasts.GetWorkerIdentity() == videos.GetWorkerIdentity() {
+		t.Fatalf("same worker identity! %s", podcasts.GetWorkerIdentity())
+	}
+
+	for i := 0; i < 50; i++ {
+		if tasks, _ := podcasts.GetAllTasks(); len(tasks) == 0 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if tasks, _ := podcasts.GetAllTasks(); len(tasks) != 0 {
+		t.Fatalf("task is not run!")
+	}
+
+	if _, err := os.Stat(podcasts.LogPath(task.Id)); err != nil {
+		t.Fatalf("task log is not written! %s", err)
+	}
+
+	if _, err := os.Stat(videos.LogPath(task.Id)); !os.IsNotExist(err) {
+		t.Fatalf("task log is written by another queue!")
+	}
+
+	for _, q := range queues {
+		q.Stop()
+	}
+
+	if defaultQueue.isStarting() {
+		t.Fatalf("default queue is started!")
+	}
+}
@@ -0,0 +1,90 @@
+package queue
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy decides how often and when a failed task is tried again
+// before it is moved into failed_tasks.
+type RetryPolicy struct {
+	// MaxAttempts counts the first attempt too, so 1 disables retries.
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	// Jitter randomizes each delay by up to this fraction of it (0 to 1).
+	Jitter float64
+}
+
+func SetRetryPolicy(policy RetryPolicy) error {
+	return defaultQueue.SetRetryPolicy(policy)
+}
+
+func (q *Queue) SetRetryPolicy(policy RetryPolicy) error {
+	if err := policy.validate(); err != nil {
+		return err
+	}
+
+	q.retryPolicyMutex.Lock()
+	q.retryPolicy = policy
+	q.retryPolicyMutex.Unlock()
+
+	return nil
+}
+
+func GetRetryPolicy() RetryPolicy {
+	return defaultQueue.GetRetryPolicy()
+}
+
+func (q *Queue) GetRetryPolicy() RetryPolicy {
+	q.retryPolicyMutex.Lock()
+	defer q.retryPolicyMutex.Unlock()
+
+	return q.retryPolicy
+}
+
+func (p RetryPolicy) validate() error {
+	if p.MaxAttempts < 1 {
+		return errors.New("max attempts must be positive.")
+	}
+
+	if p.BaseDelay < 0 || p.MaxDelay < p.BaseDelay {
+		return errors.New("retry delays must satisfy 0 <= base delay <= max delay.")
+	}
+
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return errors.New("jitter must be between 0 and 1.")
+	}
+
+	return nil
+}
+
+// Delay returns how long to wait before the next attempt
+// after the given number of failed attempts.
+func (p RetryPolicy) Delay(attempts int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < attempts && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+
+	if p.Jitter > 0 {
+		delay += time.Duration(float64(delay) * p.Jitter * (rand.Float64()*2 - 1))
+	}
+
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+
+	return delay
+}
+
+// Retryable reports whether a task failed the given number of times
+// should be tried again.
+func (p RetryPolicy) Retryable(attempts int) bool {
+	return attempts < p.MaxAttempts
+}
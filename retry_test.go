@@ -0,0 +1,75 @@
+package queue
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSetRetryPolicy(t *testing.T) {
+	defaultRetryPolicy := GetRetryPolicy()
+	defer SetRetryPolicy(defaultRetryPolicy)
+
+	invalids := []RetryPolicy{
+		{MaxAttempts: 0},
+		{MaxAttempts: 1, BaseDelay: -time.Second},
+		{MaxAttempts: 1, BaseDelay: time.Hour, MaxDelay: time.Minute},
+		{MaxAttempts: 1, Jitter: 1.5},
+	}
+
+	for _, policy := range invalids {
+		if err := SetRetryPolicy(policy); err == nil {
+			t.Fatalf("accepted invalid policy! %+v", policy)
+		}
+	}
+
+	policy := RetryPolicy{MaxAttempts: 5, BaseDelay: time.Second, MaxDelay: time.Minute, Jitter: 0.5}
+	if err := SetRetryPolicy(policy); err != nil {
+		t.Fatal(err)
+	}
+
+	if GetRetryPolicy() != policy {
+		t.Fatalf("different retry policy!")
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 10, BaseDelay: time.Second, MaxDelay: 30 * time.Second}
+
+	tests := []struct {
+		attempts int
+		delay    time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{5, 16 * time.Second},
+		{6, 30 * time.Second},
+		{100, 30 * time.Second},
+	}
+
+	for _, test := range tests {
+		if delay := policy.Delay(test.attempts); delay != test.delay {
+			t.Fatalf("attempts %d: expected %s, got %s", test.attempts, test.delay, delay)
+		}
+	}
+
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		delay := policy.Delay(3)
+		if delay < 2*time.Second || delay > 6*time.Second {
+			t.Fatalf("delay out of jitter range! %s", delay)
+		}
+	}
+}
+
+func TestRetryPolicyRetryable(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3}
+
+	if !policy.Retryable(2) {
+		t.Fatalf("2 attempts are not retryable!")
+	}
+
+	if policy.Retryable(3) {
+		t.Fatalf("3 attempts are retryable!")
+	}
+}
@@ -0,0 +1,885 @@
+package queue
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type sqliteStore struct {
+	db         *sql.DB
+	stmts      map[string]*sql.Stmt
+	stmtsMutex sync.Mutex
+}
+
+// NewSQLiteStore upgrades the schema of db to the latest version, migrating
+// a db keyed on video ids to job ids first, along with its task logs in
+// logDirectory, the log directory of the queue which is to use the store.
+func NewSQLiteStore(db *sql.DB, logDirectory string) (Store, error) {
+	if db == nil {
+		return nil, errors.New("cannot found db!")
+	}
+
+	legacy, err := hasLegacyLayout(db)
+	if err != nil {
+		return nil, err
+	}
+
+	if legacy {
+		if err = migrateLegacyLayout(db, logDirectory); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = migrate(db, migrations); err != nil {
+		return nil, err
+	}
+
+	return &sqliteStore{db: db, stmts: make(map[string]*sql.Stmt)}, nil
+}
+
+func (s *sqliteStore) stmt(sql string) (stmt *sql.Stmt, err error) {
+	s.stmtsMutex.Lock()
+	defer s.stmtsMutex.Unlock()
+
+	stmt, ok := s.stmts[sql]
+	if ok {
+		return stmt, err
+	}
+
+	stmt, err = s.db.Prepare(sql)
+	if err == nil {
+		s.stmts[sql] = stmt
+		return stmt, err
+	} else {
+		return nil, err
+	}
+}
+
+// txStmt returns the cached statement for sql bound to tx.
+func (s *sqliteStore) txStmt(tx *sql.Tx, sql string) (stmt *sql.Stmt, err error) {
+	stmt, err = s.stmt(sql)
+	if err != nil {
+		return nil, err
+	}
+
+	return tx.Stmt(stmt), nil
+}
+
+func (s *sqliteStore) Close() error {
+	s.stmtsMutex.Lock()
+	for _, stmt := range s.stmts {
+		stmt.Close()
+	}
+	s.stmts = make(map[string]*sql.Stmt)
+	s.stmtsMutex.Unlock()
+
+	return s.db.Close()
+}
+
+func (s *sqliteStore) Enqueue(t *Task) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = s.addTask(tx, t); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqliteStore) addTask(tx *sql.Tx, t *Task) error {
+	stmt, err := s.txStmt(tx, `INSERT INTO tasks (id, video_id, video_format, audio_format, url, title, output_path, parameter, created_at, updated_at, started_at, attempts, next_attempt_at, downloader, options, format) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+
+	result, err := stmt.Exec(
+		sql.NullInt64{Int64: t.Id, Valid: t.Id != 0},
+		t.VideoId,
+		t.VideoFormat,
+		t.AudioFormat,
+		t.Url,
+		t.Title,
+		t.OutputPath,
+		t.Parameters,
+		t.CreatedAt,
+		t.UpdatedAt,
+		t.StartedAt,
+		t.Attempts,
+		t.NextAttemptAt,
+		t.Downloader,
+		t.Options,
+		t.Format,
+	)
+
+	if err != nil {
+		if s.queued(tx, t) {
+			return ErrDuplicateTask
+		}
+		return err
+	}
+
+	t.Id, err = result.LastInsertId()
+
+	return err
+}
+
+// queued reports whether the same download is already in tasks.
+func (s *sqliteStore) queued(tx *sql.Tx, t *Task) bool {
+	stmt, err := s.txStmt(tx, `SELECT COUNT(*) FROM tasks WHERE video_id = ? AND video_format = ? AND audio_format = ? AND format = ? AND output_path = ? AND parameter = ?`)
+	if err != nil {
+		return false
+	}
+
+	count := 0
+	if err = stmt.QueryRow(t.VideoId, t.VideoFormat, t.AudioFormat, t.Format, t.OutputPath, t.Parameters).Scan(&count); err != nil {
+		return false
+	}
+
+	return count > 0
+}
+
+// claims numbers the claims of this process, see Claim.
+var claims uint64
+
+// Claim inserts the leases by one statement, so that workers in other
+// processes sharing the db never claim the same tasks. The leases are marked
+// by a claim token, so that only the tasks of this claim are started,
+// all in one transaction.
+func (s *sqliteStore) Claim(workerId string, limit int) (tasks []Task, err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return tasks, err
+	}
+	defer tx.Rollback()
+
+	claim := fmt.Sprintf("%d.%d.%d", os.Getpid(), time.Now().UnixNano(), atomic.AddUint64(&claims, 1))
+
+	stmt, err := s.txStmt(tx, `INSERT INTO current_task (id, worker_id, pid, heartbeat_at, claim)
+		SELECT id, ?, ?, ?, ? FROM tasks WHERE started_at = 0 AND next_attempt_at <= ? AND NOT EXISTS (
+			SELECT 1 FROM current_task c WHERE c.id = tasks.id
+		) ORDER BY created_at ASC, id ASC LIMIT ?`)
+	if err != nil {
+		return tasks, err
+	}
+
+	now := time.Now().Unix()
+	if _, err = stmt.Exec(workerId, os.Getpid(), now, claim, now, limit); err != nil {
+		return tasks, err
+	}
+
+	stmt, err = s.txStmt(tx, `UPDATE tasks SET started_at = ? WHERE id IN (SELECT id FROM current_task WHERE claim = ?)`)
+	if err != nil {
+		return tasks, err
+	}
+
+	if _, err = stmt.Exec(now, claim); err != nil {
+		return tasks, err
+	}
+
+	stmt, err = s.txStmt(tx, `SELECT t.* FROM tasks t INNER JOIN current_task c ON c.id = t.id WHERE c.claim = ? ORDER BY t.created_at ASC, t.id ASC`)
+	if err != nil {
+		return tasks, err
+	}
+
+	rows, err := stmt.Query(claim)
+	if err != nil {
+		return tasks, err
+	}
+
+	tasks = make([]Task, 0, limit)
+
+	defer rows.Close()
+	for rows.Next() {
+		task := Task{}
+		err = rows.Scan(
+			&task.Id,
+			&task.VideoId,
+			&task.VideoFormat,
+			&task.AudioFormat,
+			&task.Url,
+			&task.Title,
+			&task.OutputPath,
+			&task.Parameters,
+			&task.CreatedAt,
+			&task.UpdatedAt,
+			&task.StartedAt,
+			&task.Attempts,
+			&task.NextAttemptAt,
+			&task.Downloader,
+			&task.Options,
+			&task.Format,
+		)
+		if err != nil {
+			return []Task{}, err
+		}
+		tasks = append(tasks, task)
+	}
+	if err = rows.Err(); err != nil {
+		return []Task{}, err
+	}
+	rows.Close()
+
+	if err = tx.Commit(); err != nil {
+		return []Task{}, err
+	}
+
+	return tasks, nil
+}
+
+func (s *sqliteStore) MarkStarted(id int64, startedAt int64) error {
+	stmt, err := s.stmt(`UPDATE tasks SET started_at = ? WHERE id = ?`)
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(startedAt, id)
+
+	return err
+}
+
+func (s *sqliteStore) Release(t Task) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := s.txStmt(tx, `UPDATE tasks SET started_at = 0, attempts = ?, next_attempt_at = ?, updated_at = ? WHERE id = ?`)
+	if err != nil {
+		return err
+	}
+
+	if _, err = stmt.Exec(t.Attempts, t.NextAttemptAt, t.UpdatedAt, t.Id); err != nil {
+		return err
+	}
+
+	if err = s.releaseLease(tx, t.Id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqliteStore) Finish(ft FinishedTask) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := s.txStmt(tx, `INSERT INTO finished_tasks (id, video_id, url, output_file, format_ids, finished_at) VALUES (?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+
+	if _, err = stmt.Exec(ft.Id, ft.VideoId, ft.Url, ft.OutputFile, ft.FormatIds, ft.FinishedAt); err != nil {
+		return err
+	}
+
+	if err = s.deleteTask(tx, ft.Id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqliteStore) Fail(ft FailedTask) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = s.addFailed(tx, ft); err != nil {
+		return err
+	}
+
+	if err = s.deleteTask(tx, ft.Id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// deleteTask removes a task which is not running any more, with its lease and progress.
+func (s *sqliteStore) deleteTask(tx *sql.Tx, id int64) error {
+	stmt, err := s.txStmt(tx, `DELETE FROM tasks WHERE id = ?`)
+	if err != nil {
+		return err
+	}
+
+	if _, err = stmt.Exec(id); err != nil {
+		return err
+	}
+
+	return s.releaseLease(tx, id)
+}
+
+func (s *sqliteStore) releaseLease(tx *sql.Tx, id int64) error {
+	for _, sql := range []string{
+		`DELETE FROM current_task WHERE id = ?`,
+		`DELETE FROM task_progress WHERE id = ?`,
+	} {
+		stmt, err := s.txStmt(tx, sql)
+		if err != nil {
+			return err
+		}
+
+		if _, err = stmt.Exec(id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *sqliteStore) Requeue(t *Task) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := s.txStmt(tx, `DELETE FROM failed_tasks WHERE id = ?`)
+	if err != nil {
+		return err
+	}
+
+	result, err := stmt.Exec(t.Id)
+	if err != nil {
+		return err
+	}
+
+	if removed, err := result.RowsAffected(); err != nil || removed == 0 {
+		if err != nil {
+			return err
+		}
+		return ErrTaskNotFound
+	}
+
+	if err = s.addTask(tx, t); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqliteStore) Remove(id int64) error {
+	stmt, err := s.stmt(`DELETE FROM tasks WHERE id = ? AND started_at = 0`)
+	if err != nil {
+		return err
+	}
+
+	result, err := stmt.Exec(id)
+	if err != nil {
+		return err
+	}
+
+	if removed, err := result.RowsAffected(); err != nil || removed > 0 {
+		return err
+	}
+
+	if _, err = s.Get(id); err != nil {
+		return err
+	}
+
+	return ErrTaskRunning
+}
+
+// Get returns ErrTaskNotFound when no task has the job id.
+func (s *sqliteStore) Get(id int64) (task Task, err error) {
+	stmt, err := s.stmt(`SELECT * FROM tasks WHERE id = ?`)
+	if err != nil {
+		return task, err
+	}
+
+	err = stmt.QueryRow(id).Scan(
+		&task.Id,
+		&task.VideoId,
+		&task.VideoFormat,
+		&task.AudioFormat,
+		&task.Url,
+		&task.Title,
+		&task.OutputPath,
+		&task.Parameters,
+		&task.CreatedAt,
+		&task.UpdatedAt,
+		&task.StartedAt,
+		&task.Attempts,
+		&task.NextAttemptAt,
+		&task.Downloader,
+		&task.Options,
+		&task.Format,
+	)
+	if err == sql.ErrNoRows {
+		return task, ErrTaskNotFound
+	}
+
+	return task, err
+}
+
+func (s *sqliteStore) List() (tasks []Task, err error) {
+	return s.queryTasks(`SELECT * FROM tasks ORDER BY created_at DESC, updated_at DESC`)
+}
+
+func (s *sqliteStore) ListByVideoId(videoId string) (tasks []Task, err error) {
+	return s.queryTasks(`SELECT * FROM tasks WHERE video_id = ? ORDER BY created_at DESC, updated_at DESC`, videoId)
+}
+
+func (s *sqliteStore) queryTasks(sql string, args ...interface{}) (tasks []Task, err error) {
+	stmt, err := s.stmt(sql)
+	if err != nil {
+		return tasks, err
+	}
+
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return tasks, err
+	}
+
+	return scanTasks(rows)
+}
+
+// Query is not prepared, as its SQL varies with the filters of query.
+func (s *sqliteStore) Query(query TaskQuery, now int64) (tasks []Task, err error) {
+	sql, args := taskQuerySql(query, now)
+
+	rows, err := s.db.Query(sql, args...)
+	if err != nil {
+		return tasks, err
+	}
+
+	return scanTasks(rows)
+}
+
+func (s *sqliteStore) AddFailed(ft FailedTask) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = s.addFailed(tx, ft); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqliteStore) addFailed(tx *sql.Tx, ft FailedTask) error {
+	stmt, err := s.txStmt(tx, `INSERT INTO failed_tasks (id, video_id, video_format, audio_format, url, title, output_path, parameter, created_at, updated_at, started_at, failed_at, exit_code, log_path, reason, log_tail, attempts, downloader, options, format, format_ids) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(
+		ft.Id,
+		ft.VideoId,
+		ft.VideoFormat,
+		ft.AudioFormat,
+		ft.Url,
+		ft.Title,
+		ft.OutputPath,
+		ft.Parameters,
+		ft.CreatedAt,
+		ft.UpdatedAt,
+		ft.StartedAt,
+		ft.FailedAt,
+		ft.ExitCode,
+		ft.LogPath,
+		ft.Reason,
+		ft.LogTail,
+		ft.Attempts,
+		ft.Downloader,
+		ft.Options,
+		ft.Format,
+		ft.FormatIds,
+	)
+
+	return err
+}
+
+func (s *sqliteStore) RemoveFailed(id int64) error {
+	stmt, err := s.stmt(`DELETE FROM failed_tasks WHERE id = ?`)
+	if err != nil {
+		return err
+	}
+
+	result, err := stmt.Exec(id)
+	if err != nil {
+		return err
+	}
+
+	if removed, err := result.RowsAffected(); err != nil || removed > 0 {
+		return err
+	}
+
+	return ErrTaskNotFound
+}
+
+// GetFailed returns ErrTaskNotFound when no failed task has the job id.
+func (s *sqliteStore) GetFailed(id int64) (failedTask FailedTask, err error) {
+	stmt, err := s.stmt(`SELECT * FROM failed_tasks WHERE id = ?`)
+	if err != nil {
+		return failedTask, err
+	}
+
+	err = stmt.QueryRow(id).Scan(
+		&failedTask.Id,
+		&failedTask.VideoId,
+		&failedTask.VideoFormat,
+		&failedTask.AudioFormat,
+		&failedTask.Url,
+		&failedTask.Title,
+		&failedTask.OutputPath,
+		&failedTask.Parameters,
+		&failedTask.CreatedAt,
+		&failedTask.UpdatedAt,
+		&failedTask.StartedAt,
+		&failedTask.FailedAt,
+		&failedTask.ExitCode,
+		&failedTask.LogPath,
+		&failedTask.Reason,
+		&failedTask.LogTail,
+		&failedTask.Attempts,
+		&failedTask.Downloader,
+		&failedTask.Options,
+		&failedTask.Format,
+		&failedTask.FormatIds,
+	)
+	if err == sql.ErrNoRows {
+		return failedTask, ErrTaskNotFound
+	}
+
+	return failedTask, err
+}
+
+func (s *sqliteStore) ListFailed() (failedTasks []FailedTask, err error) {
+	return s.queryFailedTasks(`SELECT * FROM failed_tasks ORDER BY id DESC`)
+}
+
+func (s *sqliteStore) ListFailedByVideoId(videoId string) (failedTasks []FailedTask, err error) {
+	return s.queryFailedTasks(`SELECT * FROM failed_tasks WHERE video_id = ? ORDER BY failed_at DESC`, videoId)
+}
+
+// GetFinished returns ErrTaskNotFound when no task finished under the job id.
+func (s *sqliteStore) GetFinished(id int64) (finishedTask FinishedTask, err error) {
+	stmt, err := s.stmt(`SELECT id, video_id, url, output_file, format_ids, finished_at FROM finished_tasks WHERE id = ?`)
+	if err != nil {
+		return finishedTask, err
+	}
+
+	err = stmt.QueryRow(id).Scan(
+		&finishedTask.Id,
+		&finishedTask.VideoId,
+		&finishedTask.Url,
+		&finishedTask.OutputFile,
+		&finishedTask.FormatIds,
+		&finishedTask.FinishedAt,
+	)
+	if err == sql.ErrNoRows {
+		return finishedTask, ErrTaskNotFound
+	}
+
+	return finishedTask, err
+}
+
+func (s *sqliteStore) queryFailedTasks(sql string, args ...interface{}) (failedTasks []FailedTask, err error) {
+	stmt, err := s.stmt(sql)
+	if err != nil {
+		return failedTasks, err
+	}
+
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return failedTasks, err
+	}
+
+	failedTasks = []FailedTask{}
+
+	defer rows.Close()
+	for rows.Next() {
+		failedTask := FailedTask{}
+		err = rows.Scan(
+			&failedTask.Id,
+			&failedTask.VideoId,
+			&failedTask.VideoFormat,
+			&failedTask.AudioFormat,
+			&failedTask.Url,
+			&failedTask.Title,
+			&failedTask.OutputPath,
+			&failedTask.Parameters,
+			&failedTask.CreatedAt,
+			&failedTask.UpdatedAt,
+			&failedTask.StartedAt,
+			&failedTask.FailedAt,
+			&failedTask.ExitCode,
+			&failedTask.LogPath,
+			&failedTask.Reason,
+			&failedTask.LogTail,
+			&failedTask.Attempts,
+			&failedTask.Downloader,
+			&failedTask.Options,
+			&failedTask.Format,
+			&failedTask.FormatIds,
+		)
+		if err != nil {
+			return []FailedTask{}, err
+		}
+		failedTasks = append(failedTasks, failedTask)
+	}
+
+	return failedTasks, rows.Err()
+}
+
+func (s *sqliteStore) Heartbeat(id int64) error {
+	stmt, err := s.stmt(`UPDATE current_task SET heartbeat_at = ? WHERE id = ?`)
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(time.Now().Unix(), id)
+
+	return err
+}
+
+func (s *sqliteStore) ListLeases() (currentTasks []CurrentTask, err error) {
+	stmt, err := s.stmt(`SELECT id, worker_id, pid, heartbeat_at FROM current_task ORDER BY worker_id ASC`)
+	if err != nil {
+		return currentTasks, err
+	}
+
+	rows, err := stmt.Query()
+	if err != nil {
+		return currentTasks, err
+	}
+
+	currentTasks = []CurrentTask{}
+
+	defer rows.Close()
+	for rows.Next() {
+		currentTask := CurrentTask{}
+		err = rows.Scan(
+			&currentTask.Id,
+			&currentTask.WorkerId,
+			&currentTask.Pid,
+			&currentTask.HeartbeatAt,
+		)
+		if err != nil {
+			return []CurrentTask{}, err
+		}
+		currentTasks = append(currentTasks, currentTask)
+	}
+
+	return currentTasks, rows.Err()
+}
+
+func (s *sqliteStore) RecoverStaleLeases(heartbeatBefore int64) (recovered int64, err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return recovered, err
+	}
+	defer tx.Rollback()
+
+	stmt, err := s.txStmt(tx, `DELETE FROM current_task WHERE heartbeat_at < ?`)
+	if err != nil {
+		return recovered, err
+	}
+
+	if _, err = stmt.Exec(heartbeatBefore); err != nil {
+		return recovered, err
+	}
+
+	stmt, err = s.txStmt(tx, `UPDATE tasks SET started_at = 0 WHERE started_at != 0 AND NOT EXISTS (
+		SELECT 1 FROM current_task c WHERE c.id = tasks.id
+	)`)
+	if err != nil {
+		return recovered, err
+	}
+
+	result, err := stmt.Exec()
+	if err != nil {
+		return recovered, err
+	}
+
+	if recovered, err = result.RowsAffected(); err != nil {
+		return recovered, err
+	}
+
+	return recovered, tx.Commit()
+}
+
+func (s *sqliteStore) SaveProgress(progress Progress) error {
+	stmt, err := s.stmt(`INSERT OR REPLACE INTO task_progress (id, phase, percent, downloaded_bytes, total_bytes, speed, eta, filename, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(
+		progress.Id,
+		progress.Phase,
+		progress.Percent,
+		progress.DownloadedBytes,
+		progress.TotalBytes,
+		progress.Speed,
+		progress.Eta,
+		progress.Filename,
+		progress.UpdatedAt,
+	)
+
+	return err
+}
+
+func (s *sqliteStore) GetProgress(id int64) (progress Progress, err error) {
+	stmt, err := s.stmt(`SELECT id, phase, percent, downloaded_bytes, total_bytes, speed, eta, filename, updated_at FROM task_progress WHERE id = ?`)
+	if err != nil {
+		return progress, err
+	}
+
+	err = stmt.QueryRow(id).Scan(
+		&progress.Id,
+		&progress.Phase,
+		&progress.Percent,
+		&progress.DownloadedBytes,
+		&progress.TotalBytes,
+		&progress.Speed,
+		&progress.Eta,
+		&progress.Filename,
+		&progress.UpdatedAt,
+	)
+
+	return progress, err
+}
+
+func (s *sqliteStore) AddWebhook(webhook *Webhook) error {
+	stmt, err := s.stmt(`INSERT INTO webhooks (url, secret, events, created_at) VALUES (?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+
+	result, err := stmt.Exec(webhook.Url, webhook.Secret, joinEventTypes(webhook.Events), webhook.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	webhook.Id, err = result.LastInsertId()
+
+	return err
+}
+
+func (s *sqliteStore) RemoveWebhook(id int64) error {
+	stmt, err := s.stmt(`DELETE FROM webhooks WHERE id = ?`)
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(id)
+
+	return err
+}
+
+func (s *sqliteStore) ListWebhooks() (webhooks []Webhook, err error) {
+	stmt, err := s.stmt(`SELECT id, url, secret, events, created_at FROM webhooks ORDER BY id ASC`)
+	if err != nil {
+		return webhooks, err
+	}
+
+	rows, err := stmt.Query()
+	if err != nil {
+		return webhooks, err
+	}
+
+	webhooks = []Webhook{}
+
+	defer rows.Close()
+	for rows.Next() {
+		webhook := Webhook{}
+		events := ""
+		err = rows.Scan(
+			&webhook.Id,
+			&webhook.Url,
+			&webhook.Secret,
+			&events,
+			&webhook.CreatedAt,
+		)
+		if err != nil {
+			return []Webhook{}, err
+		}
+		webhook.Events = splitEventTypes(events)
+		webhooks = append(webhooks, webhook)
+	}
+
+	return webhooks, rows.Err()
+}
+
+func (s *sqliteStore) AddWebhookDelivery(d *WebhookDelivery) error {
+	stmt, err := s.stmt(`INSERT INTO webhook_deliveries (webhook_id, event, task_id, video_id, attempt, status_code, error, delivered_at, format_ids) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+
+	result, err := stmt.Exec(
+		d.WebhookId,
+		d.Event,
+		d.TaskId,
+		d.VideoId,
+		d.Attempt,
+		d.StatusCode,
+		d.Error,
+		d.DeliveredAt,
+		d.FormatIds,
+	)
+	if err != nil {
+		return err
+	}
+
+	d.Id, err = result.LastInsertId()
+
+	return err
+}
+
+func (s *sqliteStore) ListWebhookDeliveries(webhookId int64) (deliveries []WebhookDelivery, err error) {
+	stmt, err := s.stmt(`SELECT id, webhook_id, event, task_id, video_id, attempt, status_code, error, delivered_at, format_ids FROM webhook_deliveries WHERE webhook_id = ? ORDER BY id ASC`)
+	if err != nil {
+		return deliveries, err
+	}
+
+	rows, err := stmt.Query(webhookId)
+	if err != nil {
+		return deliveries, err
+	}
+
+	deliveries = []WebhookDelivery{}
+
+	defer rows.Close()
+	for rows.Next() {
+		delivery := WebhookDelivery{}
+		err = rows.Scan(
+			&delivery.Id,
+			&delivery.WebhookId,
+			&delivery.Event,
+			&delivery.TaskId,
+			&delivery.VideoId,
+			&delivery.Attempt,
+			&delivery.StatusCode,
+			&delivery.Error,
+			&delivery.DeliveredAt,
+			&delivery.FormatIds,
+		)
+		if err != nil {
+			return []WebhookDelivery{}, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, rows.Err()
+}
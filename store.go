@@ -0,0 +1,80 @@
+package queue
+
+// Store persists tasks, their leases and progress, and webhooks.
+// The default queue runs on the store set by InitializeSchema or SetStore.
+type Store interface {
+	// Enqueue inserts t, under a new job id unless it has one.
+	// It returns ErrDuplicateTask when the same download is queued.
+	Enqueue(t *Task) error
+	// Claim leases up to limit tasks which are due and not started
+	// to workerId, and marks them started.
+	Claim(workerId string, limit int) ([]Task, error)
+	MarkStarted(id int64, startedAt int64) error
+	// Release puts t back into the queue with its attempts and next attempt
+	// time, dropping its lease and progress.
+	Release(t Task) error
+	// Finish removes the task with the job id of ft with its lease and
+	// progress, recording it as ft.
+	Finish(ft FinishedTask) error
+	// Fail moves a task into the failed tasks, dropping its lease and progress.
+	Fail(ft FailedTask) error
+	// Requeue moves the failed task with the job id of t back into the queue as t.
+	Requeue(t *Task) error
+	// Remove deletes a task which is not started yet.
+	Remove(id int64) error
+	Get(id int64) (Task, error)
+	List() ([]Task, error)
+	ListByVideoId(videoId string) ([]Task, error)
+	// Query returns the tasks matching a valid query, evaluating statuses at now.
+	Query(query TaskQuery, now int64) ([]Task, error)
+
+	AddFailed(ft FailedTask) error
+	RemoveFailed(id int64) error
+	GetFailed(id int64) (FailedTask, error)
+	ListFailed() ([]FailedTask, error)
+	ListFailedByVideoId(videoId string) ([]FailedTask, error)
+
+	// GetFinished returns ErrTaskNotFound when no task finished under the job id.
+	GetFinished(id int64) (FinishedTask, error)
+
+	Heartbeat(id int64) error
+	ListLeases() ([]CurrentTask, error)
+	// RecoverStaleLeases drops leases whose heartbeat is older than
+	// heartbeatBefore, and puts started tasks without a lease back into the queue.
+	RecoverStaleLeases(heartbeatBefore int64) (recovered int64, err error)
+
+	SaveProgress(progress Progress) error
+	// GetProgress returns sql.ErrNoRows when no progress is saved.
+	GetProgress(id int64) (Progress, error)
+
+	AddWebhook(webhook *Webhook) error
+	RemoveWebhook(id int64) error
+	ListWebhooks() ([]Webhook, error)
+	AddWebhookDelivery(delivery *WebhookDelivery) error
+	ListWebhookDeliveries(webhookId int64) ([]WebhookDelivery, error)
+
+	Close() error
+}
+
+// SetStore makes the default queue run on s.
+func SetStore(s Store) {
+	defaultQueue.store = s
+}
+
+// Notifier is implemented by stores which announce the tasks queued or
+// released by any process sharing them, so that idle workers claim them
+// without waiting to poll.
+type Notifier interface {
+	// Notified returns a channel closed at the next announcement.
+	Notified() <-chan struct{}
+}
+
+// storeNotified returns the channel of the next announcement of the store,
+// or nil which blocks forever when the store announces nothing.
+func (q *Queue) storeNotified() <-chan struct{} {
+	if notifier, ok := q.store.(Notifier); ok {
+		return notifier.Notified()
+	}
+
+	return nil
+}
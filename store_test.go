@@ -0,0 +1,362 @@
+package queue
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+)
+
+// storesForTest returns an empty store of each implementation.
+func storesForTest(t *testing.T) map[string]Store {
+	sqliteStore, err := NewSQLiteStore(openDBForTest(t), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return map[string]Store{
+		"sqlite":   sqliteStore,
+		"memory":   NewMemoryStore(),
+		"postgres": postgresStoreForTest(t),
+	}
+}
+
+func enqueueForTest(t *testing.T, s Store, videoId string, createdAt int64) Task {
+	task := Task{
+		VideoId:     videoId,
+		VideoFormat: "137",
+		AudioFormat: "140",
+		Url:         "https://www.youtube.com/watch?v=" + videoId,
+		Title:       "Test" + videoId,
+		OutputPath:  "/tmp/output",
+		CreatedAt:   createdAt,
+		UpdatedAt:   createdAt,
+	}
+
+	if err := s.Enqueue(&task); err != nil {
+		t.Fatal(err)
+	}
+
+	return task
+}
+
+func TestStoreEnqueue(t *testing.T) {
+	for name, s := range storesForTest(t) {
+		first := enqueueForTest(t, s, "StoreEnqueue", 1)
+		second := enqueueForTest(t, s, "StoreEnqueue2", 2)
+
+		if first.Id == 0 || second.Id <= first.Id {
+			t.Fatalf("%s: different job ids! %d %d", name, first.Id, second.Id)
+		}
+
+		duplicate := first
+		duplicate.Id = 0
+		if err := s.Enqueue(&duplicate); err != ErrDuplicateTask {
+			t.Fatalf("%s: expected duplicate error, got %v", name, err)
+		}
+
+		task, err := s.Get(first.Id)
+		if err != nil || task.Title != "TestStoreEnqueue" {
+			t.Fatalf("%s: different task! %s %v", name, task, err)
+		}
+
+		if _, err := s.Get(second.Id + 1); err != ErrTaskNotFound {
+			t.Fatalf("%s: expected not found error, got %v", name, err)
+		}
+
+		tasks, err := s.List()
+		if err != nil || len(tasks) != 2 || tasks[0].Id != second.Id {
+			t.Fatalf("%s: different tasks! %+v %v", name, tasks, err)
+		}
+
+		tasks, err = s.ListByVideoId("StoreEnqueue")
+		if err != nil || len(tasks) != 1 || tasks[0].Id != first.Id {
+			t.Fatalf("%s: different tasks of video! %+v %v", name, tasks, err)
+		}
+	}
+}
+
+func TestStoreClaim(t *testing.T) {
+	for name, s := range storesForTest(t) {
+		oldest := enqueueForTest(t, s, "StoreClaim", 1)
+		newest := enqueueForTest(t, s, "StoreClaim2", 2)
+
+		// not due yet
+		later := Task{
+			VideoId:       "StoreClaimLater",
+			Url:           "https://www.youtube.com/watch?v=StoreClaimLater",
+			NextAttemptAt: time.Now().Add(time.Hour).Unix(),
+		}
+		if err := s.Enqueue(&later); err != nil {
+			t.Fatal(err)
+		}
+
+		tasks, err := s.Claim("worker-1", 1)
+		if err != nil || len(tasks) != 1 || tasks[0].Id != oldest.Id || tasks[0].StartedAt == 0 {
+			t.Fatalf("%s: different claimed tasks! %+v %v", name, tasks, err)
+		}
+
+		tasks, err = s.Claim("worker-2", 5)
+		if err != nil || len(tasks) != 1 || tasks[0].Id != newest.Id {
+			t.Fatalf("%s: different claimed tasks! %+v %v", name, tasks, err)
+		}
+
+		leases, err := s.ListLeases()
+		if err != nil || len(leases) != 2 || leases[0].WorkerId != "worker-1" || leases[0].Id != oldest.Id {
+			t.Fatalf("%s: different leases! %+v %v", name, leases, err)
+		}
+
+		if err := s.Remove(oldest.Id); err != ErrTaskRunning {
+			t.Fatalf("%s: expected running error, got %v", name, err)
+		}
+
+		if err := s.Remove(later.Id); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.Remove(later.Id); err != ErrTaskNotFound {
+			t.Fatalf("%s: expected not found error, got %v", name, err)
+		}
+	}
+}
+
+func TestStoreReleaseAndRecover(t *testing.T) {
+	for name, s := range storesForTest(t) {
+		enqueueForTest(t, s, "StoreRelease", 1)
+
+		tasks, err := s.Claim("worker-1", 1)
+		if err != nil || len(tasks) != 1 {
+			t.Fatalf("%s: different claimed tasks! %+v %v", name, tasks, err)
+		}
+
+		if err := s.SaveProgress(Progress{Id: tasks[0].Id, Phase: PhaseDownloadVideo, Percent: 42}); err != nil {
+			t.Fatal(err)
+		}
+
+		if progress, err := s.GetProgress(tasks[0].Id); err != nil || progress.Percent != 42 {
+			t.Fatalf("%s: different progress! %+v %v", name, progress, err)
+		}
+
+		released := tasks[0]
+		released.Attempts = 1
+		released.NextAttemptAt = 3
+		if err := s.Release(released); err != nil {
+			t.Fatal(err)
+		}
+
+		task, _ := s.Get(released.Id)
+		if task.StartedAt != 0 || task.Attempts != 1 || task.NextAttemptAt != 3 {
+			t.Fatalf("%s: different released task! %+v", name, task)
+		}
+
+		if leases, _ := s.ListLeases(); len(leases) != 0 {
+			t.Fatalf("%s: lease is not released!", name)
+		}
+
+		if _, err := s.GetProgress(task.Id); err != sql.ErrNoRows {
+			t.Fatalf("%s: progress is not released! %v", name, err)
+		}
+
+		if _, err := s.Claim("worker-1", 1); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.Heartbeat(task.Id); err != nil {
+			t.Fatal(err)
+		}
+
+		if recovered, err := s.RecoverStaleLeases(time.Now().Add(-time.Minute).Unix()); err != nil || recovered != 0 {
+			t.Fatalf("%s: fresh lease is recovered! %d %v", name, recovered, err)
+		}
+
+		if recovered, err := s.RecoverStaleLeases(time.Now().Add(time.Minute).Unix()); err != nil || recovered != 1 {
+			t.Fatalf("%s: stale lease is not recovered! %d %v", name, recovered, err)
+		}
+
+		if task, _ := s.Get(task.Id); task.StartedAt != 0 {
+			t.Fatalf("%s: recovered task is started!", name)
+		}
+	}
+}
+
+func TestStoreFailAndRequeue(t *testing.T) {
+	for name, s := range storesForTest(t) {
+		enqueueForTest(t, s, "StoreFail", 1)
+
+		tasks, err := s.Claim("worker-1", 1)
+		if err != nil || len(tasks) != 1 {
+			t.Fatalf("%s: different claimed tasks! %+v %v", name, tasks, err)
+		}
+
+		failedTask := FailedTask{
+			Id:       tasks[0].Id,
+			VideoId:  tasks[0].VideoId,
+			Url:      tasks[0].Url,
+			FailedAt: 5,
+			Reason:   ReasonUnknown,
+		}
+		if err := s.Fail(failedTask); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := s.Get(failedTask.Id); err != ErrTaskNotFound {
+			t.Fatalf("%s: failed task is still queued! %v", name, err)
+		}
+
+		if leases, _ := s.ListLeases(); len(leases) != 0 {
+			t.Fatalf("%s: lease is not released!", name)
+		}
+
+		if failedTasks, err := s.ListFailedByVideoId("StoreFail"); err != nil || len(failedTasks) != 1 || failedTasks[0].FailedAt != 5 {
+			t.Fatalf("%s: different failed tasks! %+v %v", name, failedTasks, err)
+		}
+
+		// job ids of failed tasks are not reused
+		if task := enqueueForTest(t, s, "StoreFail2", 2); task.Id <= failedTask.Id {
+			t.Fatalf("%s: job id %d is reused!", name, task.Id)
+		}
+
+		requeued := Task{Id: failedTask.Id, VideoId: failedTask.VideoId, Url: failedTask.Url}
+		if err := s.Requeue(&requeued); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := s.Get(failedTask.Id); err != nil {
+			t.Fatalf("%s: task is not requeued! %v", name, err)
+		}
+
+		if _, err := s.GetFailed(failedTask.Id); err != ErrTaskNotFound {
+			t.Fatalf("%s: failed task is not removed! %v", name, err)
+		}
+
+		if err := s.Requeue(&requeued); err != ErrTaskNotFound {
+			t.Fatalf("%s: expected not found error, got %v", name, err)
+		}
+
+		if err := s.AddFailed(failedTask); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.RemoveFailed(failedTask.Id); err != nil {
+			t.Fatal(err)
+		}
+
+		if failedTasks, _ := s.ListFailed(); len(failedTasks) != 0 {
+			t.Fatalf("%s: failed task is not removed!", name)
+		}
+	}
+}
+
+func TestStoreFinish(t *testing.T) {
+	for name, s := range storesForTest(t) {
+		enqueueForTest(t, s, "StoreFinish", 1)
+
+		tasks, err := s.Claim("worker-1", 1)
+		if err != nil || len(tasks) != 1 {
+			t.Fatalf("%s: different claimed tasks! %+v %v", name, tasks, err)
+		}
+
+		if _, err := s.GetFinished(tasks[0].Id); err != ErrTaskNotFound {
+			t.Fatalf("%s: expected not found error, got %v", name, err)
+		}
+
+		finishedTask := FinishedTask{
+			Id:         tasks[0].Id,
+			VideoId:    tasks[0].VideoId,
+			Url:        tasks[0].Url,
+			OutputFile: "/tmp/output.mp4",
+			FormatIds:  FormatIds{"137", "140"},
+			FinishedAt: 5,
+		}
+		if err := s.Finish(finishedTask); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := s.Get(finishedTask.Id); err != ErrTaskNotFound {
+			t.Fatalf("%s: finished task is still queued! %v", name, err)
+		}
+
+		if leases, _ := s.ListLeases(); len(leases) != 0 {
+			t.Fatalf("%s: lease is not released!", name)
+		}
+
+		got, err := s.GetFinished(finishedTask.Id)
+		if err != nil || got.OutputFile != finishedTask.OutputFile || strings.Join(got.FormatIds, "+") != "137+140" || got.FinishedAt != 5 {
+			t.Fatalf("%s: different finished task! %+v %v", name, got, err)
+		}
+	}
+}
+
+func TestStoreWebhooks(t *testing.T) {
+	for name, s := range storesForTest(t) {
+		webhook := Webhook{Url: "https://example.com/hook", Events: []EventType{EventFailed}, CreatedAt: 1}
+		if err := s.AddWebhook(&webhook); err != nil {
+			t.Fatal(err)
+		}
+
+		webhooks, err := s.ListWebhooks()
+		if err != nil || len(webhooks) != 1 || webhooks[0].Id != webhook.Id || len(webhooks[0].Events) != 1 {
+			t.Fatalf("%s: different webhooks! %+v %v", name, webhooks, err)
+		}
+
+		delivery := WebhookDelivery{WebhookId: webhook.Id, Event: EventFailed, TaskId: 1, Attempt: 1, StatusCode: 200}
+		if err := s.AddWebhookDelivery(&delivery); err != nil {
+			t.Fatal(err)
+		}
+
+		deliveries, err := s.ListWebhookDeliveries(webhook.Id)
+		if err != nil || len(deliveries) != 1 || deliveries[0].Id != delivery.Id {
+			t.Fatalf("%s: different deliveries! %+v %v", name, deliveries, err)
+		}
+
+		if err := s.RemoveWebhook(webhook.Id); err != nil {
+			t.Fatal(err)
+		}
+
+		if webhooks, _ := s.ListWebhooks(); len(webhooks) != 0 {
+			t.Fatalf("%s: webhook is not removed!", name)
+		}
+	}
+}
+
+func TestRunTaskOnMemoryStore(t *testing.T) {
+	InitializeForTest(t)
+	SetStore(NewMemoryStore())
+
+	defaultQueue.SetDownloader(NewYoutubeDl(writeStubDownloaderForTest(t)))
+
+	defaultRetryPolicy := GetRetryPolicy()
+	SetRetryPolicy(RetryPolicy{MaxAttempts: 1})
+	defer SetRetryPolicy(defaultRetryPolicy)
+
+	for _, url := range []string{
+		"https://www.youtube.com/watch?v=MemoryStore",
+		"https://www.youtube.com/watch?v=MemoryStorefail",
+	} {
+		task := Task{VideoFormat: "135", AudioFormat: "140", Url: url, OutputPath: "/tmp/output"}
+		if err := task.QueueTask(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tasks, err := defaultQueue.popTasks("0", 2)
+	if err != nil || len(tasks) != 2 {
+		t.Fatalf("different popped tasks! %+v %v", tasks, err)
+	}
+
+	for _, task := range tasks {
+		if err := defaultQueue.runTask(context.Background(), task); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if tasks, _ := GetAllTasks(); len(tasks) != 0 {
+		t.Fatalf("tasks are not removed! %+v", tasks)
+	}
+
+	failedTasks, err := GetAllFailedTasks()
+	if err != nil || len(failedTasks) != 1 || failedTasks[0].VideoId != "MemoryStorefail" || failedTasks[0].ExitCode != 2 {
+		t.Fatalf("different failed tasks! %+v %v", failedTasks, err)
+	}
+}
@@ -1,65 +1,87 @@
 package queue
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net/url"
 	"os"
 	"os/exec"
-	"sync"
+	"strconv"
+	"syscall"
 	"time"
 )
 
+var (
+	ErrInvalidUrl    = errors.New("cannot find id.")
+	ErrDuplicateTask = errors.New("task is already queued.")
+	ErrTaskNotFound  = errors.New("task is not found.")
+	ErrTaskRunning   = errors.New("task is running.")
+)
+
 type Task struct {
-	Id          string `json:"id"`
-	VideoFormat string `json:"video_format"`
-	AudioFormat string `json:"audio_format"`
-	Url         string `json:"url"`
-	Title       string `json:"title"`
-	OutputPath  string `json:"output_path"`
-	Parameter   string `json:"parameter"`
-	CreatedAt   int64  `json:"created_at"`
-	UpdatedAt   int64  `json:"updated_at"`
-	StartedAt   int64  `json:"started_at"`
+	Id            int64      `json:"id"`
+	VideoId       string     `json:"video_id"`
+	VideoFormat   string     `json:"video_format"`
+	AudioFormat   string     `json:"audio_format"`
+	Url           string     `json:"url"`
+	Title         string     `json:"title"`
+	OutputPath    string     `json:"output_path"`
+	Parameters    Parameters `json:"parameters"`
+	CreatedAt     int64      `json:"created_at"`
+	UpdatedAt     int64      `json:"updated_at"`
+	StartedAt     int64      `json:"started_at"`
+	Attempts      int        `json:"attempts"`
+	NextAttemptAt int64      `json:"next_attempt_at"`
+	// Downloader names the downloader of the queue running the task,
+	// empty for its default downloader.
+	Downloader string          `json:"downloader"`
+	Options    DownloadOptions `json:"options"`
+	// Format is a format selection expression of youtube-dl, as
+	// "bestvideo[height<=1080]+bestaudio/best", selecting the formats
+	// instead of VideoFormat and AudioFormat, see FormatSpec.
+	Format string `json:"format"`
+
+	// file written by the last Exec, as reported by youtube-dl
+	outputFile string
+	// format ids downloaded by the last Exec
+	formatIds []string
+	// size of the task log when the last Exec started
+	logOffset int64
 }
 
 func (t Task) String() string {
 	return fmt.Sprintf(
-		"Id: %s\tVideoFormat:%s\tAudioFormat:%s\tUrl:%s\tTitle:%s\tOutputPath:%s\tParameter:%s",
+		"Id: %d\tVideoId:%s\tVideoFormat:%s\tAudioFormat:%s\tUrl:%s\tTitle:%s\tOutputPath:%s\tParameters:%s",
 		t.Id,
+		t.VideoId,
 		t.VideoFormat,
 		t.AudioFormat,
 		t.Url,
 		t.Title,
 		t.OutputPath,
-		t.Parameter,
+		t.Parameters,
 	)
 }
 
-func (t *Task) Exec(limits chan struct{}, wg sync.WaitGroup) (err error) {
-	defer func() {
-		<-limits
-		wg.Done()
-	}()
-
-	limits <- struct{}{}
-
-	params := []string{
-		"--ffmpeg-location", ffmpegPath, // ffmpeg path
-		"-f", t.VideoFormat + "+" + t.AudioFormat, // format
-		"-o", t.OutputPath, // file output
-	}
+// Exec runs the downloader of the default queue for t.
+func (t *Task) Exec(ctx context.Context) (err error) {
+	return defaultQueue.Exec(ctx, t)
+}
 
-	if t.Parameter != "" {
-		params = append(params, t.Parameter)
+// Exec runs the downloader selected by t, writing its output into the task log.
+func (q *Queue) Exec(ctx context.Context, t *Task) (err error) {
+	downloader, err := q.downloaderOf(*t)
+	if err != nil {
+		return err
 	}
 
-	params = append(params, t.Url)
+	params := downloader.Args(*t, q.ffmpeg)
 
 	// youtube-dl execute log path
-	sep := string(os.PathSeparator)
 	taskLogFile, err := os.OpenFile(
-		logDirectory+sep+t.Id+".log",
+		q.LogPath(t.Id),
 		os.O_APPEND|os.O_CREATE|os.O_WRONLY,
 		0666,
 	)
@@ -69,226 +91,315 @@ func (t *Task) Exec(limits chan struct{}, wg sync.WaitGroup) (err error) {
 
 	defer taskLogFile.Close()
 
-	return t.Command(taskLogFile, youtubeDlPath, params...)
+	// the log is appended by every attempt, failures are read from here
+	info, err := taskLogFile.Stat()
+	if err != nil {
+		return err
+	}
+	t.logOffset = info.Size()
+
+	tracker := newProgressTracker(q, downloader, t)
+	q.registerProgress(tracker)
+	defer q.unregisterProgress(tracker)
+
+	persistCtx, stopPersist := context.WithCancel(context.Background())
+	defer stopPersist()
+	go q.persistProgress(persistCtx, tracker)
+
+	err = t.Command(ctx, io.MultiWriter(taskLogFile, tracker), downloader.Path(), params...)
+	tracker.readInfoJsons(hasString(t.Parameters, "--write-info-json"))
+	t.outputFile = tracker.Progress().Filename
+	t.formatIds = tracker.FormatIds()
+
+	return err
+}
+
+func (t Task) LogPath() string {
+	return defaultQueue.LogPath(t.Id)
+}
+
+// LogPath names the youtube-dl log of a task after its job id.
+func (q *Queue) LogPath(id int64) string {
+	return logPath(q.logDirectory, id)
 }
 
-func (t *Task) Command(file *os.File, path string, params ...string) error {
+func logPath(logDirectory string, id int64) string {
+	sep := string(os.PathSeparator)
+	return logDirectory + sep + strconv.FormatInt(id, 10) + ".log"
+}
+
+// Command runs the downloader in a process group of its own, so that
+// cancelling ctx kills its ffmpeg and other children along with it.
+// Otherwise they would hold output open, and Wait would wait for them.
+func (t *Task) Command(ctx context.Context, output io.Writer, path string, params ...string) error {
 	command := exec.Command(path, params...)
-	command.Stdout = file
-	command.Stderr = file
+	command.Stdout = output
+	command.Stderr = output
+	command.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 	err := command.Start()
 	if err != nil {
 		return err
 	}
 
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			syscall.Kill(-command.Process.Pid, syscall.SIGKILL)
+		case <-done:
+		}
+	}()
+
 	return command.Wait()
 }
 
-func (t *Task) SetId() error {
-	if t.Id != "" {
+// SetVideoId parses the video id out of the url.
+func (t *Task) SetVideoId() error {
+	if t.VideoId != "" {
 		return nil
 	}
 
 	urlStruct, err := url.Parse(t.Url)
 
 	if err != nil {
-		return err
+		return ErrInvalidUrl
 	}
 
 	query := urlStruct.Query()
-	if v, ok := query["v"]; ok {
-		t.Id = v[0]
+	if v, ok := query["v"]; ok && v[0] != "" {
+		t.VideoId = v[0]
 		return nil
 	} else {
-		return errors.New("cannot find id.")
+		return ErrInvalidUrl
 	}
 }
 
+// AddTask inserts the task, under a new job id unless it has one.
 func (t *Task) AddTask() (err error) {
-	stmt, err := createSqlStmt(`INSERT INTO tasks (id, video_format, audio_format, url, title, output_path, parameter, created_at, updated_at, started_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
-	if err != nil {
+	return defaultQueue.AddTask(t)
+}
+
+func (q *Queue) AddTask(t *Task) (err error) {
+	if err := t.SetVideoId(); err != nil {
 		return err
 	}
 
-	if err := t.SetId(); err != nil {
+	if err := t.Parameters.validate(); err != nil {
 		return err
 	}
 
-	_, err = stmt.Exec(
-		t.Id,
-		t.VideoFormat,
-		t.AudioFormat,
-		t.Url,
-		t.Title,
-		t.OutputPath,
-		t.Parameter,
-		t.CreatedAt,
-		t.UpdatedAt,
-		t.StartedAt,
-	)
+	if err := t.Options.validate(); err != nil {
+		return err
+	}
 
-	return err
+	if err := t.validateFormat(); err != nil {
+		return err
+	}
+
+	// a queue without downloaders only queues tasks for other processes
+	if _, err := q.downloaderOf(*t); t.Downloader != "" && len(q.downloaders) > 0 && err != nil {
+		return err
+	}
+
+	return q.store.Enqueue(t)
 }
 
 func (t *Task) QueueTask() (err error) {
+	return defaultQueue.QueueTask(t)
+}
+
+// QueueTask adds t as queued now, and wakes the idle workers for it.
+func (q *Queue) QueueTask(t *Task) (err error) {
 	t.CreatedAt = time.Now().Unix()
 	t.UpdatedAt = time.Now().Unix()
 
-	return t.AddTask()
+	if err = q.AddTask(t); err != nil {
+		return err
+	}
+
+	q.publishTask(EventQueued, *t)
+	q.wakeWorkers()
+
+	return nil
 }
 
 func (t *Task) StartTask() (err error) {
-	stmt, err := createSqlStmt(`UPDATE tasks SET started_at = ? WHERE id = ?`)
-	if err != nil {
+	return defaultQueue.StartTask(t)
+}
+
+func (q *Queue) StartTask(t *Task) (err error) {
+	t.StartedAt = time.Now().Unix()
+
+	return q.store.MarkStarted(t.Id, t.StartedAt)
+}
+
+// resetTask puts an interrupted task back into the queue.
+func (q *Queue) resetTask(t *Task) (err error) {
+	reset := *t
+	reset.StartedAt = 0
+
+	if err = q.store.Release(reset); err != nil {
 		return err
 	}
 
-	t.StartedAt = time.Now().Unix()
-	_, err = stmt.Exec(t.StartedAt, t.Id)
+	*t = reset
+	q.publishTask(EventRequeued, *t)
 
-	return err
+	return nil
+}
+
+// RemoveTask deletes a task which is not started yet.
+func (t *Task) RemoveTask() (err error) {
+	return defaultQueue.RemoveTask(t.Id)
+}
+
+func (q *Queue) RemoveTask(id int64) (err error) {
+	return q.store.Remove(id)
+}
+
+// retryTask puts a failed task back into the queue,
+// to be popped again after the delay of policy.
+func (q *Queue) retryTask(t *Task, policy RetryPolicy) (err error) {
+	now := time.Now()
+
+	retried := *t
+	retried.StartedAt = 0
+	retried.Attempts = t.Attempts + 1
+	retried.NextAttemptAt = now.Add(policy.Delay(retried.Attempts)).Unix()
+	retried.UpdatedAt = now.Unix()
+
+	if err = q.store.Release(retried); err != nil {
+		return err
+	}
+
+	*t = retried
+	q.publishTask(EventRequeued, *t)
+
+	return nil
 }
 
 // Task削除
 func (t *Task) FinishTask() (err error) {
-	stmt, err := createSqlStmt(`DELETE FROM tasks WHERE id = ?`)
-	if err != nil {
+	return defaultQueue.FinishTask(t)
+}
+
+// FinishTask removes the task from the queue, recording it in the finished
+// tasks with the output file and the format ids of its last run.
+func (q *Queue) FinishTask(t *Task) (err error) {
+	finishedTask := FinishedTask{
+		Id:         t.Id,
+		VideoId:    t.VideoId,
+		Url:        t.Url,
+		OutputFile: t.outputFile,
+		FormatIds:  t.formatIds,
+		FinishedAt: time.Now().Unix(),
+	}
+	if err = q.store.Finish(finishedTask); err != nil {
 		return err
 	}
 
-	_, err = stmt.Exec(t.Id)
+	q.publish(Event{Type: EventFinished, Task: *t, OutputFile: t.outputFile, FormatIds: t.formatIds})
 
-	return err
+	return nil
+}
+
+func (t *Task) AddFailedTask(cause error) (failedTask FailedTask, err error) {
+	return defaultQueue.FailTask(t, cause)
 }
 
-func (t *Task) AddFailedTask() (failedTask FailedTask, err error) {
+// FailTask moves the task into failed_tasks in one transaction,
+// recording the exit status of cause, the task log path and the tail
+// of the last Exec, and the failure reason classified from them.
+func (q *Queue) FailTask(t *Task, cause error) (failedTask FailedTask, err error) {
+	logTail, err := readLogTail(q.LogPath(t.Id), t.logOffset, logTailLines)
+	if err != nil && !os.IsNotExist(err) {
+		return failedTask, err
+	}
+
 	failedTask = FailedTask{
 		Id:          t.Id,
+		VideoId:     t.VideoId,
 		VideoFormat: t.VideoFormat,
 		AudioFormat: t.AudioFormat,
 		Url:         t.Url,
 		Title:       t.Title,
 		OutputPath:  t.OutputPath,
-		Parameter:   t.Parameter,
+		Parameters:  t.Parameters,
 		CreatedAt:   t.CreatedAt,
 		UpdatedAt:   t.UpdatedAt,
 		StartedAt:   t.StartedAt,
+		FailedAt:    time.Now().Unix(),
+		ExitCode:    exitCode(cause),
+		LogPath:     q.LogPath(t.Id),
+		Reason:      q.classifyFailure(*t, logTail, cause),
+		LogTail:     logTail,
+		Attempts:    t.Attempts + 1,
+		Downloader:  t.Downloader,
+		Options:     t.Options,
+		Format:      t.Format,
+		FormatIds:   t.formatIds,
 	}
 
-	err = failedTask.AddTask()
+	if err = q.store.Fail(failedTask); err != nil {
+		return failedTask, err
+	}
 
-	return failedTask, err
-}
+	q.publish(Event{Type: EventFailed, Task: *t, FailedTask: &failedTask, OutputFile: t.outputFile, FormatIds: t.formatIds})
 
-func popTasks() (tasks []Task, err error) {
-	stmt, err := createSqlStmt(`SELECT * FROM tasks ORDER BY created_at ASC LIMIT ?`)
-	if err != nil {
-		return tasks, err
-	}
+	return failedTask, nil
+}
 
-	rows, err := stmt.Query(workerNum)
-	if err != nil {
-		return tasks, err
+// exitCode returns the process exit status carried by err,
+// or -1 when youtube-dl could not be run at all.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
 	}
 
-	tasks = make([]Task, 0, workerNum)
-
-	defer rows.Close()
-	for rows.Next() {
-		task := Task{}
-		err = rows.Scan(
-			&task.Id,
-			&task.VideoFormat,
-			&task.AudioFormat,
-			&task.Url,
-			&task.Title,
-			&task.OutputPath,
-			&task.Parameter,
-			&task.CreatedAt,
-			&task.UpdatedAt,
-			&task.StartedAt,
-		)
-		if err != nil {
-			return []Task{}, err
-		}
-		tasks = append(tasks, task)
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode()
 	}
 
-	return tasks, err
+	return -1
 }
 
-func GetAllTasks() (tasks []Task, err error) {
-	stmt, err := createSqlStmt(`SELECT * FROM tasks ORDER BY created_at DESC, updated_at DESC`)
-	if err != nil {
+// popTasks claims up to limit tasks which are not started yet for workerId.
+func (q *Queue) popTasks(workerId string, limit int) (tasks []Task, err error) {
+	if tasks, err = q.store.Claim(workerId, limit); err != nil {
 		return tasks, err
 	}
 
-	rows, err := stmt.Query()
-	if err != nil {
-		return tasks, err
+	for _, task := range tasks {
+		q.publishTask(EventStarted, task)
 	}
 
-	tasks = []Task{}
-
-	defer rows.Close()
-	for rows.Next() {
-		task := Task{}
-		err = rows.Scan(
-			&task.Id,
-			&task.VideoFormat,
-			&task.AudioFormat,
-			&task.Url,
-			&task.Title,
-			&task.OutputPath,
-			&task.Parameter,
-			&task.CreatedAt,
-			&task.UpdatedAt,
-			&task.StartedAt,
-		)
-		if err != nil {
-			return []Task{}, err
-		}
-		tasks = append(tasks, task)
-	}
+	return tasks, nil
+}
 
-	return tasks, err
+func GetAllTasks() (tasks []Task, err error) {
+	return defaultQueue.GetAllTasks()
 }
 
-// 後でファイル移動
-func GetTasksMapByIds(ids []string) (tasks []Task, err error) {
-	stmt, err := createSqlStmt(`SELECT * FROM tasks WHERE id IN (?) ORDER BY created_at DESC, updated_at DESC`)
-	if err != nil {
-		return tasks, err
-	}
+func (q *Queue) GetAllTasks() (tasks []Task, err error) {
+	return q.store.List()
+}
 
-	rows, err := stmt.Query(ids)
-	if err != nil {
-		return tasks, err
-	}
+// GetTask returns ErrTaskNotFound when no task has the job id.
+func GetTask(id int64) (task Task, err error) {
+	return defaultQueue.GetTask(id)
+}
 
-	tasks = []Task{}
-
-	defer rows.Close()
-	for rows.Next() {
-		task := Task{}
-		err = rows.Scan(
-			&task.Id,
-			&task.VideoFormat,
-			&task.AudioFormat,
-			&task.Url,
-			&task.Title,
-			&task.OutputPath,
-			&task.Parameter,
-			&task.CreatedAt,
-			&task.UpdatedAt,
-			&task.StartedAt,
-		)
-		if err != nil {
-			return []Task{}, err
-		}
+func (q *Queue) GetTask(id int64) (task Task, err error) {
+	return q.store.Get(id)
+}
 
-		tasks = append(tasks, task)
-	}
+// GetTasksByVideoId returns the tasks downloading a video in any format.
+func GetTasksByVideoId(videoId string) (tasks []Task, err error) {
+	return defaultQueue.GetTasksByVideoId(videoId)
+}
 
-	return tasks, err
+func (q *Queue) GetTasksByVideoId(videoId string) (tasks []Task, err error) {
+	return q.store.ListByVideoId(videoId)
 }
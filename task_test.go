@@ -1,13 +1,27 @@
 package queue
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// db is the db of the store set by InitializeForTest, to check rows directly.
+var db *sql.DB
+
 func InitializeForTest(t *testing.T) {
 	sqlitePath, err := TempFileName()
 	if err != nil {
@@ -19,37 +33,86 @@ func InitializeForTest(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	InitializeSchema(testDb)
+	if err := InitializeSchema(testDb); err != nil {
+		t.Fatal(err)
+	}
+	db = testDb
+
+	logDir, err := ioutil.TempDir("", "youtube-dl-queue-log-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defaultQueue.downloader = nil
+	defaultQueue.downloaders = make(map[string]Downloader)
+	defaultQueue.ffmpegPath = ""
+	defaultQueue.ffmpeg = ""
+	defaultQueue.logDirectory = logDir
+}
+
+// stub youtube-dl: fails with exit status 2 when any argument contains "fail",
+// or is rate limited when one contains "flaky", and keeps running for a while
+// when any argument contains "sleep", or its child does for "forking".
+const stubDownloaderScript = `#!/bin/sh
+for arg in "$@"; do
+	case "$arg" in
+		*fail*) echo "ERROR: Video unavailable" >&2; exit 2 ;;
+		*flaky*) echo "ERROR: HTTP Error 429: Too Many Requests" >&2; exit 2 ;;
+		*forking*) sleep 5 & wait; exit 0 ;;
+		*sleeplong*) exec sleep 30 ;;
+		*sleep*) exec sleep 1 ;;
+	esac
+done
+echo "[download] 100% of 1.00MiB"
+`
+
+func writeStubDownloaderForTest(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "youtube-dl-queue-bin-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "youtube-dl")
+	if err := ioutil.WriteFile(path, []byte(stubDownloaderScript), 0755); err != nil {
+		t.Fatal(err)
+	}
 
-	youtubeDlPath = ""
-	ffmpegPath = ""
+	return path
 }
 
-func insertTaskForTest(t *testing.T, task Task) {
-	task.SetId()
+func insertTaskForTest(t *testing.T, task Task) Task {
+	task.SetVideoId()
 
-	if _, err := db.Exec(
-		`INSERT INTO tasks (id, video_format, audio_format, url, title, output_path, parameter, created_at, updated_at, started_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		&task.Id,
+	result, err := db.Exec(
+		`INSERT INTO tasks (video_id, video_format, audio_format, url, title, output_path, parameter, created_at, updated_at, started_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		&task.VideoId,
 		&task.VideoFormat,
 		&task.AudioFormat,
 		&task.Url,
 		&task.Title,
 		&task.OutputPath,
-		&task.Parameter,
+		&task.Parameters,
 		&task.CreatedAt,
 		&task.UpdatedAt,
 		0,
-	); err != nil {
+	)
+	if err != nil {
 		t.Fatal(err)
 	}
+
+	if task.Id, err = result.LastInsertId(); err != nil {
+		t.Fatal(err)
+	}
+
+	return task
 }
 
 func getTaskForTest(t *testing.T) Task {
 	task := Task{}
 
-	if err := db.QueryRow(`SELECT id, video_format, audio_format, title, created_at, updated_at FROM tasks ORDER BY id DESC LIMIT 1`).Scan(
+	if err := db.QueryRow(`SELECT id, video_id, video_format, audio_format, title, created_at, updated_at FROM tasks ORDER BY id DESC LIMIT 1`).Scan(
 		&task.Id,
+		&task.VideoId,
 		&task.VideoFormat,
 		&task.AudioFormat,
 		&task.Title,
@@ -62,11 +125,12 @@ func getTaskForTest(t *testing.T) Task {
 	return task
 }
 
-func getTaskByIdForTest(t *testing.T, id string, videoFormat string, audioFormat string) Task {
+func getTaskByIdForTest(t *testing.T, id int64) Task {
 	task := Task{}
 
-	if err := db.QueryRow(`SELECT id, video_format, audio_format, title, started_at FROM tasks WHERE id = ? AND video_format = ? AND audio_format = ?`, id, videoFormat, audioFormat).Scan(
+	if err := db.QueryRow(`SELECT id, video_id, video_format, audio_format, title, started_at FROM tasks WHERE id = ?`, id).Scan(
 		&task.Id,
+		&task.VideoId,
 		&task.VideoFormat,
 		&task.AudioFormat,
 		&task.Title,
@@ -78,22 +142,122 @@ func getTaskByIdForTest(t *testing.T, id string, videoFormat string, audioFormat
 	return task
 }
 
+// insertFormatVariantsForTest queues the same video in several formats.
+func insertFormatVariantsForTest(t *testing.T, videoId string) []Task {
+	tasks := []Task{}
+	for _, formats := range [][2]string{{"137", "140"}, {"136", "140"}, {"137", "251"}} {
+		tasks = append(tasks, insertTaskForTest(t, Task{
+			VideoFormat: formats[0],
+			AudioFormat: formats[1],
+			Url:         "https://www.youtube.com/watch?v=" + videoId,
+			Title:       "Test" + videoId,
+			OutputPath:  "/tmp/output",
+		}))
+	}
+
+	return tasks
+}
+
+// checkOtherVariantsForTest fails unless the variants other than tasks[0] are untouched.
+func checkOtherVariantsForTest(t *testing.T, tasks []Task) {
+	for _, task := range tasks[1:] {
+		other, err := GetTask(task.Id)
+		if err != nil {
+			t.Fatalf("%d: %s", task.Id, err)
+		}
+
+		if other.StartedAt != 0 || other.Attempts != 0 {
+			t.Fatalf("%d is changed! %+v", task.Id, other)
+		}
+	}
+}
+
 func TestExec(t *testing.T) {
 	InitializeForTest(t)
+
+	defaultQueue.SetDownloader(NewYoutubeDl(writeStubDownloaderForTest(t)))
+
+	task := Task{
+		Id:          1,
+		VideoId:     "Exec",
+		VideoFormat: "135",
+		AudioFormat: "140",
+		Url:         "https://www.youtube.com/watch?v=Exec",
+		OutputPath:  "/tmp/output",
+	}
+
+	if err := task.Exec(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(task.LogPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(string(b), "[download] 100%") {
+		t.Fatalf("not written task log!")
+	}
+
+	failTask := Task{
+		Id:          2,
+		VideoId:     "ExecFail",
+		VideoFormat: "135",
+		AudioFormat: "140",
+		Url:         "https://www.youtube.com/watch?v=fail",
+		OutputPath:  "/tmp/output",
+	}
+
+	err = failTask.Exec(context.Background())
+	if _, ok := err.(*exec.ExitError); !ok {
+		t.Fatalf("expected exit error, got %v", err)
+	}
+
+	if exitCode(err) != 2 {
+		t.Fatalf("different exit code! %d", exitCode(err))
+	}
 }
 
-func TestSetId(t *testing.T) {
+func TestExecKillsChildren(t *testing.T) {
+	InitializeForTest(t)
+
+	defaultQueue.SetDownloader(NewYoutubeDl(writeStubDownloaderForTest(t)))
+
+	// the child, as ffmpeg, holds the output of youtube-dl open
+	task := Task{
+		Id:          1,
+		VideoId:     "ExecKillsChildren",
+		VideoFormat: "135",
+		AudioFormat: "140",
+		Url:         "https://www.youtube.com/watch?v=forking",
+		OutputPath:  "/tmp/output",
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	started := time.Now()
+	if err := task.Exec(ctx); exitCode(err) != -1 {
+		t.Fatalf("expected killed, got %v", err)
+	}
+
+	if elapsed := time.Since(started); elapsed > 2*time.Second {
+		t.Fatalf("waited for the child! %s", elapsed)
+	}
+}
+
+func TestSetVideoId(t *testing.T) {
 	task := Task{
 		Url: "https://www.youtube.com/watch?v=abcdefg",
 	}
 
-	err := task.SetId()
+	err := task.SetVideoId()
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if task.Id != "abcdefg" {
-		t.Fatalf("Cannot extract Id!")
+	if task.VideoId != "abcdefg" {
+		t.Fatalf("Cannot extract VideoId!")
 	}
 }
 
@@ -106,13 +270,88 @@ func TestAddTask(t *testing.T) {
 		Url:         "https://www.youtube.com/watch?v=AddTask",
 		Title:       "TestAddTask",
 		OutputPath:  "/tmp/output",
-		Parameter:   "",
+		Parameters:  nil,
 	}
 
 	err := task.AddTask()
 	if err != nil {
 		t.Fatal(err)
 	}
+
+	if task.Id == 0 {
+		t.Fatalf("Not set Id!")
+	}
+
+	duplicate := task
+	duplicate.Id = 0
+	if err := duplicate.AddTask(); err != ErrDuplicateTask {
+		t.Fatalf("expected duplicate error, got %v", err)
+	}
+
+	// the same video with other options is another job
+	other := task
+	other.Id = 0
+	other.OutputPath = "/tmp/other"
+	if err := other.AddTask(); err != nil {
+		t.Fatal(err)
+	}
+
+	if other.Id == task.Id {
+		t.Fatalf("same job id! %d", other.Id)
+	}
+
+	invalid := Task{Url: "https://www.youtube.com/"}
+	if err := invalid.AddTask(); err != ErrInvalidUrl {
+		t.Fatalf("expected invalid url error, got %v", err)
+	}
+}
+
+func TestRemoveTask(t *testing.T) {
+	InitializeForTest(t)
+
+	ids := []int64{}
+	for _, url := range []string{
+		"https://www.youtube.com/watch?v=RemoveTask",
+		"https://www.youtube.com/watch?v=RemoveTaskRunning",
+	} {
+		ids = append(ids, insertTaskForTest(t, Task{
+			VideoFormat: "135",
+			AudioFormat: "140",
+			Url:         url,
+			Title:       "TestRemoveTask",
+			OutputPath:  "/tmp/output",
+		}).Id)
+	}
+
+	task, err := GetTask(ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := task.RemoveTask(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := GetTask(ids[0]); err != ErrTaskNotFound {
+		t.Fatalf("expected not found error, got %v", err)
+	}
+
+	if err := task.RemoveTask(); err != ErrTaskNotFound {
+		t.Fatalf("expected not found error, got %v", err)
+	}
+
+	running, err := GetTask(ids[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := running.StartTask(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := running.RemoveTask(); err != ErrTaskRunning {
+		t.Fatalf("expected running error, got %v", err)
+	}
 }
 
 func TestQueueTask(t *testing.T) {
@@ -124,7 +363,7 @@ func TestQueueTask(t *testing.T) {
 		Url:         "https://www.youtube.com/watch?v=QueueTask",
 		Title:       "TestQueueTask",
 		OutputPath:  "/tmp/output",
-		Parameter:   "",
+		Parameters:  nil,
 	}
 
 	err := task.QueueTask()
@@ -146,7 +385,7 @@ func TestStartTask(t *testing.T) {
 		Url:         "https://www.youtube.com/watch?v=StartTask",
 		Title:       "TestStartTask",
 		OutputPath:  "/tmp/output",
-		Parameter:   "",
+		Parameters:  nil,
 		CreatedAt:   0,
 		UpdatedAt:   0,
 	})
@@ -158,7 +397,7 @@ func TestStartTask(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	targetTask := getTaskByIdForTest(t, task.Id, task.VideoFormat, task.AudioFormat)
+	targetTask := getTaskByIdForTest(t, task.Id)
 	if targetTask.StartedAt == 0 {
 		t.Fatalf("Not set StartedAt!")
 	}
@@ -173,7 +412,7 @@ func TestFinishTask(t *testing.T) {
 		Url:         "https://www.youtube.com/watch?v=FinishTask",
 		Title:       "TestFinishTask",
 		OutputPath:  "/tmp/output",
-		Parameter:   "",
+		Parameters:  nil,
 		CreatedAt:   0,
 		UpdatedAt:   0,
 	})
@@ -193,6 +432,86 @@ func TestFinishTask(t *testing.T) {
 	}
 }
 
+func TestStartTaskFormatVariants(t *testing.T) {
+	InitializeForTest(t)
+
+	tasks := insertFormatVariantsForTest(t, "StartTaskFormatVariants")
+
+	if err := tasks[0].StartTask(); err != nil {
+		t.Fatal(err)
+	}
+
+	if started, _ := GetTask(tasks[0].Id); started.StartedAt == 0 {
+		t.Fatalf("Not set StartedAt!")
+	}
+
+	checkOtherVariantsForTest(t, tasks)
+}
+
+func TestFinishTaskFormatVariants(t *testing.T) {
+	InitializeForTest(t)
+
+	tasks := insertFormatVariantsForTest(t, "FinishTaskFormatVariants")
+
+	if err := tasks[0].FinishTask(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := GetTask(tasks[0].Id); err != ErrTaskNotFound {
+		t.Fatalf("expected not found error, got %v", err)
+	}
+
+	checkOtherVariantsForTest(t, tasks)
+}
+
+func TestAddFailedTaskFormatVariants(t *testing.T) {
+	InitializeForTest(t)
+
+	tasks := insertFormatVariantsForTest(t, "AddFailedTaskFormatVariants")
+
+	if _, err := tasks[0].AddFailedTask(errors.New("cannot run youtube-dl")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := GetTask(tasks[0].Id); err != ErrTaskNotFound {
+		t.Fatalf("expected not found error, got %v", err)
+	}
+
+	checkOtherVariantsForTest(t, tasks)
+}
+
+func TestRetryTaskFormatVariants(t *testing.T) {
+	InitializeForTest(t)
+
+	tasks := insertFormatVariantsForTest(t, "RetryTaskFormatVariants")
+	for i := range tasks {
+		if err := tasks[i].StartTask(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := defaultQueue.retryTask(&tasks[0], GetRetryPolicy()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := defaultQueue.resetTask(&tasks[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	retried, _ := GetTask(tasks[0].Id)
+	if retried.StartedAt != 0 || retried.Attempts != 1 {
+		t.Fatalf("task is not retried! %+v", retried)
+	}
+
+	if reset, _ := GetTask(tasks[1].Id); reset.StartedAt != 0 || reset.Attempts != 0 {
+		t.Fatalf("task is not reset! %+v", reset)
+	}
+
+	if running, _ := GetTask(tasks[2].Id); running.StartedAt == 0 {
+		t.Fatalf("running task is reset! %+v", running)
+	}
+}
+
 func TestAddFailedTask(t *testing.T) {
 	InitializeForTest(t)
 
@@ -202,21 +521,56 @@ func TestAddFailedTask(t *testing.T) {
 		Url:         "https://www.youtube.com/watch?v=AddFailedTask",
 		Title:       "TestAddFailedTask",
 		OutputPath:  "/tmp/output",
-		Parameter:   "",
+		Parameters:  nil,
 		CreatedAt:   0,
 		UpdatedAt:   0,
 	})
 
 	task := getTaskForTest(t)
+	// as parsed from the output of youtube-dl
+	task.formatIds = FormatIds{"135", "140"}
+
+	s := defaultQueue.Subscribe(1)
+	defer s.Unsubscribe()
+
+	failedTask, err := task.AddFailedTask(errors.New("cannot run youtube-dl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if event := <-s.C; event.Type != EventFailed || strings.Join(event.FormatIds, "+") != "135+140" {
+		t.Fatalf("different failed event! %+v", event)
+	}
 
-	failedTask, err := task.AddFailedTask()
+	stored, err := GetFailedTask(task.Id)
 	if err != nil {
 		t.Fatal(err)
 	}
 
+	if strings.Join(stored.FormatIds, "+") != "135+140" {
+		t.Fatalf("different format ids! %q", stored.FormatIds)
+	}
+
 	if failedTask.FailedAt == 0 {
 		t.Fatalf("Not set FailedAt!")
 	}
+
+	if failedTask.ExitCode != -1 {
+		t.Fatalf("different exit code! %d", failedTask.ExitCode)
+	}
+
+	if failedTask.LogPath != task.LogPath() {
+		t.Fatalf("Not set LogPath!")
+	}
+
+	count := 0
+	if err := db.QueryRow(`SELECT COUNT(*) FROM tasks WHERE id = ?`, task.Id).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 0 {
+		t.Fatalf("Failed delete task!")
+	}
 }
 
 func TestPopTasks(t *testing.T) {
@@ -228,19 +582,221 @@ func TestPopTasks(t *testing.T) {
 		Url:         "https://www.youtube.com/watch?v=popTasks",
 		Title:       "TestPopTasks",
 		OutputPath:  "/tmp/output",
-		Parameter:   "",
+		Parameters:  nil,
 		CreatedAt:   0,
 		UpdatedAt:   0,
 	})
 
-	tasks, err := popTasks()
+	tasks, err := defaultQueue.popTasks("0", 1)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if len(tasks) != workerNum {
+	if len(tasks) != 1 {
 		t.Fatalf("different tasks size!")
 	}
+
+	if tasks[0].StartedAt == 0 {
+		t.Fatalf("Not set StartedAt!")
+	}
+
+	tasks, err = defaultQueue.popTasks("0", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tasks) != 0 {
+		t.Fatalf("started task is popped again!")
+	}
+}
+
+func TestPopTasksOfReusedWorkerId(t *testing.T) {
+	InitializeForTest(t)
+
+	for _, videoId := range []string{"PopTasksReusedLeased", "PopTasksReused"} {
+		insertTaskForTest(t, Task{
+			VideoFormat: "135",
+			AudioFormat: "140",
+			Url:         "https://www.youtube.com/watch?v=" + videoId,
+			OutputPath:  "/tmp/output",
+		})
+	}
+
+	leased, err := GetTasksByVideoId("PopTasksReusedLeased")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// left by an earlier worker of the same id, before it started the task
+	if _, err := db.Exec(`INSERT INTO current_task (id, worker_id, pid, heartbeat_at) VALUES (?, '0', ?, ?)`, leased[0].Id, os.Getpid(), time.Now().Unix()); err != nil {
+		t.Fatal(err)
+	}
+
+	tasks, err := defaultQueue.popTasks("0", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tasks) != 1 || tasks[0].VideoId != "PopTasksReused" {
+		t.Fatalf("different tasks! %+v", tasks)
+	}
+}
+
+func TestPopTasksConcurrently(t *testing.T) {
+	InitializeForTest(t)
+
+	for i := 1; i <= 20; i++ {
+		insertTaskForTest(t, Task{
+			VideoFormat: "135",
+			AudioFormat: "140",
+			Url:         "https://www.youtube.com/watch?v=PopTasksConcurrently" + strconv.Itoa(i),
+			Title:       "TestPopTasksConcurrently" + strconv.Itoa(i),
+			OutputPath:  "/tmp/output",
+		})
+	}
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	popped := map[int64]int{}
+
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(workerId string) {
+			defer wg.Done()
+			for {
+				tasks, err := defaultQueue.popTasks(workerId, 1)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if len(tasks) == 0 {
+					return
+				}
+
+				mutex.Lock()
+				popped[tasks[0].Id] += 1
+				mutex.Unlock()
+			}
+		}(strconv.Itoa(i))
+	}
+
+	wg.Wait()
+
+	if len(popped) != 20 {
+		t.Fatalf("different popped tasks size! %d", len(popped))
+	}
+
+	for id, count := range popped {
+		if count != 1 {
+			t.Fatalf("task %d is popped %d times!", id, count)
+		}
+	}
+}
+
+// TestPopTasksHelperProcess pops tasks from another process in TestPopTasksAcrossProcesses.
+func TestPopTasksHelperProcess(t *testing.T) {
+	sqlitePath := os.Getenv("YOUTUBE_DL_QUEUE_TEST_DB")
+	if sqlitePath == "" {
+		return
+	}
+
+	testDb, err := sql.Open("sqlite3", sqlitePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := InitializeSchema(testDb); err != nil {
+		t.Fatal(err)
+	}
+
+	workerId := os.Getenv("YOUTUBE_DL_QUEUE_TEST_WORKER")
+	for {
+		tasks, err := defaultQueue.popTasks(workerId, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tasks) == 0 {
+			return
+		}
+
+		fmt.Printf("popped:%d\n", tasks[0].Id)
+	}
+}
+
+func TestPopTasksAcrossProcesses(t *testing.T) {
+	InitializeForTest(t)
+
+	sqlitePath, err := TempFileName()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testDb, err := sql.Open("sqlite3", sqlitePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := InitializeSchema(testDb); err != nil {
+		t.Fatal(err)
+	}
+	db = testDb
+
+	for i := 1; i <= 30; i++ {
+		insertTaskForTest(t, Task{
+			VideoFormat: "135",
+			AudioFormat: "140",
+			Url:         "https://www.youtube.com/watch?v=PopTasksAcrossProcesses" + strconv.Itoa(i),
+			Title:       "TestPopTasksAcrossProcesses" + strconv.Itoa(i),
+			OutputPath:  "/tmp/output",
+		})
+	}
+
+	commands := []*exec.Cmd{}
+	outputs := []*bytes.Buffer{}
+
+	for i := 0; i < 3; i++ {
+		command := exec.Command(os.Args[0], "-test.run=^TestPopTasksHelperProcess$")
+		command.Env = append(
+			os.Environ(),
+			"YOUTUBE_DL_QUEUE_TEST_DB="+sqlitePath,
+			"YOUTUBE_DL_QUEUE_TEST_WORKER=process"+strconv.Itoa(i),
+		)
+
+		output := &bytes.Buffer{}
+		command.Stdout = output
+		command.Stderr = output
+
+		if err := command.Start(); err != nil {
+			t.Fatal(err)
+		}
+
+		commands = append(commands, command)
+		outputs = append(outputs, output)
+	}
+
+	popped := map[string]int{}
+
+	for i, command := range commands {
+		if err := command.Wait(); err != nil {
+			t.Fatalf("%s: %s", err, outputs[i])
+		}
+
+		for _, line := range strings.Split(outputs[i].String(), "\n") {
+			if strings.HasPrefix(line, "popped:") {
+				popped[strings.TrimPrefix(line, "popped:")] += 1
+			}
+		}
+	}
+
+	if len(popped) != 30 {
+		t.Fatalf("different popped tasks size! %d", len(popped))
+	}
+
+	for id, count := range popped {
+		if count != 1 {
+			t.Fatalf("task %s is popped %d times!", id, count)
+		}
+	}
 }
 
 func TestGetAllTasks(t *testing.T) {
@@ -253,7 +809,7 @@ func TestGetAllTasks(t *testing.T) {
 			Url:         "https://www.youtube.com/watch?v=GetAllTasks" + strconv.Itoa(i),
 			Title:       "TestGetAllTasks" + strconv.Itoa(i),
 			OutputPath:  "/tmp/output",
-			Parameter:   "",
+			Parameters:  nil,
 			CreatedAt:   0,
 			UpdatedAt:   0,
 		})
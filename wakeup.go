@@ -0,0 +1,172 @@
+package queue
+
+import (
+	"errors"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// announcer wakes every goroutine waiting on the channel of wait at once.
+type announcer struct {
+	mutex sync.Mutex
+	c     chan struct{}
+}
+
+func newAnnouncer() *announcer {
+	return &announcer{c: make(chan struct{})}
+}
+
+// wait returns a channel closed at the next announce.
+func (a *announcer) wait() <-chan struct{} {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return a.c
+}
+
+func (a *announcer) announce() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	close(a.c)
+	a.c = make(chan struct{})
+}
+
+// SetPollInterval sets how long idle workers wait before looking for tasks
+// without being woken up. It can be changed while the queue is running.
+func SetPollInterval(d time.Duration) error {
+	return defaultQueue.SetPollInterval(d)
+}
+
+func (q *Queue) SetPollInterval(d time.Duration) error {
+	if d <= 0 {
+		return errors.New("poll interval must be positive.")
+	}
+
+	q.pollIntervalMutex.Lock()
+	q.pollInterval = d
+	q.pollIntervalMutex.Unlock()
+
+	return nil
+}
+
+func GetPollInterval() time.Duration {
+	return defaultQueue.GetPollInterval()
+}
+
+func (q *Queue) GetPollInterval() time.Duration {
+	q.pollIntervalMutex.Lock()
+	defer q.pollIntervalMutex.Unlock()
+
+	return q.pollInterval
+}
+
+// SetNotifyDirectory makes processes sharing a SQLite db wake each other up
+// through unix sockets in dir, when tasks are queued or requeued.
+// Each started queue listens on a socket named after its pid there.
+// Set it before Start, and to the same directory in every process.
+func SetNotifyDirectory(dir string) {
+	defaultQueue.SetNotifyDirectory(dir)
+}
+
+func (q *Queue) SetNotifyDirectory(dir string) {
+	q.notifyDirectory = dir
+}
+
+// wakeWorkers wakes the idle workers of the queue, and of the queues
+// listening in the notify directory, to claim tasks queued just now.
+func (q *Queue) wakeWorkers() {
+	q.wakeups.announce()
+
+	if q.notifyDirectory == "" {
+		return
+	}
+
+	paths, err := filepath.Glob(filepath.Join(q.notifyDirectory, "*.sock"))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	for _, path := range paths {
+		if err := sendWakeup(path); err != nil {
+			log.Printf("wakeup %s: %s", path, err)
+		}
+	}
+}
+
+func sendWakeup(path string) error {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		// the socket of a process which died without removing it
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			return os.Remove(path)
+		}
+		return err
+	}
+	defer conn.Close()
+
+	// a full socket buffer means the process has wakeups to handle already
+	conn.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err = conn.Write([]byte{1}); err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return nil
+		}
+		return err
+	}
+
+	return nil
+}
+
+// listenWakeups wakes the workers of the queue on each wakeup
+// sent to its socket in the notify directory.
+func (q *Queue) listenWakeups() error {
+	if q.notifyDirectory == "" {
+		return nil
+	}
+
+	if err := os.MkdirAll(q.notifyDirectory, 0755); err != nil {
+		return err
+	}
+
+	path := filepath.Join(q.notifyDirectory, strconv.Itoa(os.Getpid())+q.instanceSuffix()+".sock")
+
+	// left by a process which had the same pid
+	os.Remove(path)
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	q.wakeupListener = conn
+	q.wakeupSocketPath = path
+
+	go func() {
+		buf := make([]byte, 16)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				return
+			}
+			q.wakeups.announce()
+		}
+	}()
+
+	return nil
+}
+
+// stopWakeups closes and removes the socket of the queue.
+func (q *Queue) stopWakeups() {
+	if q.wakeupListener == nil {
+		return
+	}
+
+	q.wakeupListener.Close()
+	q.wakeupListener = nil
+	os.Remove(q.wakeupSocketPath)
+}
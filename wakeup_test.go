@@ -0,0 +1,114 @@
+package queue
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSetPollInterval(t *testing.T) {
+	defaultPollInterval := GetPollInterval()
+	defer SetPollInterval(defaultPollInterval)
+
+	if err := SetPollInterval(0); err == nil {
+		t.Fatalf("accepted poll interval 0!")
+	}
+
+	if err := SetPollInterval(time.Second); err != nil || GetPollInterval() != time.Second {
+		t.Fatalf("different poll interval! %s %v", GetPollInterval(), err)
+	}
+}
+
+func TestWorkerWokenByQueueTask(t *testing.T) {
+	InitializeForTest(t)
+
+	defaultQueue.SetDownloader(NewYoutubeDl(writeStubDownloaderForTest(t)))
+
+	defaultPollInterval := GetPollInterval()
+	SetPollInterval(time.Hour)
+	defer SetPollInterval(defaultPollInterval)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defaultQueue.work(ctx, ctx, "worker-1")
+	}()
+
+	// the worker finds the queue empty and waits
+	time.Sleep(100 * time.Millisecond)
+
+	task := Task{VideoFormat: "135", AudioFormat: "140", Url: "https://www.youtube.com/watch?v=WokenByQueueTask", OutputPath: "/tmp/output"}
+	if err := task.QueueTask(); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if tasks, _ := GetAllTasks(); len(tasks) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("worker is not woken!")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	<-done
+}
+
+func TestWakeupAcrossProcesses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "youtube-dl-queue-notify-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	SetNotifyDirectory(dir)
+	defer SetNotifyDirectory("")
+
+	if err := defaultQueue.listenWakeups(); err != nil {
+		t.Fatal(err)
+	}
+
+	wakened := defaultQueue.wakeups.wait()
+
+	// sent by another process sharing the notify directory
+	if err := sendWakeup(defaultQueue.wakeupSocketPath); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-wakened:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("wakeup is not received!")
+	}
+
+	// the socket of a process which died
+	stalePath := filepath.Join(dir, "0.sock")
+	stale, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: stalePath, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.Close()
+
+	defaultQueue.wakeWorkers()
+
+	if _, err := os.Stat(stalePath); !os.IsNotExist(err) {
+		t.Fatalf("stale socket is not removed! %v", err)
+	}
+
+	socketPath := defaultQueue.wakeupSocketPath
+	defaultQueue.stopWakeups()
+
+	if _, err := os.Stat(socketPath); !os.IsNotExist(err) {
+		t.Fatalf("socket is not removed! %v", err)
+	}
+}
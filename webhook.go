@@ -0,0 +1,371 @@
+package queue
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	WebhookSignatureHeader = "X-Queue-Signature"
+	WebhookEventHeader     = "X-Queue-Event"
+)
+
+var (
+	webhookClient      = &http.Client{Timeout: 30 * time.Second}
+	webhookRetryPolicy = RetryPolicy{
+		MaxAttempts: 5,
+		BaseDelay:   time.Second,
+		MaxDelay:    time.Minute,
+		Jitter:      0.2,
+	}
+	// deliveries left after Stop are given up after it
+	webhookShutdownTimeout = 10 * time.Second
+)
+
+// Webhook is an HTTP endpoint notified when a task finishes or fails.
+// Events is empty to receive both.
+type Webhook struct {
+	Id        int64       `json:"id"`
+	Url       string      `json:"url"`
+	Secret    string      `json:"-"`
+	Events    []EventType `json:"events"`
+	CreatedAt int64       `json:"created_at"`
+}
+
+// WebhookPayload is the JSON body posted to webhooks.
+// Duration is the seconds from the start of the task to the event.
+type WebhookPayload struct {
+	Event      EventType   `json:"event"`
+	Task       Task        `json:"task"`
+	FailedTask *FailedTask `json:"failed_task,omitempty"`
+	OutputFile string      `json:"output_file"`
+	FormatIds  FormatIds   `json:"format_ids,omitempty"`
+	Duration   int64       `json:"duration"`
+	At         int64       `json:"at"`
+}
+
+// WebhookDelivery is one attempt to deliver an event to a webhook.
+type WebhookDelivery struct {
+	Id          int64     `json:"id"`
+	WebhookId   int64     `json:"webhook_id"`
+	Event       EventType `json:"event"`
+	TaskId      int64     `json:"task_id"`
+	VideoId     string    `json:"video_id"`
+	Attempt     int       `json:"attempt"`
+	StatusCode  int       `json:"status_code"`
+	Error       string    `json:"error"`
+	DeliveredAt int64     `json:"delivered_at"`
+	FormatIds   FormatIds `json:"format_ids"`
+}
+
+func (w Webhook) accepts(eventType EventType) bool {
+	if eventType != EventFinished && eventType != EventFailed {
+		return false
+	}
+
+	if len(w.Events) == 0 {
+		return true
+	}
+
+	for _, e := range w.Events {
+		if e == eventType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AddWebhook registers an endpoint. Payloads are signed with secret
+// when it is not empty.
+func AddWebhook(webhookUrl string, secret string, events []EventType) (webhook Webhook, err error) {
+	return defaultQueue.AddWebhook(webhookUrl, secret, events)
+}
+
+func (q *Queue) AddWebhook(webhookUrl string, secret string, events []EventType) (webhook Webhook, err error) {
+	u, err := url.Parse(webhookUrl)
+	if err != nil {
+		return webhook, err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return webhook, errors.New("webhook url must be http or https.")
+	}
+
+	for _, e := range events {
+		if e != EventFinished && e != EventFailed {
+			return webhook, fmt.Errorf("webhook cannot receive %s events.", e)
+		}
+	}
+
+	webhook = Webhook{
+		Url:       webhookUrl,
+		Secret:    secret,
+		Events:    events,
+		CreatedAt: time.Now().Unix(),
+	}
+
+	err = q.store.AddWebhook(&webhook)
+
+	return webhook, err
+}
+
+func RemoveWebhook(id int64) error {
+	return defaultQueue.RemoveWebhook(id)
+}
+
+func (q *Queue) RemoveWebhook(id int64) error {
+	return q.store.RemoveWebhook(id)
+}
+
+func GetAllWebhooks() (webhooks []Webhook, err error) {
+	return defaultQueue.GetAllWebhooks()
+}
+
+func (q *Queue) GetAllWebhooks() (webhooks []Webhook, err error) {
+	return q.store.ListWebhooks()
+}
+
+func GetWebhookDeliveries(webhookId int64) (deliveries []WebhookDelivery, err error) {
+	return defaultQueue.GetWebhookDeliveries(webhookId)
+}
+
+func (q *Queue) GetWebhookDeliveries(webhookId int64) (deliveries []WebhookDelivery, err error) {
+	return q.store.ListWebhookDeliveries(webhookId)
+}
+
+func joinEventTypes(events []EventType) string {
+	s := make([]string, len(events))
+	for i, e := range events {
+		s[i] = string(e)
+	}
+
+	return strings.Join(s, ",")
+}
+
+func splitEventTypes(s string) []EventType {
+	events := []EventType{}
+	for _, e := range strings.Split(s, ",") {
+		if e != "" {
+			events = append(events, EventType(e))
+		}
+	}
+
+	return events
+}
+
+// SignWebhookPayload returns the signature header value for body.
+func SignWebhookPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func newWebhookPayload(event Event) WebhookPayload {
+	payload := WebhookPayload{
+		Event:      event.Type,
+		Task:       event.Task,
+		FailedTask: event.FailedTask,
+		OutputFile: event.OutputFile,
+		FormatIds:  event.FormatIds,
+		At:         event.At,
+	}
+
+	if event.Task.StartedAt > 0 && event.At >= event.Task.StartedAt {
+		payload.Duration = event.At - event.Task.StartedAt
+	}
+
+	return payload
+}
+
+// webhookOutbox holds the finished and failed events of a started queue
+// until runWebhooks takes them. Unlike a Subscription it drops none of them,
+// and publishing never waits for deliveries.
+type webhookOutbox struct {
+	mutex  sync.Mutex
+	open   bool
+	events []Event
+	// signalled when events are pushed
+	ready chan struct{}
+}
+
+func newWebhookOutbox() *webhookOutbox {
+	return &webhookOutbox{ready: make(chan struct{}, 1)}
+}
+
+// push keeps a finished or failed event while the outbox is open.
+func (o *webhookOutbox) push(event Event) {
+	if event.Type != EventFinished && event.Type != EventFailed {
+		return
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if !o.open {
+		return
+	}
+
+	o.events = append(o.events, event)
+
+	select {
+	case o.ready <- struct{}{}:
+	default:
+	}
+}
+
+// take returns the events pushed since the last take.
+func (o *webhookOutbox) take() []Event {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	events := o.events
+	o.events = nil
+
+	return events
+}
+
+// setOpen starts or stops keeping the events pushed.
+func (o *webhookOutbox) setOpen(open bool) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.open = open
+}
+
+// runWebhooks delivers the events of the webhook outbox until ctx is done.
+// Then it closes the outbox, delivers the events left in it, and waits for
+// deliveries in flight for up to webhookShutdownTimeout.
+func (q *Queue) runWebhooks(ctx context.Context) {
+	deliveryCtx, cancelDeliveries := context.WithCancel(context.Background())
+	defer cancelDeliveries()
+
+	var wg sync.WaitGroup
+
+	for running := true; running; {
+		select {
+		case <-q.webhookOutbox.ready:
+		case <-ctx.Done():
+			running = false
+		}
+
+		for _, event := range q.webhookOutbox.take() {
+			q.startWebhookDeliveries(deliveryCtx, &wg, event)
+		}
+	}
+
+	q.webhookOutbox.setOpen(false)
+
+	timeout := time.AfterFunc(webhookShutdownTimeout, cancelDeliveries)
+	defer timeout.Stop()
+
+	for _, event := range q.webhookOutbox.take() {
+		q.startWebhookDeliveries(deliveryCtx, &wg, event)
+	}
+
+	wg.Wait()
+}
+
+// startWebhookDeliveries delivers a finished or failed event
+// to the webhooks accepting it, each in a goroutine added to wg.
+func (q *Queue) startWebhookDeliveries(ctx context.Context, wg *sync.WaitGroup, event Event) {
+	if event.Type != EventFinished && event.Type != EventFailed {
+		return
+	}
+
+	webhooks, err := q.GetAllWebhooks()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	for _, webhook := range webhooks {
+		if !webhook.accepts(event.Type) {
+			continue
+		}
+
+		wg.Add(1)
+		go func(webhook Webhook) {
+			defer wg.Done()
+			q.deliverWebhook(ctx, webhook, event)
+		}(webhook)
+	}
+}
+
+// deliverWebhook posts event to webhook, retrying with backoff
+// until it answers 2xx, attempts run out or ctx is done.
+func (q *Queue) deliverWebhook(ctx context.Context, webhook Webhook, event Event) error {
+	body, err := json.Marshal(newWebhookPayload(event))
+	if err != nil {
+		return err
+	}
+
+	for attempt := 1; ; attempt++ {
+		delivery := WebhookDelivery{
+			WebhookId: webhook.Id,
+			Event:     event.Type,
+			TaskId:    event.Task.Id,
+			VideoId:   event.Task.VideoId,
+			Attempt:   attempt,
+			FormatIds: event.FormatIds,
+		}
+
+		delivery.StatusCode, err = postWebhook(ctx, webhook, event.Type, body)
+		if err == nil && (delivery.StatusCode < 200 || delivery.StatusCode >= 300) {
+			err = fmt.Errorf("webhook responded %d.", delivery.StatusCode)
+		}
+		if err != nil {
+			delivery.Error = err.Error()
+		}
+
+		delivery.DeliveredAt = time.Now().Unix()
+		if logErr := q.store.AddWebhookDelivery(&delivery); logErr != nil {
+			log.Println(logErr)
+		}
+
+		if err == nil || !webhookRetryPolicy.Retryable(attempt) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(webhookRetryPolicy.Delay(attempt)):
+		}
+	}
+}
+
+func postWebhook(ctx context.Context, webhook Webhook, eventType EventType, body []byte) (statusCode int, err error) {
+	request, err := http.NewRequest(http.MethodPost, webhook.Url, bytes.NewReader(body))
+	if err != nil {
+		return statusCode, err
+	}
+
+	request = request.WithContext(ctx)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(WebhookEventHeader, string(eventType))
+	if webhook.Secret != "" {
+		request.Header.Set(WebhookSignatureHeader, SignWebhookPayload(webhook.Secret, body))
+	}
+
+	response, err := webhookClient.Do(request)
+	if err != nil {
+		return statusCode, err
+	}
+	defer response.Body.Close()
+
+	return response.StatusCode, nil
+}
@@ -0,0 +1,342 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type webhookServerForTest struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	failures int
+	requests []*http.Request
+	payloads []WebhookPayload
+	bodies   [][]byte
+}
+
+// newWebhookServerForTest answers 500 to the first failures requests and 200 afterwards.
+func newWebhookServerForTest(t *testing.T, failures int) *webhookServerForTest {
+	ws := &webhookServerForTest{failures: failures}
+	ws.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+
+		payload := WebhookPayload{}
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Error(err)
+		}
+
+		ws.mutex.Lock()
+		defer ws.mutex.Unlock()
+
+		ws.requests = append(ws.requests, r)
+		ws.payloads = append(ws.payloads, payload)
+		ws.bodies = append(ws.bodies, body)
+
+		if len(ws.requests) <= ws.failures {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+
+	return ws
+}
+
+func (ws *webhookServerForTest) received() int {
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+
+	return len(ws.requests)
+}
+
+func setWebhookRetryPolicyForTest(policy RetryPolicy) func() {
+	defaultPolicy := webhookRetryPolicy
+	webhookRetryPolicy = policy
+
+	return func() { webhookRetryPolicy = defaultPolicy }
+}
+
+func TestAddWebhook(t *testing.T) {
+	InitializeForTest(t)
+
+	if _, err := AddWebhook("ftp://example.com/hook", "", nil); err == nil {
+		t.Fatalf("accepted non http url!")
+	}
+
+	if _, err := AddWebhook("https://example.com/hook", "", []EventType{EventQueued}); err == nil {
+		t.Fatalf("accepted queued events!")
+	}
+
+	webhook, err := AddWebhook("https://example.com/hook", "secret", []EventType{EventFailed})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	webhooks, err := GetAllWebhooks()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(webhooks) != 1 || webhooks[0].Id != webhook.Id || webhooks[0].Secret != "secret" || len(webhooks[0].Events) != 1 || webhooks[0].Events[0] != EventFailed {
+		t.Fatalf("different webhooks! %+v", webhooks)
+	}
+
+	if webhooks[0].accepts(EventFinished) || !webhooks[0].accepts(EventFailed) {
+		t.Fatalf("different accepted events!")
+	}
+
+	if err := RemoveWebhook(webhook.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	if webhooks, _ := GetAllWebhooks(); len(webhooks) != 0 {
+		t.Fatalf("webhook is not removed!")
+	}
+}
+
+func TestDeliverWebhook(t *testing.T) {
+	InitializeForTest(t)
+
+	defer setWebhookRetryPolicyForTest(RetryPolicy{MaxAttempts: 5, BaseDelay: 10 * time.Millisecond, MaxDelay: 10 * time.Millisecond})()
+
+	server := newWebhookServerForTest(t, 2)
+	defer server.Close()
+
+	webhook, err := AddWebhook(server.URL, "secret", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := Event{
+		Type:       EventFinished,
+		Task:       Task{Id: 1, VideoId: "DeliverWebhook", VideoFormat: "135", AudioFormat: "140", StartedAt: 100},
+		OutputFile: "/tmp/output/title.mp4",
+		FormatIds:  FormatIds{"135", "140"},
+		At:         160,
+	}
+
+	if err := defaultQueue.deliverWebhook(context.Background(), webhook, event); err != nil {
+		t.Fatal(err)
+	}
+
+	if server.received() != 3 {
+		t.Fatalf("different requests size! %d", server.received())
+	}
+
+	request := server.requests[2]
+	if request.Header.Get(WebhookEventHeader) != string(EventFinished) {
+		t.Fatalf("different event header!")
+	}
+
+	if request.Header.Get(WebhookSignatureHeader) != SignWebhookPayload("secret", server.bodies[2]) {
+		t.Fatalf("different signature!")
+	}
+
+	payload := server.payloads[2]
+	if payload.Event != EventFinished || payload.Task.VideoId != "DeliverWebhook" || payload.OutputFile != "/tmp/output/title.mp4" || strings.Join(payload.FormatIds, "+") != "135+140" || payload.Duration != 60 {
+		t.Fatalf("different payload! %+v", payload)
+	}
+
+	deliveries, err := GetWebhookDeliveries(webhook.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(deliveries) != 3 {
+		t.Fatalf("different deliveries size! %d", len(deliveries))
+	}
+
+	for i, statusCode := range []int{500, 500, 200} {
+		if deliveries[i].Attempt != i+1 || deliveries[i].StatusCode != statusCode || deliveries[i].TaskId != 1 || deliveries[i].VideoId != "DeliverWebhook" || strings.Join(deliveries[i].FormatIds, "+") != "135+140" {
+			t.Fatalf("different delivery! %+v", deliveries[i])
+		}
+	}
+
+	if deliveries[2].Error != "" {
+		t.Fatalf("successful delivery has error! %s", deliveries[2].Error)
+	}
+}
+
+func TestDeliverWebhookGivesUp(t *testing.T) {
+	InitializeForTest(t)
+
+	defer setWebhookRetryPolicyForTest(RetryPolicy{MaxAttempts: 2})()
+
+	server := newWebhookServerForTest(t, 100)
+	defer server.Close()
+
+	webhook, err := AddWebhook(server.URL, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := defaultQueue.deliverWebhook(context.Background(), webhook, Event{Type: EventFailed}); err == nil {
+		t.Fatalf("failed delivery returned no error!")
+	}
+
+	if server.received() != 2 {
+		t.Fatalf("different requests size! %d", server.received())
+	}
+
+	if server.requests[0].Header.Get(WebhookSignatureHeader) != "" {
+		t.Fatalf("signed without secret!")
+	}
+}
+
+func TestRunWebhooks(t *testing.T) {
+	InitializeForTest(t)
+
+	defaultQueue.SetDownloader(NewYoutubeDl(writeStubDownloaderForTest(t)))
+
+	server := newWebhookServerForTest(t, 0)
+	defer server.Close()
+
+	failedOnly := newWebhookServerForTest(t, 0)
+	defer failedOnly.Close()
+
+	if _, err := AddWebhook(server.URL, "", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := AddWebhook(failedOnly.URL, "", []EventType{EventFailed}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	defaultQueue.webhookOutbox.setOpen(true)
+
+	go func() {
+		defer close(done)
+		defaultQueue.runWebhooks(ctx)
+	}()
+
+	insertTaskForTest(t, Task{
+		VideoFormat: "135",
+		AudioFormat: "140",
+		Url:         "https://www.youtube.com/watch?v=RunWebhooks",
+		Title:       "TestRunWebhooks",
+		OutputPath:  "/tmp/output",
+	})
+
+	tasks, err := defaultQueue.popTasks("0", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := defaultQueue.runTask(context.Background(), tasks[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 50 && server.received() == 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	cancel()
+	<-done
+
+	if server.received() != 1 {
+		t.Fatalf("different requests size! %d", server.received())
+	}
+
+	if server.payloads[0].Task.VideoId != "RunWebhooks" || server.payloads[0].Event != EventFinished {
+		t.Fatalf("different payload! %+v", server.payloads[0])
+	}
+
+	if failedOnly.received() != 0 {
+		t.Fatalf("finished event is delivered to failed only webhook!")
+	}
+}
+
+func TestWebhookOutbox(t *testing.T) {
+	outbox := newWebhookOutbox()
+
+	// events are not kept until the queue starts
+	outbox.push(Event{Type: EventFinished})
+
+	outbox.setOpen(true)
+	for i := 0; i < 2000; i++ {
+		outbox.push(Event{Type: EventFinished, Task: Task{Id: int64(i)}})
+		outbox.push(Event{Type: EventProgress})
+	}
+
+	select {
+	case <-outbox.ready:
+	default:
+		t.Fatalf("outbox is not ready!")
+	}
+
+	// nothing is dropped however long deliveries take
+	events := outbox.take()
+	if len(events) != 2000 || events[0].Task.Id != 0 || events[1999].Task.Id != 1999 {
+		t.Fatalf("different events size! %d", len(events))
+	}
+
+	outbox.setOpen(false)
+	outbox.push(Event{Type: EventFailed})
+
+	if events := outbox.take(); len(events) != 0 {
+		t.Fatalf("closed outbox keeps events! %+v", events)
+	}
+}
+
+func TestStopDeliversWebhooks(t *testing.T) {
+	server := newWebhookServerForTest(t, 0)
+	defer server.Close()
+
+	logDir, err := ioutil.TempDir("", "youtube-dl-queue-log-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q, err := New(Options{
+		Store:           NewMemoryStore(),
+		YoutubeDlPath:   writeStubDownloaderForTest(t),
+		FFmpegPath:      NoFFmpeg,
+		LogDirectory:    logDir,
+		StopGracePeriod: 10 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := q.AddWebhook(server.URL, "", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// finishes a second after it starts
+	task := Task{VideoFormat: "135", AudioFormat: "140", Url: "https://www.youtube.com/watch?v=sleepStopWebhooks", OutputPath: "/tmp/output"}
+	if err := q.QueueTask(&task); err != nil {
+		t.Fatal(err)
+	}
+
+	s := q.Subscribe(16)
+	if _, err := q.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for event := range s.C {
+		if event.Type == EventStarted {
+			break
+		}
+	}
+	s.Unsubscribe()
+
+	q.Stop()
+
+	if server.received() != 1 {
+		t.Fatalf("different requests size! %d", server.received())
+	}
+
+	if server.payloads[0].Event != EventFinished || server.payloads[0].Task.Id != task.Id {
+		t.Fatalf("different payload! %+v", server.payloads[0])
+	}
+}